@@ -1,6 +1,7 @@
 package archive
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -12,3 +13,90 @@ type Archive interface {
 	// Unpack reads the archive and restores it to the destination
 	Unpack(dst string, r io.Reader) error
 }
+
+// Namer is implemented by archives that can name their format.
+type Namer interface {
+	// Name returns the name of the format, for example "tar".
+	Name() string
+}
+
+// Name returns the format name of the archive, or an empty string if the
+// archive doesn't implement Namer.
+func Name(a Archive) string {
+	if n, ok := a.(Namer); ok {
+		return n.Name()
+	}
+
+	return ""
+}
+
+// OptionPacker is implemented by archives that accept options for a single
+// Pack call. The options are applied on top of the ones the archive was
+// created with.
+type OptionPacker interface {
+	PackWithOptions(srcs []string, w io.Writer, opts ...Option) error
+}
+
+// PackWithOptions packs the sources with the options if the archive
+// supports them, and with its own options otherwise.
+func PackWithOptions(a Archive, srcs []string, w io.Writer, opts ...Option) error {
+	if p, ok := a.(OptionPacker); ok {
+		return p.PackWithOptions(srcs, w, opts...)
+	}
+
+	return a.Pack(srcs, w)
+}
+
+// Result describes what an Unpack call did.
+type Result struct {
+	// Conflicts is the number of entries whose destination already existed.
+	Conflicts int
+
+	// Skipped is the number of entries that were not unpacked because of
+	// the conflict policy.
+	Skipped int
+}
+
+// OptionUnpacker is implemented by archives that accept options for a single
+// Unpack call and report what they did. The options are applied on top of
+// the ones the archive was created with.
+type OptionUnpacker interface {
+	UnpackWithOptions(dst string, r io.Reader, opts ...Option) (Result, error)
+}
+
+// UnpackWithOptions unpacks the archive with the options if the archive
+// supports them, and with its own options and an empty result otherwise.
+func UnpackWithOptions(a Archive, dst string, r io.Reader, opts ...Option) (Result, error) {
+	if u, ok := a.(OptionUnpacker); ok {
+		return u.UnpackWithOptions(dst, r, opts...)
+	}
+
+	return Result{}, a.Unpack(dst, r)
+}
+
+// ConflictError is returned by Unpack when an entry's destination already
+// exists and the conflict policy is ConflictFail.
+type ConflictError struct {
+	Path string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("file already exists at %s", e.Path)
+}
+
+// LimitError is returned by Unpack when the archive exceeds one of the
+// configured limits.
+type LimitError struct {
+	// Limit names the limit, for example "file size".
+	Limit string
+
+	// Max is the configured value of the limit.
+	Max int64
+
+	// Path is the entry that exceeded the limit, or the destination.
+	Path string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %d exceeded at %s", e.Limit, e.Max, e.Path)
+}
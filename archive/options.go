@@ -0,0 +1,240 @@
+package archive
+
+import (
+	"archive/tar"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/progress"
+)
+
+// Options contains configuration shared by the archive formats.
+type Options struct {
+	// Concurrency is the number of goroutines compressing, decompressing
+	// and writing files. It defaults to 1, which disables all parallelism.
+	Concurrency int
+
+	// Level is the compression level of compressed formats, from 0 for no
+	// compression to 9 for the best. It defaults to -1, the default level
+	// of the format.
+	Level int
+
+	// Format is the tar header format. It defaults to the format Go picks
+	// for every header.
+	Format tar.Format
+
+	// BufferSize is the size of the buffer files are copied with. It
+	// defaults to 32KiB.
+	BufferSize int
+
+	// BlockSize is the amount of data compressed or read ahead as one unit
+	// when running concurrently. It defaults to 1MiB.
+	BlockSize int
+
+	// Symlinks selects which symlinks are stored as the files they point
+	// to instead of as links. It defaults to SymlinksKeep.
+	Symlinks SymlinkMode
+
+	// Conflict decides what Unpack does with entries whose destination
+	// already exists. It defaults to ConflictOverwrite.
+	Conflict ConflictPolicy
+
+	// Atomic makes Unpack extract into a staging directory next to the
+	// destination and move the unpacked roots into place only after the
+	// whole archive was read. A failed Unpack leaves the destination
+	// untouched. Each root replaces the existing path as a whole, with the
+	// conflict policy deciding per root. An archive of "." replaces the
+	// content of the destination.
+	Atomic bool
+
+	// Limits bounds what Unpack writes. The zero value has no limits.
+	Limits Limits
+
+	// Progress receives the progress of Pack and Unpack. It may be nil.
+	Progress progress.Observer
+
+	// Logger receives the log messages of Pack and Unpack. It defaults to
+	// logger.Discard.
+	Logger logger.Logger
+}
+
+// Limits bounds what Unpack writes, to protect against corrupted or
+// malicious archives. Zero disables a limit. Exceeding one aborts Unpack
+// with a *LimitError and removes what it created.
+type Limits struct {
+	// MaxBytes is the total size of all files.
+	MaxBytes int64
+
+	// MaxFileSize is the size of a single file.
+	MaxFileSize int64
+
+	// MaxEntries is the number of entries.
+	MaxEntries int
+
+	// MaxPathLength is the length of an entry's name.
+	MaxPathLength int
+
+	// MaxDepth is the number of path elements of an entry's name.
+	MaxDepth int
+
+	// MinFreeSpace is the free space in bytes the destination needs before
+	// anything is unpacked. It is not checked on platforms that can't
+	// report free space.
+	MinFreeSpace int64
+}
+
+// WithLimits sets the limits Unpack enforces.
+func WithLimits(limits Limits) Option {
+	return func(o *Options) {
+		o.Limits = limits
+	}
+}
+
+// SymlinkMode selects how symlinks are packed.
+type SymlinkMode int
+
+const (
+	// SymlinksKeep stores every symlink as a link.
+	SymlinksKeep SymlinkMode = iota
+
+	// SymlinksFollow stores the files every symlink points to.
+	SymlinksFollow
+
+	// SymlinksFollowOutside stores the files symlinks point to when they are
+	// outside of the packed sources, and keeps links within them.
+	SymlinksFollowOutside
+)
+
+// Option configures an archive.
+type Option func(*Options)
+
+// WithConcurrency sets the number of goroutines compressing, decompressing
+// and writing files.
+func WithConcurrency(n int) Option {
+	return func(o *Options) {
+		o.Concurrency = n
+	}
+}
+
+// WithLevel sets the compression level of compressed formats.
+func WithLevel(level int) Option {
+	return func(o *Options) {
+		o.Level = level
+	}
+}
+
+// WithFormat sets the tar header format, for example tar.FormatPAX.
+func WithFormat(format tar.Format) Option {
+	return func(o *Options) {
+		o.Format = format
+	}
+}
+
+// WithBufferSize sets the size of the buffer files are copied with.
+func WithBufferSize(n int) Option {
+	return func(o *Options) {
+		o.BufferSize = n
+	}
+}
+
+// WithBlockSize sets the amount of data compressed or read ahead as one
+// unit when running concurrently.
+func WithBlockSize(n int) Option {
+	return func(o *Options) {
+		o.BlockSize = n
+	}
+}
+
+// ConflictPolicy decides what happens when an entry is unpacked to a path
+// that already exists. A directory unpacked onto an existing directory is
+// not a conflict.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing path with the entry.
+	ConflictOverwrite ConflictPolicy = iota
+
+	// ConflictSkip keeps the existing path and skips the entry.
+	ConflictSkip
+
+	// ConflictKeepNewer replaces the existing path only if the entry was
+	// modified after it.
+	ConflictKeepNewer
+
+	// ConflictFail aborts unpacking with a *ConflictError.
+	ConflictFail
+)
+
+// WithConflict sets what Unpack does with entries whose destination already
+// exists.
+func WithConflict(policy ConflictPolicy) Option {
+	return func(o *Options) {
+		o.Conflict = policy
+	}
+}
+
+// WithAtomic makes Unpack leave the destination untouched unless the whole
+// archive could be unpacked.
+func WithAtomic(atomic bool) Option {
+	return func(o *Options) {
+		o.Atomic = atomic
+	}
+}
+
+// WithLogger sets the logger receiving the messages of Pack and Unpack.
+func WithLogger(l logger.Logger) Option {
+	return func(o *Options) {
+		o.Logger = l
+	}
+}
+
+// WithProgress sets the observer receiving the progress of Pack and Unpack.
+func WithProgress(o progress.Observer) Option {
+	return func(opts *Options) {
+		opts.Progress = o
+	}
+}
+
+// WithSymlinks sets which symlinks are stored as the files they point to.
+func WithSymlinks(mode SymlinkMode) Option {
+	return func(o *Options) {
+		o.Symlinks = mode
+	}
+}
+
+// WithFollowSymlinks stores the files all symlinks point to instead of the
+// links.
+func WithFollowSymlinks(follow bool) Option {
+	if follow {
+		return WithSymlinks(SymlinksFollow)
+	}
+
+	return WithSymlinks(SymlinksKeep)
+}
+
+// NewOptions returns the default options with opts applied.
+func NewOptions(opts ...Option) Options {
+	o := Options{
+		Concurrency: 1,
+		Level:       -1,
+		BufferSize:  32 << 10,
+		BlockSize:   1 << 20,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	if o.BufferSize < 1 {
+		o.BufferSize = 32 << 10
+	}
+	if o.BlockSize < 1 {
+		o.BlockSize = 1 << 20
+	}
+
+	o.Logger = logger.OrDiscard(o.Logger)
+
+	return o
+}
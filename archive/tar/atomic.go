@@ -0,0 +1,303 @@
+package tar
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/logger"
+)
+
+// swap records a root moved into place, and where the path it replaced was
+// moved to. A swap without a staged path only moves the target away.
+type swap struct {
+	target string
+	staged string
+	backup string
+	log    logger.Logger
+}
+
+// unpackAtomic extracts the archive into a staging directory next to dst
+// and moves every root of the archive into place once the archive was read
+// to the end. A root is an entry none of whose parent directories are in the
+// archive. A "." root stands for dst itself, so its children are moved into
+// place and what else dst contains is removed.
+func unpackAtomic(dst string, r io.Reader, opts archive.Options) (archive.Result, error) {
+	log := opts.Logger
+	dir := dst
+	if dir == "" {
+		dir = "."
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return archive.Result{}, err
+	}
+
+	// Stage next to dst, so moving into place is a rename on the same
+	// filesystem and the staging directory never shows up in dst
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return archive.Result{}, err
+	}
+
+	work, err := ioutil.TempDir(filepath.Dir(abs), "."+filepath.Base(abs)+".unpack-")
+	if err != nil {
+		return archive.Result{}, err
+	}
+
+	defer os.RemoveAll(work)
+
+	staging := filepath.Join(work, "staging")
+	if err := os.Mkdir(staging, 0755); err != nil {
+		return archive.Result{}, err
+	}
+
+	dirs := make(map[string]bool)
+	headers := make(map[string]*tar.Header)
+	var roots []*tar.Header
+
+	res, err := unpack(staging, r, opts, func(header *tar.Header) {
+		name := path.Clean(header.Name)
+		headers[name] = header
+
+		if !hasParent(name, dirs) {
+			roots = append(roots, header)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			dirs[name] = true
+		}
+	})
+
+	if err != nil {
+		return res, err
+	}
+
+	// Read up to the end of the stream so compressed formats verify their
+	// checksum before anything is moved into place
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return res, err
+	}
+
+	// The staging directory started out empty, only the roots can conflict
+	res.Conflicts = 0
+	res.Skipped = 0
+
+	var swaps []swap
+
+	for _, header := range roots {
+		name := path.Clean(header.Name)
+
+		if name == "." {
+			more, err := dotSwaps(dir, staging, work, header, headers, &res, opts, len(swaps))
+			if err != nil {
+				return res, rollback(swaps, err)
+			}
+
+			for _, s := range more {
+				if err := s.apply(); err != nil {
+					return res, rollback(swaps, err)
+				}
+
+				swaps = append(swaps, s)
+			}
+
+			continue
+		}
+
+		s := swap{
+			target: filepath.Join(dir, name),
+			staged: filepath.Join(staging, name),
+			log:    log,
+		}
+
+		write, err := s.resolve(header, &res, opts, work, len(swaps))
+		if err != nil {
+			return res, rollback(swaps, err)
+		}
+
+		if !write {
+			continue
+		}
+
+		if err := s.apply(); err != nil {
+			return res, rollback(swaps, err)
+		}
+
+		swaps = append(swaps, s)
+	}
+
+	log.Debugf("Moved %d unpacked paths into place", len(swaps))
+
+	return res, nil
+}
+
+// resolve checks the target of the swap for a conflict and decides under
+// the conflict policy whether the staged path replaces it. A replaced path
+// is backed up into the work directory.
+func (s *swap) resolve(header *tar.Header, res *archive.Result, opts archive.Options, work string, n int) (bool, error) {
+	fi, err := os.Lstat(s.target)
+
+	switch {
+	case os.IsNotExist(err):
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+
+	res.Conflicts++
+
+	write, err := replaces(s.target, fi, header, opts.Conflict)
+	if err != nil {
+		return false, err
+	}
+
+	if !write {
+		opts.Logger.Debugf("Skipping %s because it already exists", s.target)
+		res.Skipped++
+		return false, nil
+	}
+
+	s.backup = filepath.Join(work, fmt.Sprintf("backup-%d", n))
+	return true, nil
+}
+
+// dotSwaps returns the swaps that make dir match the staged "." root: every
+// staged child is moved into place like a root, and the other children of
+// dir are removed if the policy lets the root replace dir.
+func dotSwaps(dir, staging, work string, header *tar.Header, headers map[string]*tar.Header, res *archive.Result, opts archive.Options, n int) ([]swap, error) {
+	staged, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var swaps []swap
+	names := make(map[string]bool)
+
+	for _, fi := range staged {
+		names[fi.Name()] = true
+
+		// Children created for deeper entries have no header of their own
+		h := headers[fi.Name()]
+		if h == nil {
+			h = header
+		}
+
+		s := swap{
+			target: filepath.Join(dir, fi.Name()),
+			staged: filepath.Join(staging, fi.Name()),
+			log:    opts.Logger,
+		}
+
+		write, err := s.resolve(h, res, opts, work, n+len(swaps))
+		if err != nil {
+			return nil, err
+		}
+
+		if write {
+			swaps = append(swaps, s)
+		}
+	}
+
+	for _, fi := range existing {
+		if names[fi.Name()] {
+			continue
+		}
+
+		// Removing the rest is a conflict of the root with dir itself
+		s := swap{
+			target: filepath.Join(dir, fi.Name()),
+			log:    opts.Logger,
+		}
+
+		write, err := s.resolve(header, res, opts, work, n+len(swaps))
+		if err != nil {
+			return nil, err
+		}
+
+		if write {
+			swaps = append(swaps, s)
+		}
+	}
+
+	return swaps, nil
+}
+
+// hasParent reports whether one of the parent directories of name is in
+// dirs. A "." entry is the parent of every other entry.
+func hasParent(name string, dirs map[string]bool) bool {
+	if name == "." {
+		return false
+	}
+
+	for parent := path.Dir(name); ; parent = path.Dir(parent) {
+		if dirs[parent] {
+			return true
+		}
+
+		if parent == "." || parent == "/" {
+			return false
+		}
+	}
+}
+
+// apply moves the path at the target out of the way and the staged root in.
+func (s swap) apply() error {
+	if s.backup != "" {
+		if err := os.Rename(s.target, s.backup); err != nil {
+			return err
+		}
+	}
+
+	if s.staged == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.target), 0755); err != nil {
+		return s.undo(err)
+	}
+
+	if err := os.Rename(s.staged, s.target); err != nil {
+		return s.undo(err)
+	}
+
+	return nil
+}
+
+// undo moves the original path back after apply failed.
+func (s swap) undo(err error) error {
+	if s.backup != "" {
+		if rerr := os.Rename(s.backup, s.target); rerr != nil {
+			s.log.Warnf("Failed to restore %s: %s", s.target, rerr)
+		}
+	}
+
+	return err
+}
+
+// rollback reverts the swaps that were applied, in reverse order, and
+// returns err.
+func rollback(swaps []swap, err error) error {
+	for i := len(swaps) - 1; i >= 0; i-- {
+		s := swaps[i]
+
+		if rerr := os.RemoveAll(s.target); rerr != nil {
+			s.log.Warnf("Failed to remove %s: %s", s.target, rerr)
+			continue
+		}
+
+		s.undo(nil)
+	}
+
+	return err
+}
@@ -0,0 +1,49 @@
+package tar
+
+import (
+	"archive/tar"
+	"os"
+
+	"github.com/drone/drone-cache-lib/archive"
+)
+
+// resolveConflict decides whether the entry is written to target under the
+// policy, and reports whether something already existed there. Whatever the
+// entry replaces is removed, so it is always written to a fresh path.
+func resolveConflict(target string, header *tar.Header, policy archive.ConflictPolicy) (bool, bool, error) {
+	fi, err := os.Lstat(target)
+
+	if os.IsNotExist(err) {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+
+	// directories are merged
+	if header.Typeflag == tar.TypeDir && fi.IsDir() {
+		return true, false, nil
+	}
+
+	write, err := replaces(target, fi, header, policy)
+	if !write || err != nil {
+		return false, true, err
+	}
+
+	return true, true, os.RemoveAll(target)
+}
+
+// replaces reports whether the entry replaces the existing path under the
+// policy.
+func replaces(target string, fi os.FileInfo, header *tar.Header, policy archive.ConflictPolicy) (bool, error) {
+	switch policy {
+	case archive.ConflictFail:
+		return false, &archive.ConflictError{Path: target}
+	case archive.ConflictSkip:
+		return false, nil
+	case archive.ConflictKeepNewer:
+		return header.ModTime.After(fi.ModTime()), nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package tar
+
+// freeSpace reports that the free space is unknown on this platform.
+func freeSpace(dir string) (int64, bool, error) {
+	return 0, false, nil
+}
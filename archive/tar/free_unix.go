@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package tar
+
+import (
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem of dir.
+func freeSpace(dir string) (int64, bool, error) {
+	var st syscall.Statfs_t
+
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, false, err
+	}
+
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), true, nil
+}
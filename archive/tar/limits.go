@@ -0,0 +1,136 @@
+package tar
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/logger"
+)
+
+// limiter enforces the limits on the entries of an archive and remembers
+// what was created, so it can be removed again.
+type limiter struct {
+	limits  archive.Limits
+	log     logger.Logger
+	bytes   int64
+	entries int
+	created []string
+}
+
+// check returns a *archive.LimitError if the entry exceeds a limit.
+func (l *limiter) check(header *tar.Header) error {
+	l.entries++
+
+	name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+
+	switch {
+	case l.limits.MaxEntries > 0 && l.entries > l.limits.MaxEntries:
+		return l.exceeded("entry count", int64(l.limits.MaxEntries), header)
+	case l.limits.MaxPathLength > 0 && len(header.Name) > l.limits.MaxPathLength:
+		return l.exceeded("path length", int64(l.limits.MaxPathLength), header)
+	case l.limits.MaxDepth > 0 && strings.Count(name, "/")+1 > l.limits.MaxDepth:
+		return l.exceeded("directory depth", int64(l.limits.MaxDepth), header)
+	}
+
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	l.bytes += header.Size
+
+	switch {
+	case l.limits.MaxFileSize > 0 && header.Size > l.limits.MaxFileSize:
+		return l.exceeded("file size", l.limits.MaxFileSize, header)
+	case l.limits.MaxBytes > 0 && l.bytes > l.limits.MaxBytes:
+		return l.exceeded("total size", l.limits.MaxBytes, header)
+	}
+
+	return nil
+}
+
+func (l *limiter) exceeded(limit string, max int64, header *tar.Header) error {
+	return &archive.LimitError{Limit: limit, Max: max, Path: header.Name}
+}
+
+// checkFree returns a *archive.LimitError if dst has less free space than
+// required.
+func (l *limiter) checkFree(dst string) error {
+	if l.limits.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	// the destination is created while unpacking
+	dir := dst
+	if dir == "" {
+		dir = "."
+	}
+
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	free, ok, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		l.log.Debugf("Free space of %s is unknown", dst)
+		return nil
+	}
+
+	if free < l.limits.MinFreeSpace {
+		return &archive.LimitError{Limit: "free space", Max: l.limits.MinFreeSpace, Path: dir}
+	}
+
+	return nil
+}
+
+// create records that the unpack added the path, so cleanup removes it.
+// Nothing is recorded without limits.
+func (l *limiter) create(p string) {
+	if l.limits != (archive.Limits{}) {
+		l.created = append(l.created, p)
+	}
+}
+
+// mkdirAll creates the directory and its parents unless it exists, and
+// records the first one that didn't exist.
+func (l *limiter) mkdirAll(dir string) error {
+	if _, err := os.Lstat(dir); err == nil {
+		return nil
+	}
+
+	missing := dir
+	for parent := filepath.Dir(missing); parent != missing; parent = filepath.Dir(missing) {
+		if _, err := os.Lstat(parent); err == nil {
+			break
+		}
+		missing = parent
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	l.create(missing)
+	return nil
+}
+
+// cleanup removes what was created, newest first.
+func (l *limiter) cleanup() {
+	for i := len(l.created) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(l.created[i]); err != nil {
+			l.log.Warnf("Failed to remove %s: %s", l.created[i], err)
+		}
+	}
+
+	l.created = nil
+}
@@ -0,0 +1,111 @@
+package tar
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// symlinkChecker makes sure entries are never written through a symlink
+// that leads out of the destination, like an entry "link/file" after a
+// symlink "link" to another directory.
+type symlinkChecker struct {
+	dst  string
+	real string
+
+	// safe holds the directories that were checked since the last symlink
+	// was created
+	safe map[string]bool
+}
+
+func newSymlinkChecker(dst string) (*symlinkChecker, error) {
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	real, err := evalExisting(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &symlinkChecker{
+		dst:  filepath.Clean(dst),
+		real: real,
+		safe: make(map[string]bool),
+	}, nil
+}
+
+// check returns an error if a parent directory of the target below the
+// destination is a symlink that resolves outside of it.
+func (c *symlinkChecker) check(target string) error {
+	rel, err := filepath.Rel(c.dst, filepath.Dir(target))
+	if err != nil || rel == "." {
+		return err
+	}
+
+	dir := c.dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+
+		if c.safe[dir] {
+			continue
+		}
+
+		fi, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// the rest is created by the unpack
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if err := c.within(dir); err != nil {
+				return err
+			}
+		}
+
+		c.safe[dir] = true
+	}
+
+	return nil
+}
+
+// within returns an error if the symlink resolves outside of the
+// destination.
+func (c *symlinkChecker) within(link string) error {
+	real, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return err
+	}
+
+	if real != c.real && !strings.HasPrefix(real, c.real+string(filepath.Separator)) {
+		return fmt.Errorf("path %s is below a symlink to %s outside of the destination", link, real)
+	}
+
+	return nil
+}
+
+// reset forgets the checked directories after a symlink was created.
+func (c *symlinkChecker) reset() {
+	c.safe = make(map[string]bool)
+}
+
+// evalExisting resolves the symlinks of the part of the path that exists,
+// as the destination may be a symlink itself or not exist yet.
+func evalExisting(abs string) (string, error) {
+	for p := abs; ; p = filepath.Dir(p) {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			rel, _ := filepath.Rel(p, abs)
+			return filepath.Join(real, rel), nil
+		}
+
+		if !os.IsNotExist(err) || filepath.Dir(p) == p {
+			return "", err
+		}
+	}
+}
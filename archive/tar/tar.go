@@ -8,25 +8,75 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/progress"
 )
 
-type tarArchive struct{}
+// maxBuffered is the largest file that is read into memory so it can be
+// written by another goroutine while unpacking continues.
+const maxBuffered = 4 << 20
 
-// New creates an archive that uses the .tar file format.
-func New() archive.Archive {
-	return &tarArchive{}
+type tarArchive struct {
+	fns  []archive.Option
+	opts archive.Options
+}
+
+// New creates an archive that uses the .tar file format. It also accepts
+// options per call through archive.PackWithOptions and
+// archive.UnpackWithOptions.
+func New(opts ...archive.Option) archive.Archive {
+	return &tarArchive{
+		fns:  opts,
+		opts: archive.NewOptions(opts...),
+	}
+}
+
+func (a *tarArchive) Name() string {
+	return "tar"
 }
 
 func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
-	tw := tar.NewWriter(w)
+	return pack(srcs, w, a.opts)
+}
+
+func (a *tarArchive) PackWithOptions(srcs []string, w io.Writer, opts ...archive.Option) error {
+	return pack(srcs, w, a.options(opts))
+}
+
+// options returns the options of the archive with opts applied on top.
+func (a *tarArchive) options(opts []archive.Option) archive.Options {
+	fns := append(append([]archive.Option(nil), a.fns...), opts...)
+	return archive.NewOptions(fns...)
+}
+
+func pack(srcs []string, w io.Writer, opts archive.Options) (err error) {
+	log := opts.Logger
+	t := progress.NewTracker(opts.Progress, progress.Pack, 0)
+
+	defer func() {
+		if err != nil {
+			t.Fail(err)
+		}
+	}()
+
+	tw := tar.NewWriter(t.Writer(w))
 	defer tw.Close()
 
+	buf := make([]byte, opts.BufferSize)
+
+	var roots []string
+	if opts.Symlinks == archive.SymlinksFollowOutside {
+		var err error
+		if roots, err = resolveRoots(srcs); err != nil {
+			return err
+		}
+	}
+
 	// Loop through each source
 	var fwErr error
 	for _, s := range srcs {
@@ -36,7 +86,7 @@ func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
 		}
 
 		// walk path
-		fwErr = filepath.Walk(s, func(path string, fi os.FileInfo, err error) error {
+		fwErr = walk(s, opts.Symlinks, roots, log, func(path string, fi os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
@@ -61,6 +111,7 @@ func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
 			}
 
 			header.Name = strings.TrimPrefix(filepath.ToSlash(path), "/")
+			header.Format = opts.Format
 
 			if err = tw.WriteHeader(header); err != nil {
 				return err
@@ -72,6 +123,7 @@ func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
 			}
 
 			log.Debugf("File found at %s", path)
+			t.File(path)
 
 			file, err := os.Open(path)
 			if err != nil {
@@ -79,7 +131,7 @@ func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
 			}
 
 			defer file.Close()
-			_, err = io.Copy(tw, file)
+			_, err = io.CopyBuffer(tw, t.Reader(file), buf)
 			return err
 		})
 
@@ -88,11 +140,63 @@ func (a *tarArchive) Pack(srcs []string, w io.Writer) error {
 		}
 	}
 
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	t.Done()
 	return fwErr
 }
 
 func (a *tarArchive) Unpack(dst string, r io.Reader) error {
-	tr := tar.NewReader(r)
+	_, err := a.UnpackWithOptions(dst, r)
+	return err
+}
+
+func (a *tarArchive) UnpackWithOptions(dst string, r io.Reader, opts ...archive.Option) (archive.Result, error) {
+	o := a.options(opts)
+
+	if o.Atomic {
+		return unpackAtomic(dst, r, o)
+	}
+
+	return unpack(dst, r, o, nil)
+}
+
+// unpack extracts the archive to dst, calling entry for every header that
+// is unpacked if it isn't nil.
+func unpack(dst string, r io.Reader, opts archive.Options, entry func(*tar.Header)) (archive.Result, error) {
+	log := opts.Logger
+	t := progress.NewTracker(opts.Progress, progress.Unpack, 0)
+
+	tr := tar.NewReader(t.Reader(r))
+
+	w := newFileWriter(opts.Concurrency)
+	defer w.Wait()
+
+	buf := make([]byte, opts.BufferSize)
+
+	var res archive.Result
+	var skipped string
+
+	l := &limiter{limits: opts.Limits, log: log}
+	if err := l.checkFree(dst); err != nil {
+		return res, err
+	}
+
+	sc, err := newSymlinkChecker(dst)
+	if err != nil {
+		return res, err
+	}
+
+	// remove everything written so far when the unpack fails
+	fail := func(err error) (archive.Result, error) {
+		w.Wait()
+		l.cleanup()
+		t.Fail(err)
+
+		return res, err
+	}
 
 	for {
 		header, err := tr.Next()
@@ -101,19 +205,89 @@ func (a *tarArchive) Unpack(dst string, r io.Reader) error {
 
 		// if no more files are found return
 		case err == io.EOF:
-			return nil
+			if err := w.Wait(); err != nil {
+				return fail(err)
+			}
+
+			t.Done()
+			return res, nil
 
 		// return any other error
 		case err != nil:
-			return err
+			return fail(err)
 
 		// if the header is nil, just skip it (not sure how this happens)
 		case header == nil:
 			continue
 		}
 
+		// stop early if writing a file failed
+		if err := w.Err(); err != nil {
+			return fail(err)
+		}
+
+		// remove everything written so far if the archive is too large
+		if err := l.check(header); err != nil {
+			return fail(err)
+		}
+
 		// the target location where the dir/file should be created
-		target := filepath.Join(dst, header.Name)
+		target, err := entryTarget(dst, header.Name)
+		if err != nil {
+			return fail(err)
+		}
+
+		// never write through a symlink that leads out of the destination
+		if err := sc.check(target); err != nil {
+			return fail(err)
+		}
+
+		// everything below a skipped directory is skipped as well
+		if skipped != "" && strings.HasPrefix(target, skipped+string(filepath.Separator)) {
+			res.Skipped++
+			continue
+		}
+
+		// an earlier entry of the same path may still be written
+		if w.Pending(target) {
+			if err := w.Flush(); err != nil {
+				return fail(err)
+			}
+		}
+
+		write, conflict, err := resolveConflict(target, header, opts.Conflict)
+		if conflict {
+			res.Conflicts++
+		}
+		if err != nil {
+			return fail(err)
+		}
+		if !write {
+			log.Debugf("Skipping %s because it already exists", target)
+			res.Skipped++
+
+			if header.Typeflag == tar.TypeDir {
+				skipped = target
+			}
+			continue
+		}
+
+		if entry != nil {
+			entry(header)
+		}
+
+		// archives of single files or delta archives don't contain the
+		// parent directories
+		if header.Typeflag != tar.TypeDir {
+			if err := l.mkdirAll(filepath.Dir(target)); err != nil {
+				return fail(err)
+			}
+
+			// paths that existed before are replaced but never removed
+			if !conflict {
+				l.create(target)
+			}
+		}
 
 		// the following switch could also be done using fi.Mode(), not sure if there
 		// a benefit of using one vs. the other.
@@ -122,14 +296,14 @@ func (a *tarArchive) Unpack(dst string, r io.Reader) error {
 		// check the file type
 		switch header.Typeflag {
 
-		// if its a symlink and it doesn't exist create it
+		// if its a symlink create it
 		case tar.TypeSymlink:
 			log.Debugf("Symlink found at %s", target)
 
-			// Check if something already exists
-			_, err := os.Stat(target)
-			if err == nil {
-				return fmt.Errorf("Failed to create symlink because file already exists at %s", target)
+			// files below the path must be written before it turns into a
+			// link
+			if err := w.Flush(); err != nil {
+				return fail(err)
 			}
 
 			// Create the link
@@ -138,41 +312,72 @@ func (a *tarArchive) Unpack(dst string, r io.Reader) error {
 
 			if err != nil {
 				log.Infof("Failed creating link %s to %s", target, header.Linkname)
-				return err
+				return fail(err)
 			}
 
+			sc.reset()
+
 		// if its a dir and it doesn't exist create it
 		case tar.TypeDir:
 			log.Debugf("Directory found at %s", target)
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					return err
-				}
+			if err := l.mkdirAll(target); err != nil {
+				return fail(err)
 			}
 
 		// if it's a file create it
 		case tar.TypeReg:
 			log.Debugf("File found at %s", target)
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
-				return err
-			}
-
-			// copy over contents
-			_, err = io.Copy(f, tr)
+			t.File(header.Name)
 
-			// Explicitly close otherwise too many files remain open
-			f.Close()
+			// small files are handed to another goroutine
+			if w.Concurrent() && header.Size <= maxBuffered {
+				data := make([]byte, header.Size)
+				if _, err := io.ReadFull(tr, data); err != nil {
+					return fail(err)
+				}
 
-			if err != nil {
-				return err
+				w.Write(target, header, data)
+				t.Write(header.Size)
+				continue
 			}
 
-			err = os.Chtimes(target, time.Now(), header.ModTime)
-
-			if err != nil {
-				return err
+			if err := writeFile(target, header, tr, buf); err != nil {
+				return fail(err)
 			}
+			t.Write(header.Size)
 		}
 	}
 }
+
+// entryTarget returns the path the entry is unpacked to. Names are relative
+// to dst even if they start with a slash, and entries that would end up
+// outside of it are rejected.
+func entryTarget(dst, name string) (string, error) {
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("entry %q leaves the destination", name)
+	}
+
+	return filepath.Join(dst, filepath.FromSlash(clean)), nil
+}
+
+// writeFile creates the file and copies its content from r.
+func writeFile(target string, header *tar.Header, r io.Reader, buf []byte) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(header.Mode))
+	if err != nil {
+		return err
+	}
+
+	// copy over contents
+	_, err = io.CopyBuffer(f, r, buf)
+
+	// Explicitly close otherwise too many files remain open
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, time.Now(), header.ModTime)
+}
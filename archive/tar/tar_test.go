@@ -1,11 +1,15 @@
 package tar
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -128,6 +132,83 @@ func TestTarArchive(t *testing.T) {
 				g.Assert(err.Error()).Equal("unexpected EOF")
 			})
 
+			g.It("Should reject entries outside the destination", func() {
+				dir, _ := ioutil.TempDir("", "tar")
+				defer os.RemoveAll(dir)
+
+				for _, name := range []string{"../escaped.txt", "data/../../escaped.txt", "/../escaped.txt"} {
+					var buf bytes.Buffer
+					tw := tar.NewWriter(&buf)
+					tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+					tw.Write([]byte("hello"))
+					tw.Close()
+
+					err := New().Unpack(filepath.Join(dir, "out"), &buf)
+					g.Assert(err != nil).IsTrue("failed to reject " + name)
+					g.Assert(exists(filepath.Join(dir, "escaped.txt"))).IsFalse("wrote " + name)
+				}
+			})
+
+			g.It("Should not write through symlinks leaving the destination", func() {
+				dir, _ := ioutil.TempDir("", "tar")
+				defer os.RemoveAll(dir)
+				os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				tw.WriteHeader(&tar.Header{Name: "data/a.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+				tw.Write([]byte("hello"))
+				tw.WriteHeader(&tar.Header{Name: "link", Linkname: filepath.Join(dir, "outside"), Mode: 0777, Typeflag: tar.TypeSymlink})
+				tw.WriteHeader(&tar.Header{Name: "link/evil.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+				tw.Write([]byte("evil"))
+				tw.Close()
+
+				out := filepath.Join(dir, "out")
+				_, err := archive.UnpackWithOptions(New(), out, &buf, archive.WithLimits(archive.Limits{MaxEntries: 10}))
+				g.Assert(err != nil).IsTrue("failed to reject write through symlink")
+				g.Assert(exists(filepath.Join(dir, "outside", "evil.txt"))).IsFalse("wrote through symlink")
+				g.Assert(exists(filepath.Join(out, "data"))).IsFalse("failed to clean up")
+			})
+
+			g.It("Should write through symlinks within the destination", func() {
+				dir, _ := ioutil.TempDir("", "tar")
+				defer os.RemoveAll(dir)
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				tw.WriteHeader(&tar.Header{Name: "data/", Mode: 0755, Typeflag: tar.TypeDir})
+				tw.WriteHeader(&tar.Header{Name: "link", Linkname: "data", Mode: 0777, Typeflag: tar.TypeSymlink})
+				tw.WriteHeader(&tar.Header{Name: "link/a.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+				tw.Write([]byte("hello"))
+				tw.Close()
+
+				out := filepath.Join(dir, "out")
+				err := New().Unpack(out, &buf)
+				g.Assert(err == nil).IsTrue("failed to unpack")
+				g.Assert(exists(filepath.Join(out, "data", "a.txt"))).IsTrue("failed to write through symlink")
+			})
+
+			g.It("Should clean up when writing a file fails", func() {
+				dir, _ := ioutil.TempDir("", "tar")
+				defer os.RemoveAll(dir)
+
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				tw.WriteHeader(&tar.Header{Name: "data/a.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+				tw.Write([]byte("hello"))
+				tw.WriteHeader(&tar.Header{Name: "data/b.txt", Mode: 0644, Size: 64 << 10, Typeflag: tar.TypeReg})
+				tw.Write(bytes.Repeat([]byte("x"), 64<<10))
+				tw.Close()
+
+				// Cut the archive in the middle of the second file
+				data := buf.Bytes()[:3<<10]
+
+				out := filepath.Join(dir, "out")
+				_, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithLimits(archive.Limits{MaxEntries: 10}))
+				g.Assert(err != nil).IsTrue("failed to return error")
+				g.Assert(exists(filepath.Join(out, "data"))).IsFalse("failed to clean up")
+			})
+
 			g.It("Should return error on missing file", func() {
 				ta := New()
 				g.Assert(ta != nil).IsTrue("failed to create tarArchive")
@@ -137,6 +218,468 @@ func TestTarArchive(t *testing.T) {
 				g.Assert(err != nil).IsTrue("Failed to return error")
 				g.Assert(err.Error()).Equal("open /tmp/fixtures/tarfiles/test2.tar: no such file or directory")
 			})
+
+			g.It("Should write repeated entries in order when writing concurrently", func() {
+				var buf bytes.Buffer
+				tw := tar.NewWriter(&buf)
+				for i := 0; i < 20; i++ {
+					content := fmt.Sprintf("version %d", i)
+					tw.WriteHeader(&tar.Header{Name: "repeated.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+					tw.Write([]byte(content))
+				}
+				tw.Close()
+
+				out, _ := ioutil.TempDir("", "tar")
+				defer os.RemoveAll(out)
+
+				err := New(archive.WithConcurrency(4)).Unpack(out, &buf)
+				g.Assert(err == nil).IsTrue("failed to unpack")
+
+				content, _ := ioutil.ReadFile(filepath.Join(out, "repeated.txt"))
+				g.Assert(string(content)).Equal("version 19")
+			})
+		})
+	})
+}
+
+func TestTarOptions(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("tar options", func() {
+		var dir string
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "tar")
+			os.MkdirAll(filepath.Join(dir, "src", "data", "sub"), 0755)
+			os.MkdirAll(filepath.Join(dir, "outside"), 0755)
+			ioutil.WriteFile(filepath.Join(dir, "outside", "file.txt"), []byte("outside\n"), 0644)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "sub", "file.txt"), []byte("inside\n"), 0644)
+			os.Symlink("../../outside/file.txt", filepath.Join(dir, "src", "data", "link.txt"))
+			os.Symlink("../../outside", filepath.Join(dir, "src", "data", "linkdir"))
+			os.Symlink("..", filepath.Join(dir, "src", "data", "sub", "parent"))
+			os.Symlink("missing", filepath.Join(dir, "src", "data", "dangling"))
+			os.Symlink("sub/file.txt", filepath.Join(dir, "src", "data", "inside.txt"))
+			os.Symlink(".", filepath.Join(dir, "src", "data", "self"))
+			os.Chdir(filepath.Join(dir, "src"))
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should write headers in the requested format", func() {
+			var buf bytes.Buffer
+			g.Assert(New(archive.WithFormat(tar.FormatPAX)).Pack([]string{"data/sub/file.txt"}, &buf) == nil).IsTrue("failed to pack")
+
+			hdr, err := tar.NewReader(&buf).Next()
+			g.Assert(err == nil).IsTrue("failed to read header")
+			g.Assert(hdr.Format).Equal(tar.FormatPAX)
+		})
+
+		g.It("Should keep symlinks by default", func() {
+			var buf bytes.Buffer
+			g.Assert(New().Pack([]string{"data"}, &buf) == nil).IsTrue("failed to pack")
+
+			out := filepath.Join(dir, "out")
+			g.Assert(New().Unpack(out, &buf) == nil).IsTrue("failed to unpack")
+
+			fi, err := os.Lstat(filepath.Join(out, "data", "link.txt"))
+			g.Assert(err == nil).IsTrue("failed to stat link")
+			g.Assert(fi.Mode()&os.ModeSymlink != 0).IsTrue("expected a symlink")
+		})
+
+		g.It("Should store the targets of symlinks when following them", func() {
+			var buf bytes.Buffer
+			g.Assert(New(archive.WithFollowSymlinks(true)).Pack([]string{"data"}, &buf) == nil).IsTrue("failed to pack")
+
+			out := filepath.Join(dir, "out")
+			g.Assert(New().Unpack(out, &buf) == nil).IsTrue("failed to unpack")
+
+			fi, err := os.Lstat(filepath.Join(out, "data", "link.txt"))
+			g.Assert(err == nil).IsTrue("failed to stat link")
+			g.Assert(fi.Mode().IsRegular()).IsTrue("expected a regular file")
+
+			content, _ := ioutil.ReadFile(filepath.Join(out, "data", "link.txt"))
+			g.Assert(string(content)).Equal("outside\n")
+
+			content, _ = ioutil.ReadFile(filepath.Join(out, "data", "linkdir", "file.txt"))
+			g.Assert(string(content)).Equal("outside\n")
+
+			// Links to parents and dangling links are kept as links
+			for _, name := range []string{"sub/parent", "self", "dangling"} {
+				fi, err = os.Lstat(filepath.Join(out, "data", name))
+				g.Assert(err == nil).IsTrue("failed to stat " + name)
+				g.Assert(fi.Mode()&os.ModeSymlink != 0).IsTrue("expected a symlink at " + name)
+			}
+		})
+
+		g.It("Should only follow symlinks outside of the sources when asked per call", func() {
+			a := New()
+
+			var buf bytes.Buffer
+			err := archive.PackWithOptions(a, []string{"data"}, &buf, archive.WithSymlinks(archive.SymlinksFollowOutside))
+			g.Assert(err == nil).IsTrue("failed to pack")
+
+			out := filepath.Join(dir, "out")
+			g.Assert(New().Unpack(out, &buf) == nil).IsTrue("failed to unpack")
+
+			for _, name := range []string{"link.txt", "linkdir/file.txt"} {
+				fi, err := os.Lstat(filepath.Join(out, "data", name))
+				g.Assert(err == nil).IsTrue("failed to stat " + name)
+				g.Assert(fi.Mode().IsRegular()).IsTrue("expected a regular file at " + name)
+			}
+
+			for _, name := range []string{"inside.txt", "self", "sub/parent"} {
+				fi, err := os.Lstat(filepath.Join(out, "data", name))
+				g.Assert(err == nil).IsTrue("failed to stat " + name)
+				g.Assert(fi.Mode()&os.ModeSymlink != 0).IsTrue("expected a symlink at " + name)
+			}
+
+			// The archive keeps its own options for later calls
+			buf.Reset()
+			g.Assert(a.Pack([]string{"data/link.txt"}, &buf) == nil).IsTrue("failed to pack")
+
+			hdr, _ := tar.NewReader(&buf).Next()
+			g.Assert(hdr.Typeflag == tar.TypeSymlink).IsTrue("expected a symlink")
+		})
+	})
+}
+
+func TestTarConflicts(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("tar conflicts", func() {
+		var dir, out string
+		var data []byte
+
+		old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		mid := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+		recent := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "tar")
+			out = filepath.Join(dir, "out")
+
+			// Archive a small tree modified in the middle of the year
+			os.MkdirAll(filepath.Join(dir, "src", "data", "dir"), 0755)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "new.txt"), []byte("new"), 0644)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "old.txt"), []byte("new"), 0644)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "dir", "file.txt"), []byte("new"), 0644)
+			os.Symlink("new.txt", filepath.Join(dir, "src", "data", "link"))
+			for _, name := range []string{"new.txt", "old.txt", "dir/file.txt"} {
+				os.Chtimes(filepath.Join(dir, "src", "data", name), mid, mid)
+			}
+
+			os.Chdir(filepath.Join(dir, "src"))
+			var buf bytes.Buffer
+			New().Pack([]string{"data"}, &buf)
+			os.Chdir(wd)
+			data = buf.Bytes()
+
+			// Existing files are longer than the archived ones, one is
+			// newer and one is older than its entry
+			os.MkdirAll(filepath.Join(out, "data"), 0755)
+			ioutil.WriteFile(filepath.Join(out, "data", "new.txt"), []byte("existing"), 0644)
+			ioutil.WriteFile(filepath.Join(out, "data", "old.txt"), []byte("existing"), 0644)
+			ioutil.WriteFile(filepath.Join(out, "data", "dir"), []byte("existing"), 0644)
+			ioutil.WriteFile(filepath.Join(out, "data", "link"), []byte("existing"), 0644)
+			os.Chtimes(filepath.Join(out, "data", "new.txt"), recent, recent)
+			os.Chtimes(filepath.Join(out, "data", "old.txt"), old, old)
+			os.Chtimes(filepath.Join(out, "data", "dir"), old, old)
+			os.Chtimes(filepath.Join(out, "data", "link"), recent, recent)
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		read := func(name string) string {
+			content, _ := ioutil.ReadFile(filepath.Join(out, "data", name))
+			return string(content)
+		}
+
+		g.It("Should replace existing paths by default", func() {
+			res, err := archive.UnpackWithOptions(New(archive.WithConcurrency(1)), out, bytes.NewReader(data))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(res.Conflicts).Equal(4)
+			g.Assert(res.Skipped).Equal(0)
+
+			g.Assert(read("new.txt")).Equal("new")
+			g.Assert(read("old.txt")).Equal("new")
+			g.Assert(read("dir/file.txt")).Equal("new")
+
+			link, _ := os.Readlink(filepath.Join(out, "data", "link"))
+			g.Assert(link).Equal("new.txt")
+		})
+
+		g.It("Should truncate existing files when writing concurrently", func() {
+			res, err := archive.UnpackWithOptions(New(archive.WithConcurrency(4)), out, bytes.NewReader(data))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(res.Conflicts).Equal(4)
+
+			g.Assert(read("new.txt")).Equal("new")
+			g.Assert(read("old.txt")).Equal("new")
+		})
+
+		g.It("Should skip existing paths", func() {
+			res, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithConflict(archive.ConflictSkip))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(res.Conflicts).Equal(4)
+			g.Assert(res.Skipped).Equal(5)
+
+			g.Assert(read("new.txt")).Equal("existing")
+			g.Assert(read("old.txt")).Equal("existing")
+			g.Assert(read("dir")).Equal("existing")
+			g.Assert(read("link")).Equal("existing")
+		})
+
+		g.It("Should keep existing paths that are newer", func() {
+			res, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithConflict(archive.ConflictKeepNewer))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(res.Conflicts).Equal(4)
+			g.Assert(res.Skipped).Equal(1)
+
+			g.Assert(read("new.txt")).Equal("existing")
+			g.Assert(read("old.txt")).Equal("new")
+			g.Assert(read("dir/file.txt")).Equal("new")
+		})
+
+		g.It("Should fail on existing paths", func() {
+			_, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithConflict(archive.ConflictFail))
+			g.Assert(err != nil).IsTrue("expected an error")
+
+			cerr, ok := err.(*archive.ConflictError)
+			g.Assert(ok).IsTrue("expected a conflict error")
+			g.Assert(strings.HasPrefix(cerr.Path, filepath.Join(out, "data"))).IsTrue("unexpected path " + cerr.Path)
+		})
+	})
+}
+
+func TestTarAtomic(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("atomic unpack", func() {
+		var dir, out string
+		var data []byte
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "tar")
+			out = filepath.Join(dir, "out")
+
+			os.MkdirAll(filepath.Join(dir, "src", "data", "dir"), 0755)
+			os.MkdirAll(filepath.Join(dir, "src", "other"), 0755)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "dir", "file.txt"), []byte("new"), 0644)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "large.bin"), bytes.Repeat([]byte("x"), 64<<10), 0644)
+			ioutil.WriteFile(filepath.Join(dir, "src", "other", "file.txt"), []byte("new"), 0644)
+
+			os.Chdir(filepath.Join(dir, "src"))
+			var buf bytes.Buffer
+			New().Pack([]string{"data", "other/file.txt"}, &buf)
+			os.Chdir(wd)
+			data = buf.Bytes()
+
+			os.MkdirAll(filepath.Join(out, "data", "dir"), 0755)
+			os.MkdirAll(filepath.Join(out, "other"), 0755)
+			ioutil.WriteFile(filepath.Join(out, "data", "dir", "file.txt"), []byte("existing"), 0644)
+			ioutil.WriteFile(filepath.Join(out, "data", "stale.txt"), []byte("existing"), 0644)
+			ioutil.WriteFile(filepath.Join(out, "other", "file.txt"), []byte("existing"), 0644)
+			ioutil.WriteFile(filepath.Join(out, "other", "keep.txt"), []byte("existing"), 0644)
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		read := func(name string) string {
+			content, err := ioutil.ReadFile(filepath.Join(out, name))
+			if err != nil {
+				return ""
+			}
+			return string(content)
+		}
+
+		entries := func() []string {
+			infos, _ := ioutil.ReadDir(out)
+
+			var names []string
+			for _, fi := range infos {
+				names = append(names, fi.Name())
+			}
+			return names
+		}
+
+		g.It("Should replace the roots once the archive was read", func() {
+			res, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithAtomic(true))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(res.Conflicts).Equal(2)
+
+			g.Assert(read("data/dir/file.txt")).Equal("new")
+			g.Assert(read("data/stale.txt")).Equal("")
+			g.Assert(read("other/file.txt")).Equal("new")
+			g.Assert(read("other/keep.txt")).Equal("existing")
+			g.Assert(entries()).Equal([]string{"data", "other"})
+		})
+
+		g.It("Should stage next to the destination", func() {
+			var seen []string
+			r := &peekReader{Reader: bytes.NewReader(data), peek: func() {
+				seen = entries()
+			}}
+
+			_, err := archive.UnpackWithOptions(New(), out, r, archive.WithAtomic(true))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(seen).Equal([]string{"data", "other"})
+
+			infos, _ := ioutil.ReadDir(dir)
+			g.Assert(len(infos)).Equal(2)
+		})
+
+		g.It("Should replace the destination with an archive of the current directory", func() {
+			os.Chdir(filepath.Join(dir, "src"))
+			var buf bytes.Buffer
+			New().Pack([]string{"."}, &buf)
+			os.Chdir(wd)
+
+			ioutil.WriteFile(filepath.Join(out, "gone.txt"), []byte("existing"), 0644)
+
+			_, err := archive.UnpackWithOptions(New(), out, &buf, archive.WithAtomic(true))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+
+			g.Assert(read("data/dir/file.txt")).Equal("new")
+			g.Assert(read("data/stale.txt")).Equal("")
+			g.Assert(read("other/keep.txt")).Equal("")
+			g.Assert(entries()).Equal([]string{"data", "other"})
+		})
+
+		g.It("Should leave the destination untouched on a truncated archive", func() {
+			_, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data[:len(data)/2]), archive.WithAtomic(true))
+			g.Assert(err != nil).IsTrue("expected an error")
+
+			g.Assert(read("data/dir/file.txt")).Equal("existing")
+			g.Assert(read("data/stale.txt")).Equal("existing")
+			g.Assert(read("other/file.txt")).Equal("existing")
+			g.Assert(entries()).Equal([]string{"data", "other"})
+		})
+
+		g.It("Should roll back when a root conflicts", func() {
+			ioutil.WriteFile(filepath.Join(out, "other", "file.txt"), []byte("existing"), 0644)
+
+			_, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithAtomic(true), archive.WithConflict(archive.ConflictFail))
+			_, ok := err.(*archive.ConflictError)
+			g.Assert(ok).IsTrue("expected a conflict error")
+
+			g.Assert(read("data/stale.txt")).Equal("existing")
+			g.Assert(entries()).Equal([]string{"data", "other"})
+		})
+
+		g.It("Should skip conflicting roots", func() {
+			res, err := archive.UnpackWithOptions(New(), out, bytes.NewReader(data), archive.WithAtomic(true), archive.WithConflict(archive.ConflictSkip))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(res.Skipped).Equal(2)
+
+			g.Assert(read("data/stale.txt")).Equal("existing")
+			g.Assert(entries()).Equal([]string{"data", "other"})
+		})
+	})
+}
+
+func TestTarLimits(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("unpack limits", func() {
+		var dir, out string
+		var data []byte
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "tar")
+			out = filepath.Join(dir, "out")
+
+			os.MkdirAll(filepath.Join(dir, "src", "data", "a", "b"), 0755)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "small.txt"), []byte("small"), 0644)
+			ioutil.WriteFile(filepath.Join(dir, "src", "data", "a", "b", "large.bin"), bytes.Repeat([]byte("x"), 64<<10), 0644)
+
+			os.Chdir(filepath.Join(dir, "src"))
+			var buf bytes.Buffer
+			New().Pack([]string{"data"}, &buf)
+			os.Chdir(wd)
+			data = buf.Bytes()
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should unpack archives within the limits", func() {
+			limits := archive.Limits{
+				MaxBytes:      1 << 20,
+				MaxFileSize:   64 << 10,
+				MaxEntries:    5,
+				MaxPathLength: 100,
+				MaxDepth:      4,
+				MinFreeSpace:  1,
+			}
+
+			err := New(archive.WithLimits(limits)).Unpack(out, bytes.NewReader(data))
+			g.Assert(err == nil).IsTrue("failed to unpack")
+			g.Assert(exists(filepath.Join(out, "data", "a", "b", "large.bin"))).IsTrue("failed to unpack large.bin")
+		})
+
+		for _, tc := range []struct {
+			limit  string
+			limits archive.Limits
+		}{
+			{"total size", archive.Limits{MaxBytes: 32 << 10}},
+			{"file size", archive.Limits{MaxFileSize: 32 << 10}},
+			{"entry count", archive.Limits{MaxEntries: 4}},
+			{"path length", archive.Limits{MaxPathLength: 10}},
+			{"directory depth", archive.Limits{MaxDepth: 3}},
+			{"free space", archive.Limits{MinFreeSpace: 1 << 62}},
+		} {
+			tc := tc
+
+			g.It("Should enforce the "+tc.limit+" limit and clean up", func() {
+				for _, n := range []int{1, 4} {
+					err := New(archive.WithConcurrency(n), archive.WithLimits(tc.limits)).Unpack(out, bytes.NewReader(data))
+
+					lerr, ok := err.(*archive.LimitError)
+					g.Assert(ok).IsTrue("expected a limit error")
+					g.Assert(lerr.Limit).Equal(tc.limit)
+					g.Assert(exists(out)).IsFalse("failed to clean up")
+				}
+			})
+		}
+
+		g.It("Should not remove files it replaced", func() {
+			os.MkdirAll(filepath.Join(out, "data", "a", "b"), 0755)
+			ioutil.WriteFile(filepath.Join(out, "data", "a", "b", "large.bin"), []byte("existing"), 0644)
+
+			// large.bin is the fourth entry and replaced before small.txt
+			// exceeds the limit
+			for _, n := range []int{1, 4} {
+				err := New(archive.WithConcurrency(n), archive.WithLimits(archive.Limits{MaxEntries: 4})).Unpack(out, bytes.NewReader(data))
+				_, ok := err.(*archive.LimitError)
+				g.Assert(ok).IsTrue("expected a limit error")
+
+				g.Assert(exists(filepath.Join(out, "data", "a", "b", "large.bin"))).IsTrue("removed a replaced file")
+				g.Assert(exists(filepath.Join(out, "data", "small.txt"))).IsFalse("failed to clean up")
+			}
+		})
+
+		g.It("Should only remove what it created", func() {
+			os.MkdirAll(filepath.Join(out, "data"), 0755)
+			ioutil.WriteFile(filepath.Join(out, "data", "keep.txt"), []byte("keep"), 0644)
+
+			err := New(archive.WithLimits(archive.Limits{MaxFileSize: 1})).Unpack(out, bytes.NewReader(data))
+			_, ok := err.(*archive.LimitError)
+			g.Assert(ok).IsTrue("expected a limit error")
+
+			g.Assert(exists(filepath.Join(out, "data", "keep.txt"))).IsTrue("removed an existing file")
+			g.Assert(exists(filepath.Join(out, "data", "a"))).IsFalse("failed to clean up")
 		})
 	})
 }
@@ -273,3 +816,20 @@ var (
 	invalidFile = "/tmp/fixtures/tarfiles/bad.tar"
 	missingFile = "/tmp/fixtures/tarfiles/test2.tar"
 )
+
+// peekReader calls peek once after the first read.
+type peekReader struct {
+	io.Reader
+	peek func()
+}
+
+func (r *peekReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+
+	if r.peek != nil {
+		r.peek()
+		r.peek = nil
+	}
+
+	return n, err
+}
@@ -0,0 +1,153 @@
+package tar
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/logger"
+)
+
+// walk calls fn for root and everything below it like filepath.Walk.
+// Symlinks selected by the mode are reported with the info of their target
+// and linked directories are walked as well. Links that would lead back
+// into a directory being walked are reported as links to avoid an endless
+// walk.
+//
+// With SymlinksFollowOutside, links to anything within the roots are kept.
+// The roots must be resolved with resolveRoots.
+func walk(root string, mode archive.SymlinkMode, roots []string, log logger.Logger, fn filepath.WalkFunc) error {
+	if mode == archive.SymlinksKeep {
+		return filepath.Walk(root, fn)
+	}
+
+	w := walker{mode: mode, roots: roots, log: log, fn: fn}
+
+	err := w.walk(root, nil)
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return err
+}
+
+type walker struct {
+	mode  archive.SymlinkMode
+	roots []string
+	log   logger.Logger
+	fn    filepath.WalkFunc
+}
+
+func (w walker) walk(path string, parents []os.FileInfo) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return w.fn(path, nil, err)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		info = w.follow(path, info, parents)
+	}
+
+	if err := w.fn(path, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+
+	names, err := f.Readdirnames(-1)
+	f.Close()
+
+	if err != nil {
+		return w.fn(path, info, err)
+	}
+
+	sort.Strings(names)
+
+	parents = append(parents, info)
+	for _, name := range names {
+		err := w.walk(filepath.Join(path, name), parents)
+		if err != nil && err != filepath.SkipDir {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// follow returns the info of the file the link points to, or the info of the
+// link itself if it should be kept.
+func (w walker) follow(path string, link os.FileInfo, parents []os.FileInfo) os.FileInfo {
+	target, err := os.Stat(path)
+
+	switch {
+	case err != nil:
+		w.log.Debugf("Keeping dangling symbolic link at %s", path)
+		return link
+	case target.IsDir() && isParent(target, parents):
+		w.log.Warnf("Keeping symbolic link at %s because it points to a parent directory", path)
+		return link
+	case w.mode == archive.SymlinksFollowOutside && w.inside(path):
+		return link
+	}
+
+	w.log.Debugf("Following symbolic link at %s", path)
+	return target
+}
+
+// inside reports whether the link points to a path within the roots.
+func (w walker) inside(path string) bool {
+	resolved, err := resolve(path)
+	if err != nil {
+		return false
+	}
+
+	for _, root := range w.roots {
+		if resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveRoots returns the absolute paths of the sources with all symlinks
+// resolved.
+func resolveRoots(srcs []string) ([]string, error) {
+	roots := make([]string, 0, len(srcs))
+
+	for _, s := range srcs {
+		root, err := resolve(s)
+		if err != nil {
+			return nil, err
+		}
+
+		roots = append(roots, root)
+	}
+
+	return roots, nil
+}
+
+func resolve(path string) (string, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(path)
+}
+
+// isParent reports whether dir is one of the directories being walked.
+func isParent(dir os.FileInfo, parents []os.FileInfo) bool {
+	for _, p := range parents {
+		if os.SameFile(dir, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,126 @@
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fileWriter writes files from a pool of goroutines while the archive is
+// still being read.
+type fileWriter struct {
+	jobs chan fileJob
+	wg   sync.WaitGroup
+	once sync.Once
+
+	// queued counts the files not written yet, pending counts them by target
+	queued sync.WaitGroup
+
+	mu      sync.Mutex
+	err     error
+	pending map[string]int
+}
+
+type fileJob struct {
+	target string
+	header *tar.Header
+	data   []byte
+}
+
+func newFileWriter(n int) *fileWriter {
+	w := &fileWriter{pending: make(map[string]int)}
+
+	if n < 2 {
+		return w
+	}
+
+	w.jobs = make(chan fileJob, n)
+
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+
+		go func() {
+			defer w.wg.Done()
+
+			for job := range w.jobs {
+				var err error
+				if w.Err() == nil {
+					err = writeFile(job.target, job.header, bytes.NewReader(job.data), nil)
+				}
+
+				w.mu.Lock()
+				if err != nil && w.err == nil {
+					w.err = err
+				}
+				if w.pending[job.target]--; w.pending[job.target] == 0 {
+					delete(w.pending, job.target)
+				}
+				w.mu.Unlock()
+
+				w.queued.Done()
+			}
+		}()
+	}
+
+	return w
+}
+
+// Concurrent reports whether files can be handed to Write.
+func (w *fileWriter) Concurrent() bool {
+	return w.jobs != nil
+}
+
+// Write queues the file for writing.
+func (w *fileWriter) Write(target string, header *tar.Header, data []byte) {
+	w.mu.Lock()
+	w.pending[target]++
+	w.mu.Unlock()
+
+	w.queued.Add(1)
+	w.jobs <- fileJob{target: target, header: header, data: data}
+}
+
+// Pending reports whether a queued file is written to target or below it.
+// Only a few files are queued at any time.
+func (w *fileWriter) Pending(target string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for p := range w.pending {
+		if p == target || strings.HasPrefix(p, target+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Flush waits until all queued files are written and returns the first
+// error.
+func (w *fileWriter) Flush() error {
+	w.queued.Wait()
+	return w.Err()
+}
+
+// Err returns the first error a queued file failed with.
+func (w *fileWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// Wait waits for all queued files and returns the first error.
+func (w *fileWriter) Wait() error {
+	w.once.Do(func() {
+		if w.jobs != nil {
+			close(w.jobs)
+		}
+
+		w.wg.Wait()
+	})
+
+	return w.Err()
+}
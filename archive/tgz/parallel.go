@@ -0,0 +1,223 @@
+package tgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// parallelWriter compresses blocks of the input on several goroutines. Every
+// block becomes a gzip member of its own, and the concatenated members are
+// a valid gzip stream that standard tools decompress as a whole.
+type parallelWriter struct {
+	w     io.Writer
+	level int
+	buf   []byte
+	wrote bool
+
+	queue chan chan []byte
+	done  chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func newParallelWriter(w io.Writer, level, size, n int) *parallelWriter {
+	pw := &parallelWriter{
+		w:     w,
+		level: level,
+		buf:   make([]byte, 0, size),
+		queue: make(chan chan []byte, n),
+		done:  make(chan struct{}),
+	}
+
+	// Write the compressed blocks in their original order
+	go func() {
+		defer close(pw.done)
+
+		for ch := range pw.queue {
+			b := <-ch
+
+			if pw.Err() != nil {
+				continue
+			}
+
+			if _, err := pw.w.Write(b); err != nil {
+				pw.setErr(err)
+			}
+		}
+	}()
+
+	return pw
+}
+
+func (pw *parallelWriter) Write(p []byte) (int, error) {
+	if err := pw.Err(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+
+	for len(p) > 0 {
+		m := copy(pw.buf[len(pw.buf):cap(pw.buf)], p)
+		pw.buf = pw.buf[:len(pw.buf)+m]
+		p = p[m:]
+
+		if len(pw.buf) == cap(pw.buf) {
+			pw.flush()
+		}
+	}
+
+	return n, nil
+}
+
+// Close compresses the remaining input and waits for all blocks.
+func (pw *parallelWriter) Close() error {
+	// An empty stream still needs one member to be valid gzip
+	if len(pw.buf) > 0 || !pw.wrote {
+		pw.flush()
+	}
+
+	close(pw.queue)
+	<-pw.done
+
+	return pw.Err()
+}
+
+// flush hands the buffered block to a new goroutine.
+func (pw *parallelWriter) flush() {
+	block := pw.buf
+	pw.buf = make([]byte, 0, cap(block))
+	pw.wrote = true
+
+	ch := make(chan []byte, 1)
+	pw.queue <- ch
+
+	go func() {
+		var buf bytes.Buffer
+
+		gw, err := gzip.NewWriterLevel(&buf, pw.level)
+		if err == nil {
+			_, err = gw.Write(block)
+		}
+		if err == nil {
+			err = gw.Close()
+		}
+
+		if err != nil {
+			pw.setErr(err)
+		}
+
+		ch <- buf.Bytes()
+	}()
+}
+
+func (pw *parallelWriter) Err() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	return pw.err
+}
+
+func (pw *parallelWriter) setErr(err error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.err == nil {
+		pw.err = err
+	}
+}
+
+// readAhead reads from r on its own goroutine, so the stage feeding r and
+// the stage consuming the returned reader run in parallel.
+type readAhead struct {
+	blocks chan []byte
+	free   chan []byte
+	stop   chan struct{}
+	once   sync.Once
+	cur    []byte
+	buf    []byte
+	err    error
+}
+
+func newReadAhead(r io.Reader, size, n int) *readAhead {
+	ra := &readAhead{
+		blocks: make(chan []byte, n),
+		free:   make(chan []byte, n+2),
+		stop:   make(chan struct{}),
+	}
+
+	for i := 0; i < n+2; i++ {
+		ra.free <- make([]byte, size)
+	}
+
+	go func() {
+		defer close(ra.blocks)
+
+		for {
+			var buf []byte
+			select {
+			case buf = <-ra.free:
+			case <-ra.stop:
+				return
+			}
+
+			m, err := io.ReadFull(r, buf)
+			if m > 0 {
+				select {
+				case ra.blocks <- buf[:m]:
+				case <-ra.stop:
+					return
+				}
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				ra.err = io.EOF
+				return
+			}
+			if err != nil {
+				ra.err = err
+				return
+			}
+		}
+	}()
+
+	return ra
+}
+
+func (ra *readAhead) Read(p []byte) (int, error) {
+	for len(ra.cur) == 0 {
+		if ra.buf != nil {
+			ra.free <- ra.buf[:cap(ra.buf)]
+			ra.buf = nil
+		}
+
+		b, ok := <-ra.blocks
+		if !ok {
+			// err is written before blocks is closed, it is only nil if
+			// Close stopped reading ahead
+			if ra.err == nil {
+				return 0, io.ErrClosedPipe
+			}
+
+			return 0, ra.err
+		}
+
+		ra.buf, ra.cur = b, b
+	}
+
+	n := copy(p, ra.cur)
+	ra.cur = ra.cur[n:]
+
+	return n, nil
+}
+
+// Close stops reading ahead.
+func (ra *readAhead) Close() error {
+	ra.once.Do(func() {
+		close(ra.stop)
+	})
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package tgz
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/franela/goblin"
+)
+
+const blockSize = 1 << 20
+
+func TestParallel(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("parallel compression", func() {
+		g.It("Should produce a stream readable by gzip", func() {
+			data := make([]byte, 3*blockSize+123)
+			rand.New(rand.NewSource(1)).Read(data[:blockSize])
+
+			var buf bytes.Buffer
+			pw := newParallelWriter(&buf, gzip.DefaultCompression, blockSize, 4)
+			pw.Write(data[:100])
+			pw.Write(data[100:])
+			g.Assert(pw.Close() == nil).IsTrue("failed to close")
+
+			gr, err := gzip.NewReader(&buf)
+			g.Assert(err == nil).IsTrue("failed to read gzip header")
+
+			out, err := ioutil.ReadAll(gr)
+			g.Assert(err == nil).IsTrue("failed to decompress")
+			g.Assert(bytes.Equal(out, data)).IsTrue("content differs")
+		})
+
+		g.It("Should produce a valid empty stream", func() {
+			var buf bytes.Buffer
+			pw := newParallelWriter(&buf, gzip.DefaultCompression, blockSize, 4)
+			g.Assert(pw.Close() == nil).IsTrue("failed to close")
+
+			gr, err := gzip.NewReader(&buf)
+			g.Assert(err == nil).IsTrue("failed to read gzip header")
+
+			out, _ := ioutil.ReadAll(gr)
+			g.Assert(len(out)).Equal(0)
+		})
+
+		g.It("Should round-trip many files with and without concurrency", func() {
+			wd, _ := os.Getwd()
+			dir, _ := ioutil.TempDir("", "tgz")
+			defer os.RemoveAll(dir)
+			defer os.Chdir(wd)
+
+			os.MkdirAll(filepath.Join(dir, "src", "files"), 0755)
+			os.Chdir(filepath.Join(dir, "src"))
+
+			for i := 0; i < 100; i++ {
+				content := bytes.Repeat([]byte(fmt.Sprint(i)), i*1000)
+				ioutil.WriteFile(fmt.Sprintf("files/%d.txt", i), content, 0644)
+			}
+
+			for _, n := range []int{1, 4} {
+				a := New(archive.WithConcurrency(n))
+
+				var buf bytes.Buffer
+				g.Assert(a.Pack([]string{"files"}, &buf) == nil).IsTrue("failed to pack")
+
+				out := filepath.Join(dir, fmt.Sprint("out", n))
+				g.Assert(a.Unpack(out, &buf) == nil).IsTrue("failed to unpack")
+
+				for i := 0; i < 100; i++ {
+					content, _ := ioutil.ReadFile(filepath.Join(out, fmt.Sprintf("files/%d.txt", i)))
+					g.Assert(bytes.Equal(content, bytes.Repeat([]byte(fmt.Sprint(i)), i*1000))).IsTrue("content differs")
+				}
+			}
+		})
+
+		g.It("Should apply the compression level and block size", func() {
+			wd, _ := os.Getwd()
+			dir, _ := ioutil.TempDir("", "tgz")
+			defer os.RemoveAll(dir)
+			defer os.Chdir(wd)
+
+			os.Chdir(dir)
+			ioutil.WriteFile("file.txt", bytes.Repeat([]byte("hello go\n"), 100000), 0644)
+
+			for _, n := range []int{1, 4} {
+				var none, best bytes.Buffer
+				g.Assert(New(archive.WithConcurrency(n), archive.WithLevel(gzip.NoCompression)).Pack([]string{"file.txt"}, &none) == nil).IsTrue("failed to pack")
+				g.Assert(New(archive.WithConcurrency(n), archive.WithLevel(gzip.BestCompression), archive.WithBlockSize(64<<10)).Pack([]string{"file.txt"}, &best) == nil).IsTrue("failed to pack")
+				g.Assert(none.Len() > 900000).IsTrue("expected uncompressed output")
+				g.Assert(best.Len() < none.Len()/10).IsTrue("expected compressed output")
+
+				out := filepath.Join(dir, fmt.Sprint("out", n))
+				os.Mkdir(out, 0755)
+				g.Assert(New(archive.WithConcurrency(n), archive.WithBlockSize(64<<10)).Unpack(out, &best) == nil).IsTrue("failed to unpack")
+
+				content, _ := ioutil.ReadFile(filepath.Join(out, "file.txt"))
+				g.Assert(bytes.Equal(content, bytes.Repeat([]byte("hello go\n"), 100000))).IsTrue("content differs")
+			}
+		})
+
+		g.It("Should fail reads after the read ahead was closed", func() {
+			ra := newReadAhead(zeros{}, 1024, 2)
+			ra.Close()
+
+			var err error
+			for i := 0; i < 1000 && err == nil; i++ {
+				_, err = ra.Read(make([]byte, 1024))
+			}
+
+			g.Assert(err == io.ErrClosedPipe).IsTrue("failed to return error")
+		})
+
+		g.It("Should reject an invalid compression level", func() {
+			err := New(archive.WithLevel(10)).Pack([]string{"missing"}, ioutil.Discard)
+			g.Assert(err != nil).IsTrue("expected an error")
+			g.Assert(err.Error()).Equal("invalid compression level: 10")
+		})
+
+		g.It("Should verify the checksum before an atomic unpack moves files into place", func() {
+			wd, _ := os.Getwd()
+			dir, _ := ioutil.TempDir("", "tgz")
+			defer os.RemoveAll(dir)
+			defer os.Chdir(wd)
+
+			os.Chdir(dir)
+			os.Mkdir("data", 0755)
+			ioutil.WriteFile("data/file.txt", []byte("new"), 0644)
+
+			var buf bytes.Buffer
+			g.Assert(New(archive.WithConcurrency(1)).Pack([]string{"data"}, &buf) == nil).IsTrue("failed to pack")
+
+			// Corrupt the checksum in the gzip trailer
+			data := buf.Bytes()
+			data[len(data)-8] ^= 0xff
+
+			os.MkdirAll("out/data", 0755)
+			ioutil.WriteFile("out/data/file.txt", []byte("existing"), 0644)
+
+			for _, n := range []int{1, 4} {
+				_, err := archive.UnpackWithOptions(New(archive.WithConcurrency(n)), "out", bytes.NewReader(data), archive.WithAtomic(true))
+				g.Assert(err != nil).IsTrue("expected a checksum error")
+
+				content, _ := ioutil.ReadFile("out/data/file.txt")
+				g.Assert(string(content)).Equal("existing")
+			}
+		})
+	})
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
@@ -5,40 +5,97 @@ package tgz
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 
 	"github.com/drone/drone-cache-lib/archive"
 	"github.com/drone/drone-cache-lib/archive/tar"
 )
 
-type tgzArchive struct{}
+type tgzArchive struct {
+	opts []archive.Option
+}
+
+// New creates an archive that uses the .tar.gz file format. It also accepts
+// options per call through archive.PackWithOptions and
+// archive.UnpackWithOptions.
+//
+// With a concurrency above one the input is compressed in blocks on several
+// goroutines, and decompression runs in a pipeline next to unpacking.
+func New(opts ...archive.Option) archive.Archive {
+	return &tgzArchive{
+		opts: opts,
+	}
+}
 
-// New creates an archive that uses the .tar.gz file format.
-func New() archive.Archive {
-	return &tgzArchive{}
+func (a *tgzArchive) Name() string {
+	return "tar.gz"
 }
 
 func (a *tgzArchive) Pack(srcs []string, w io.Writer) error {
-	gw := gzip.NewWriter(w)
-	defer gw.Close()
+	return a.PackWithOptions(srcs, w)
+}
 
-	taP := tar.New()
+func (a *tgzArchive) PackWithOptions(srcs []string, w io.Writer, opts ...archive.Option) error {
+	fns := append(append([]archive.Option(nil), a.opts...), opts...)
+	o := archive.NewOptions(fns...)
+
+	if o.Level < gzip.HuffmanOnly || o.Level > gzip.BestCompression {
+		return fmt.Errorf("invalid compression level: %d", o.Level)
+	}
+
+	var gw io.WriteCloser
+	if o.Concurrency > 1 {
+		gw = newParallelWriter(w, o.Level, o.BlockSize, o.Concurrency)
+	} else {
+		var err error
+		if gw, err = gzip.NewWriterLevel(w, o.Level); err != nil {
+			return err
+		}
+	}
+
+	taP := tar.New(fns...)
 
 	err := taP.Pack(srcs, gw)
 
+	if cerr := gw.Close(); err == nil {
+		err = cerr
+	}
+
 	return err
 }
 
 func (a *tgzArchive) Unpack(dst string, r io.Reader) error {
+	_, err := a.UnpackWithOptions(dst, r)
+	return err
+}
+
+func (a *tgzArchive) UnpackWithOptions(dst string, r io.Reader, opts ...archive.Option) (archive.Result, error) {
+	fns := append(append([]archive.Option(nil), a.opts...), opts...)
+	o := archive.NewOptions(fns...)
+
+	if o.Concurrency > 1 {
+		ra := newReadAhead(r, o.BlockSize, 2)
+		defer ra.Close()
+
+		r = ra
+	}
+
 	gr, err := gzip.NewReader(r)
 
 	if err != nil {
-		return err
+		return archive.Result{}, err
 	}
 
-	taU := tar.New()
+	var tr io.Reader = gr
+	if o.Concurrency > 1 {
+		ra := newReadAhead(gr, o.BlockSize, 2)
+		defer ra.Close()
+
+		tr = ra
+	}
 
-	fwErr := taU.Unpack(dst, gr)
+	taU := tar.New(fns...)
 
-	return fwErr
+	return archive.UnpackWithOptions(taU, dst, tr)
 }
@@ -9,14 +9,15 @@ import (
 	"github.com/drone/drone-cache-lib/archive/tgz"
 )
 
-// FromFilename determines the archive format to use based on the name.
-func FromFilename(name string) (archive.Archive, error) {
+// FromFilename determines the archive format to use based on the name. The
+// options are passed to the archive constructor.
+func FromFilename(name string, opts ...archive.Option) (archive.Archive, error) {
 	if strings.HasSuffix(name, ".tar") {
-		return tar.New(), nil
+		return tar.New(opts...), nil
 	}
 
 	if strings.HasSuffix(name, ".tgz") || strings.HasSuffix(name, ".tar.gz") {
-		return tgz.New(), nil
+		return tgz.New(opts...), nil
 	}
 
 	return nil, fmt.Errorf("Unknown file format for archive %s", name)
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// DefaultAccessInterval is the minimum time between two recorded accesses
+// of the same cache item.
+const DefaultAccessInterval = 24 * time.Hour
+
+// accessSuffix is appended to a cache key to name its access index object.
+const accessSuffix = "~access"
+
+// accessPath returns the path of the access index object for the key.
+func accessPath(key string) string {
+	return key + accessSuffix
+}
+
+// readAccess returns the last access time recorded for the key.
+func readAccess(s storage.Storage, key string) (time.Time, error) {
+	var buf bytes.Buffer
+
+	if err := s.Get(accessPath(key), &buf); err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(buf.String()))
+}
+
+// writeAccess records t as the last access time of the key.
+func writeAccess(s storage.Storage, key string, t time.Time) error {
+	return s.Put(accessPath(key), strings.NewReader(t.UTC().Format(time.RFC3339Nano)))
+}
+
+// touch records an access of the key unless one was recorded within the
+// configured interval.
+func (c Cache) touch(key string) error {
+	if c.accessInterval < 0 {
+		return nil
+	}
+
+	now := c.now()
+
+	if last, err := readAccess(c.s, key); err == nil && now.Sub(last) < c.accessInterval {
+		return nil
+	}
+
+	return writeAccess(c.s, key, now)
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestAccess(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("access tracking", func() {
+		var (
+			s   storage.Storage
+			now time.Time
+			c   Cache
+		)
+
+		g.BeforeEach(func() {
+			now = time.Date(2020, 8, 5, 20, 23, 42, 0, time.UTC)
+			s, _ = memory.New(&memory.Options{Clock: func() time.Time { return now }})
+			c = New(s, tar.New(), WithAccessInterval(time.Hour), WithClock(func() time.Time { return now }))
+		})
+
+		g.It("Should record access on first touch", func() {
+			g.Assert(c.touch("key.tar") == nil).IsTrue("failed to touch")
+
+			last, err := readAccess(s, "key.tar")
+			g.Assert(err == nil).IsTrue("failed to read access")
+			g.Assert(last.Equal(now)).IsTrue("unexpected access time")
+		})
+
+		g.It("Should throttle access writes", func() {
+			c.touch("key.tar")
+			first := now
+
+			now = now.Add(30 * time.Minute)
+			c.touch("key.tar")
+
+			last, _ := readAccess(s, "key.tar")
+			g.Assert(last.Equal(first)).IsTrue("access was recorded within interval")
+
+			now = now.Add(time.Hour)
+			c.touch("key.tar")
+
+			last, _ = readAccess(s, "key.tar")
+			g.Assert(last.Equal(now)).IsTrue("access was not recorded after interval")
+		})
+
+		g.It("Should not record access when disabled", func() {
+			c = New(s, tar.New(), WithAccessInterval(-1))
+			c.touch("key.tar")
+
+			_, err := readAccess(s, "key.tar")
+			g.Assert(err != nil).IsTrue("access was recorded")
+		})
+
+		g.It("Should expire on last use", func() {
+			old := time.Now().AddDate(0, 0, -40)
+
+			g.Assert(IsExpired(storage.FileEntry{LastModified: old})).IsTrue("failed to expire unused item")
+			g.Assert(IsExpired(storage.FileEntry{LastModified: old, LastAccessed: time.Now()})).IsFalse("expired recently used item")
+		})
+
+		g.It("Should pass access time to the flusher", func() {
+			s.Put("proj/used.tar", strings.NewReader("used"))
+			s.Put("proj/unused.tar", strings.NewReader("unused"))
+			s.Put("proj/gone.tar~access", strings.NewReader(""))
+			writeAccess(s, "proj/used.tar", time.Now())
+
+			f := NewFlusher(s, func(file storage.FileEntry) bool {
+				return file.LastAccessed.IsZero()
+			})
+			g.Assert(f.Flush("proj/") == nil).IsTrue("failed to flush")
+
+			files, _ := s.List("proj/")
+			g.Assert(len(files)).Equal(2)
+			g.Assert(files[0].Path).Equal("proj/used.tar")
+			g.Assert(files[1].Path).Equal("proj/used.tar~access")
+		})
+
+		g.It("Should keep cache items named like access indexes of other items", func() {
+			s.Put("proj/data.access", strings.NewReader("data"))
+
+			f := NewFlusher(s, func(storage.FileEntry) bool { return false })
+			g.Assert(f.Flush("proj/") == nil).IsTrue("failed to flush")
+
+			files, _ := s.List("proj/")
+			g.Assert(len(files)).Equal(1)
+			g.Assert(files[0].Path).Equal("proj/data.access")
+		})
+
+		g.It("Should reject keys named like access indexes", func() {
+			err := c.Rebuild([]string{"mount1"}, "archive.tar~access")
+			g.Assert(err != nil).IsTrue("failed to reject the key")
+
+			g.Assert(c.Restore("archive.tar", "archive.tar~access") == nil).IsTrue("returned an error")
+
+			files, _ := s.List("")
+			g.Assert(len(files)).Equal(0)
+		})
+	})
+}
@@ -1,11 +1,17 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/drone/drone-cache-lib/archive"
 	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/progress"
 	"github.com/drone/drone-cache-lib/storage"
 )
 
@@ -13,85 +19,472 @@ import (
 type Cache struct {
 	s storage.Storage
 	a archive.Archive
+
+	accessInterval time.Duration
+	skipExisting   bool
+	deltaChain     int
+	parallelism    int
+	lockPolicy     LockPolicy
+	lockTTL        time.Duration
+	lockPoll       time.Duration
+	unpackOpts     []archive.Option
+	progress       progress.Observer
+	build          BuildInfo
+	log            logger.Logger
+	now            func() time.Time
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithAccessInterval sets the minimum time between two recorded accesses of
+// the same cache item. A zero interval records every restore and a negative
+// one disables access tracking.
+func WithAccessInterval(d time.Duration) Option {
+	return func(c *Cache) {
+		c.accessInterval = d
+	}
+}
+
+// WithSkipExisting makes Rebuild keep an existing cache item instead of
+// replacing it.
+func WithSkipExisting() Option {
+	return func(c *Cache) {
+		c.skipExisting = true
+	}
+}
+
+// WithDelta makes Rebuild upload only the files that changed since the
+// cache item was last written, as long as the item consists of at most max
+// delta archives on top of a full one. Restore applies the chain of
+// archives transparently.
+func WithDelta(max int) Option {
+	return func(c *Cache) {
+		c.deltaChain = max
+	}
+}
+
+// WithParallelism limits how many mounts RebuildMounts and RestoreMounts
+// process at the same time.
+func WithParallelism(n int) Option {
+	return func(c *Cache) {
+		c.parallelism = n
+	}
+}
+
+// WithLock makes Rebuild take a lock on the cache key, so builds finishing
+// at the same time don't upload the same cache item. Builds that find the
+// lock held skip or wait according to the policy. A build that stops
+// renewing its lock, for example because it was killed, loses it after the
+// ttl. A zero ttl uses DefaultLockTTL.
+//
+// The lock is best effort. Taking a free lock is atomic on storages
+// implementing storage.Creator, but two builds taking over an expired lock
+// at the same time may both rebuild. A build that lost its lock reports it
+// in Result.LockLost.
+func WithLock(policy LockPolicy, ttl time.Duration) Option {
+	return func(c *Cache) {
+		if ttl <= 0 {
+			ttl = DefaultLockTTL
+		}
+
+		c.lockPolicy = policy
+		c.lockTTL = ttl
+	}
+}
+
+// WithUnpackOptions sets archive options used when restoring, for example
+// the conflict policy for files that already exist.
+func WithUnpackOptions(opts ...archive.Option) Option {
+	return func(c *Cache) {
+		c.unpackOpts = opts
+	}
+}
+
+// WithProgress sets the observer receiving the progress of packing,
+// uploading, downloading and unpacking cache items.
+func WithProgress(o progress.Observer) Option {
+	return func(c *Cache) {
+		c.progress = o
+	}
+}
+
+// WithBuildInfo sets the build recorded in the metadata of rebuilt cache
+// items.
+func WithBuildInfo(b BuildInfo) Option {
+	return func(c *Cache) {
+		c.build = b
+	}
+}
+
+// WithLogger sets the logger the cache writes to. Nothing is logged by
+// default.
+func WithLogger(l logger.Logger) Option {
+	return func(c *Cache) {
+		c.log = l
+	}
+}
+
+// WithClock sets the function used to read the current time.
+func WithClock(now func() time.Time) Option {
+	return func(c *Cache) {
+		c.now = now
+	}
 }
 
 // New creates a new cache object.
-func New(s storage.Storage, a archive.Archive) Cache {
-	return Cache{s: s, a: a}
+func New(s storage.Storage, a archive.Archive, opts ...Option) Cache {
+	c := Cache{
+		s:              s,
+		a:              a,
+		accessInterval: DefaultAccessInterval,
+		parallelism:    DefaultParallelism,
+		lockPoll:       DefaultLockPoll,
+		now:            time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	c.log = logger.OrDiscard(c.log)
+
+	return c
+}
+
+// Logger returns the logger the cache writes to.
+func (c Cache) Logger() logger.Logger {
+	return c.log
 }
 
 // NewDefault creates a new cache object with tar format.
-func NewDefault(s storage.Storage) Cache {
+func NewDefault(s storage.Storage, opts ...Option) Cache {
 	// Return default Cache that uses tar and flushes items after 7 days
-	return New(s, tar.New())
+	return New(s, tar.New(), opts...)
+}
+
+// Result describes what a rebuild or restore did.
+type Result struct {
+	// Key is the cache key written or restored. It is the fallback key if
+	// the cache was restored from the fallback.
+	Key string
+
+	// Hit reports whether a cache item was restored.
+	Hit bool
+
+	// Fallback reports whether the fallback key was tried.
+	Fallback bool
+
+	// Skipped reports whether a rebuild kept the existing cache item.
+	Skipped bool
+
+	// Locked reports whether a rebuild was skipped because another build
+	// held the lock.
+	Locked bool
+
+	// LockLost reports whether another build took over the lock while the
+	// rebuild was running, so the cache item may have been written by both.
+	LockLost bool
+
+	// Size is the number of bytes uploaded or downloaded.
+	Size int64
 }
 
 // Rebuild rebuilds the new cache.
 func (c Cache) Rebuild(srcs []string, dst string) error {
-	return rebuildCache(srcs, dst, c.s, c.a)
+	_, err := c.RebuildResult(srcs, dst)
+	return err
 }
 
-// Restore restores the existing cache.
-func (c Cache) Restore(src string, fallback string) error {
-	err := restoreCache(src, c.s, c.a)
+// RebuildResult rebuilds the cache like Rebuild and describes what it did.
+func (c Cache) RebuildResult(srcs []string, dst string) (Result, error) {
+	c.log = c.log.WithFields(logger.Fields{"key": dst})
 
-	if err != nil && fallback != "" && fallback != src {
-		log.Warnf("Failed to retrieve %s, trying %s", src, fallback)
-		err = restoreCache(fallback, c.s, c.a)
+	if err := checkKey(dst); err != nil {
+		return Result{Key: dst}, err
+	}
+
+	if c.lockTTL > 0 {
+		l, ok, err := c.lock(dst)
+		if err != nil {
+			return Result{Key: dst}, err
+		}
+
+		if !ok {
+			c.log.Infof("Cache at %s is being rebuilt by another build, skipping rebuild", dst)
+			return Result{Key: dst, Skipped: true, Locked: true}, nil
+		}
+
+		res, err := c.rebuild(srcs, dst)
+		res.LockLost = l.unlock()
+
+		return res, err
+	}
+
+	return c.rebuild(srcs, dst)
+}
+
+// rebuild rebuilds the cache once the lock, if any, is held.
+func (c Cache) rebuild(srcs []string, dst string) (Result, error) {
+	if c.skipExisting {
+		file, err := storage.Stat(c.s, dst)
+		if err == nil {
+			c.log.Infof("Cache already exists at %s (%d bytes), skipping rebuild", dst, file.Size)
+			return Result{Key: dst, Skipped: true}, nil
+		}
+
+		if !storage.IsNotFound(err) {
+			c.log.Warnf("Failed to check for existing cache at %s: %s", dst, err)
+		}
+	}
+
+	if c.deltaChain > 0 {
+		return c.rebuildDelta(srcs, dst)
+	}
+
+	started := c.now()
+	previous := c.dropDelta(dst)
+
+	meta, err := c.rebuildCache(srcs, dst)
+	if err == nil {
+		c.describe(dst, srcs, started, meta)
 	}
 
+	c.deleteLayers(dst, previous)
+
+	return Result{Key: dst, Size: meta.Size}, err
+}
+
+// Restore restores the existing cache.
+func (c Cache) Restore(src string, fallback string) error {
+	res, err := c.RestoreResult(src, fallback)
+
 	// Cache plugin should print an error but it should not return it
 	// this is so the build continues even if the cache cant be restored
 	if err != nil {
-		log.Warnf("Cache could not be restored %s", err)
+		c.log.Warnf("Cache could not be restored %s", err)
+	} else if !res.Hit {
+		c.log.Infof("No cache found at %s", res.Key)
 	}
 
 	return nil
 }
 
-func restoreCache(src string, s storage.Storage, a archive.Archive) error {
+// RestoreResult restores the cache like Restore and describes what it did.
+// Unlike Restore it returns errors, except for a missing cache item, which
+// is reported as a result without a hit.
+func (c Cache) RestoreResult(src string, fallback string) (Result, error) {
+	c.log = c.log.WithFields(logger.Fields{"key": src})
+
+	for _, key := range []string{src, fallback} {
+		if err := checkKey(key); err != nil {
+			return Result{Key: src}, err
+		}
+	}
+
+	res, err := c.restoreFallback(src, fallback)
+
+	if storage.IsNotFound(err) {
+		return res, nil
+	}
+
+	return res, err
+}
+
+// restoreFallback restores src, or fallback if src can't be restored.
+func (c Cache) restoreFallback(src string, fallback string) (Result, error) {
+	res := Result{Key: src}
+	size, err := c.restore(src)
+
+	if err != nil && fallback != "" && fallback != src {
+		if storage.IsNotFound(err) {
+			c.log.Infof("No cache found at %s, trying %s", src, fallback)
+		} else {
+			c.log.Warnf("Failed to retrieve %s, trying %s: %s", src, fallback, err)
+		}
+
+		res.Key = fallback
+		res.Fallback = true
+		size, err = c.restore(fallback)
+	}
+
+	if err != nil {
+		return res, err
+	}
+
+	res.Hit = true
+	res.Size = size
+
+	if err := c.touch(res.Key); err != nil {
+		c.log.Warnf("Failed to record access of %s: %s", res.Key, err)
+	}
+
+	return res, nil
+}
+
+// restore looks up the cache item before downloading it, so a missing item
+// is detected without starting the download. It returns the number of bytes
+// downloaded.
+func (c Cache) restore(src string) (int64, error) {
+	file, err := storage.Stat(c.s, src)
+
+	switch {
+	case storage.IsNotFound(err):
+		return 0, err
+	case err != nil:
+		c.log.Debugf("Failed to look up %s: %s", src, err)
+	default:
+		c.log.Infof("Restoring cache from %s (%d bytes)", src, file.Size)
+	}
+
+	idx, err := readDelta(c.s, src)
+	if err == nil {
+		return c.restoreDelta(src, idx)
+	}
+
+	if !storage.IsNotFound(err) {
+		c.log.Warnf("Failed to read delta index of %s: %s", src, err)
+	}
+
+	return c.restoreCache(src, file.Size)
+}
+
+// restoreCache downloads and unpacks the archive at src and returns the
+// number of bytes downloaded. The size is used to report progress and may
+// be zero.
+func (c Cache) restoreCache(src string, size int64) (int64, error) {
 	reader, writer := io.Pipe()
 
 	cw := make(chan error, 1)
 	defer close(cw)
 
+	o := progress.WithKey(c.progress, src)
+	t := progress.NewTracker(o, progress.Download, size)
+
 	go func() {
-		defer writer.Close()
+		err := c.s.Get(src, t.Writer(writer))
+		writer.CloseWithError(err)
+		t.Finish(err)
 
-		cw <- s.Get(src, writer)
+		cw <- err
 	}()
 
-	err := a.Unpack("", reader)
+	opts := append(append([]archive.Option(nil), c.unpackOpts...), c.archiveOptions(o)...)
+
+	res, err := archive.UnpackWithOptions(c.a, "", reader, opts...)
+
+	if res.Conflicts > 0 {
+		c.log.Infof("Restored %s over %d existing paths, skipped %d", src, res.Conflicts, res.Skipped)
+	}
+
+	// Drain any trailing padding so the download can complete, or stop it
+	// if the archive could not be read
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, reader)
+	}
+	reader.CloseWithError(err)
+
 	werr := <-cw
 
 	if werr != nil {
-		return werr
+		return t.Event().BytesWritten, werr
 	}
 
-	return err
+	return t.Event().BytesWritten, err
 }
 
-func rebuildCache(srcs []string, dst string, s storage.Storage, a archive.Archive) error {
-	log.Infof("Rebuilding cache at %s to %s", srcs, dst)
+// rebuildCache packs the sources, uploads the archive to dst and returns the
+// metadata describing the archive.
+func (c Cache) rebuildCache(srcs []string, dst string) (Metadata, error) {
+	c.log.Infof("Rebuilding cache at %s to %s", srcs, dst)
 
 	reader, writer := io.Pipe()
-	defer reader.Close()
 
 	cw := make(chan error, 1)
 	defer close(cw)
 
+	o := progress.WithKey(c.progress, dst)
+
+	// Record what the archive packed, and pass it on
+	var mu sync.Mutex
+	var packed progress.Event
+
+	po := progress.Func(func(e progress.Event) {
+		mu.Lock()
+		packed = e
+		mu.Unlock()
+
+		if o != nil {
+			o.Observe(e)
+		}
+	})
+
 	go func() {
-		defer writer.Close()
+		err := archive.PackWithOptions(c.a, srcs, writer, c.archiveOptions(po)...)
+		writer.CloseWithError(err)
 
-		cw <- a.Pack(srcs, writer)
+		cw <- err
 	}()
 
-	err := s.Put(dst, reader)
-	werr := <-cw
+	t := progress.NewTracker(o, progress.Upload, 0)
+	h := sha256.New()
 
+	// Upload to a temporary object first on storages that can move it into
+	// place, so restores never read a partial archive
+	key := dst
+	if storage.CanRename(c.s) {
+		key = tempKey(dst)
+	}
+
+	err := c.s.Put(key, t.Reader(io.TeeReader(reader, h)))
+	t.Finish(err)
+
+	// Unblock the packer if the upload stopped reading early
+	reader.CloseWithError(err)
+
+	werr := <-cw
 	if werr != nil {
-		return werr
+		err = werr
 	}
 
-	return err
+	if key != dst {
+		if err == nil {
+			err = storage.Rename(c.s, key, dst)
+		}
+
+		if err != nil {
+			if derr := c.s.Delete(key); derr != nil {
+				c.log.Warnf("Failed to delete %s: %s", key, derr)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return Metadata{
+		Archive:          dst,
+		Format:           archive.Name(c.a),
+		Size:             t.Event().BytesRead,
+		UncompressedSize: packed.BytesWritten,
+		Files:            packed.Files,
+		Digest:           "sha256:" + hex.EncodeToString(h.Sum(nil)),
+	}, err
+}
+
+// archiveOptions returns the options passing the logger and the progress
+// observer of the cache to the archive. An archive keeps its own logger if
+// the cache has none.
+func (c Cache) archiveOptions(o progress.Observer) []archive.Option {
+	var opts []archive.Option
+
+	if c.log != logger.Discard {
+		opts = append(opts, archive.WithLogger(c.log))
+	}
+
+	if o != nil {
+		opts = append(opts, archive.WithProgress(o))
+	}
+
+	return opts
 }
@@ -1,15 +1,26 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/progress"
+	"github.com/drone/drone-cache-lib/storage"
 	"github.com/drone/drone-cache-lib/storage/dummy"
+	"github.com/drone/drone-cache-lib/storage/memory"
 	"github.com/franela/goblin"
+	"github.com/sirupsen/logrus"
 )
 
 func TestCache(t *testing.T) {
@@ -61,6 +72,70 @@ func TestCache(t *testing.T) {
 			})
 		})
 
+		g.Describe("Reserved keys", func() {
+			g.It("Should reject keys named like sidecars", func() {
+				s, _ := memory.New(nil)
+				c := NewDefault(s)
+
+				_, err := c.RebuildResult([]string{"mount1"}, "archive.tar~access")
+				g.Assert(err != nil).IsTrue("failed to reject the key")
+
+				_, err = c.RestoreResult("archive.tar", "archive.tar~access")
+				g.Assert(err != nil).IsTrue("failed to reject the fallback")
+
+				files, _ := s.List("")
+				g.Assert(len(files)).Equal(0)
+			})
+
+			g.It("Should map archives to the key of their item", func() {
+				for p, want := range map[string]string{
+					"archive.tgz":                      "archive.tgz",
+					"archive.tgz~delta-2":              "archive.tgz",
+					"archive.tgz~tmp-0123456789abcdef": "archive.tgz",
+				} {
+					key, ok := ArchiveKey(p)
+					g.Assert(ok).IsTrue(p)
+					g.Assert(key).Equal(want)
+				}
+
+				_, ok := ArchiveKey("archive.tgz~delta")
+				g.Assert(ok).IsFalse("took the delta index for an archive")
+
+				_, ok = ArchiveKey("archive.tgz~meta")
+				g.Assert(ok).IsFalse("took the metadata for an archive")
+			})
+		})
+
+		g.Describe("Rebuild existing", func() {
+			g.It("Should skip rebuild when the cache exists", func() {
+				s, err := memory.New(nil)
+				g.Assert(err == nil).IsTrue("failed to create storage")
+
+				s.Put("archive.tar", strings.NewReader("existing"))
+
+				c := NewDefault(s, WithSkipExisting())
+				err = c.Rebuild([]string{"mount1"}, "archive.tar")
+				g.Assert(err == nil).IsTrue("failed to skip rebuild")
+
+				var buf bytes.Buffer
+				s.Get("archive.tar", &buf)
+				g.Assert(buf.String()).Equal("existing")
+			})
+
+			g.It("Should rebuild when the cache is missing", func() {
+				s, err := memory.New(nil)
+				g.Assert(err == nil).IsTrue("failed to create storage")
+
+				os.Chdir("/tmp/fixtures/mounts")
+				c := NewDefault(s, WithSkipExisting())
+				err = c.Rebuild([]string{"test.txt"}, "archive.tar")
+				g.Assert(err == nil).IsTrue("failed to rebuild")
+
+				ok, _ := storage.Exists(s, "archive.tar")
+				g.Assert(ok).IsTrue("failed to write cache")
+			})
+		})
+
 		g.Describe("Restore", func() {
 			g.It("Should restore with no errors", func() {
 				s, err := dummy.New(dummyOpts)
@@ -100,6 +175,139 @@ func TestCache(t *testing.T) {
 				err = c.Restore("fixtures/test2.tar", "")
 				g.Assert(err == nil).IsTrue("should not have returned error on missing file")
 			})
+
+			g.It("Should report a missing file as not found", func() {
+				s, err := memory.New(nil)
+				g.Assert(err == nil).IsTrue("failed to create storage")
+
+				_, err = New(s, tar.New()).restoreCache("missing.tar", 0)
+				g.Assert(storage.IsNotFound(err)).IsTrue("failed to report missing file")
+			})
+
+			g.It("Should surface other storage errors", func() {
+				s, err := memory.New(&memory.Options{Fail: func(op, p string) error {
+					return errors.New("connection reset")
+				}})
+				g.Assert(err == nil).IsTrue("failed to create storage")
+
+				_, err = New(s, tar.New()).restoreCache("archive.tar", 0)
+				g.Assert(err != nil).IsTrue("failed to return error")
+				g.Assert(storage.IsNotFound(err)).IsFalse("reported storage error as not found")
+			})
+
+			g.It("Should describe what rebuild and restore did", func() {
+				dir, _ := ioutil.TempDir("", "result")
+				defer os.RemoveAll(dir)
+				defer os.Chdir("/tmp")
+				os.Chdir(dir)
+
+				s, _ := memory.New(nil)
+				c := NewDefault(s, WithSkipExisting())
+
+				os.Mkdir("mount", 0755)
+				ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+
+				res, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+				g.Assert(err == nil).IsTrue("failed to rebuild")
+				g.Assert(res.Key).Equal("cache.tar")
+				g.Assert(res.Size).Equal(int64(2560))
+				g.Assert(res.Skipped).IsFalse()
+
+				res, err = c.RebuildResult([]string{"mount"}, "cache.tar")
+				g.Assert(err == nil).IsTrue("failed to rebuild")
+				g.Assert(res.Skipped).IsTrue()
+
+				res, err = c.RestoreResult("cache.tar", "")
+				g.Assert(err == nil).IsTrue("failed to restore")
+				g.Assert(res).Equal(Result{Key: "cache.tar", Hit: true, Size: 2560})
+
+				res, err = c.RestoreResult("missing.tar", "cache.tar")
+				g.Assert(err == nil).IsTrue("failed to restore")
+				g.Assert(res).Equal(Result{Key: "cache.tar", Hit: true, Fallback: true, Size: 2560})
+
+				res, err = c.RestoreResult("missing.tar", "")
+				g.Assert(err == nil).IsTrue("reported a missing item as error")
+				g.Assert(res).Equal(Result{Key: "missing.tar"})
+			})
+
+			g.It("Should write to the configured logger", func() {
+				dir, _ := ioutil.TempDir("", "logger")
+				defer os.RemoveAll(dir)
+				defer os.Chdir("/tmp")
+				os.Chdir(dir)
+
+				var buf bytes.Buffer
+				l := logrus.New()
+				l.SetOutput(&buf)
+
+				s, _ := memory.New(nil)
+				c := NewDefault(s, WithLogger(logger.NewLogrus(l)))
+
+				os.Mkdir("mount", 0755)
+				ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+
+				g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+				g.Assert(c.Restore("missing.tar", "") == nil).IsTrue("failed to restore")
+
+				out := buf.String()
+				g.Assert(strings.Contains(out, "Rebuilding cache at [mount] to cache.tar")).IsTrue(out)
+				g.Assert(strings.Contains(out, "key=cache.tar")).IsTrue(out)
+				g.Assert(strings.Contains(out, "No cache found at missing.tar")).IsTrue(out)
+			})
+
+			g.It("Should report the progress of every stage", func() {
+				dir, _ := ioutil.TempDir("", "progress")
+				defer os.RemoveAll(dir)
+				defer os.Chdir("/tmp")
+				os.Chdir(dir)
+
+				var mu sync.Mutex
+				done := make(map[progress.Stage]progress.Event)
+				o := progress.Func(func(e progress.Event) {
+					mu.Lock()
+					defer mu.Unlock()
+
+					if e.Done {
+						done[e.Stage] = e
+					}
+				})
+
+				s, _ := memory.New(nil)
+				c := NewDefault(s, WithProgress(o))
+
+				os.Mkdir("mount", 0755)
+				ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+				g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+				g.Assert(c.Restore("cache.tar", "") == nil).IsTrue("failed to restore")
+
+				g.Assert(len(done)).Equal(4)
+				g.Assert(done[progress.Pack].Files).Equal(1)
+				g.Assert(done[progress.Pack].Key).Equal("cache.tar")
+				g.Assert(done[progress.Upload].BytesRead).Equal(done[progress.Pack].BytesWritten)
+				g.Assert(done[progress.Download].BytesWritten).Equal(done[progress.Download].Total)
+				g.Assert(done[progress.Unpack].BytesWritten).Equal(int64(6))
+			})
+
+			g.It("Should apply the conflict policy to existing files", func() {
+				dir, _ := ioutil.TempDir("", "conflict")
+				defer os.RemoveAll(dir)
+				defer os.Chdir("/tmp")
+				os.Chdir(dir)
+
+				s, _ := memory.New(nil)
+				os.Mkdir("mount", 0755)
+				ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+				g.Assert(NewDefault(s).Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+				ioutil.WriteFile("mount/file.txt", []byte("existing content"), 0644)
+				NewDefault(s, WithUnpackOptions(archive.WithConflict(archive.ConflictSkip))).Restore("cache.tar", "")
+				content, _ := ioutil.ReadFile("mount/file.txt")
+				g.Assert(string(content)).Equal("existing content")
+
+				NewDefault(s).Restore("cache.tar", "")
+				content, _ = ioutil.ReadFile("mount/file.txt")
+				g.Assert(string(content)).Equal("cached")
+			})
 		})
 	})
 }
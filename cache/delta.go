@@ -0,0 +1,382 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// deltaSuffix is appended to a cache key to name its delta index object.
+// Delta archives are stored under the index path followed by a sequence.
+const deltaSuffix = "~delta"
+
+// deltaIndex describes a cache item made of a full archive followed by
+// delta archives, and the files the chain restores.
+type deltaIndex struct {
+	Layers []deltaLayer         `json:"layers"`
+	Files  map[string]deltaFile `json:"files"`
+}
+
+// deltaLayer is a single archive of the chain. Remove lists the paths that
+// are deleted or replaced before the archive is unpacked.
+type deltaLayer struct {
+	Key    string   `json:"key"`
+	Remove []string `json:"remove,omitempty"`
+}
+
+// deltaFile records the state of a single path. Hash is the content digest
+// of regular files and the target of symlinks.
+type deltaFile struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Hash    string      `json:"hash,omitempty"`
+}
+
+// deltaPath returns the path of the delta index object for the key.
+func deltaPath(key string) string {
+	return key + deltaSuffix
+}
+
+// readDelta returns the delta index of the key.
+func readDelta(s storage.Storage, key string) (deltaIndex, error) {
+	var buf bytes.Buffer
+	var idx deltaIndex
+
+	if err := s.Get(deltaPath(key), &buf); err != nil {
+		return idx, err
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &idx); err != nil {
+		return idx, fmt.Errorf("invalid delta index for %s: %s", key, err)
+	}
+
+	return idx, nil
+}
+
+// writeDelta stores the delta index of the key.
+func writeDelta(s storage.Storage, key string, idx deltaIndex) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(deltaPath(key), bytes.NewReader(b))
+}
+
+// rebuildDelta uploads only the files that changed since the chain stored
+// at dst was written. A full archive is written when there is no chain yet
+// or it reached the maximum length.
+func (c Cache) rebuildDelta(srcs []string, dst string) (Result, error) {
+	base, err := readDelta(c.s, dst)
+
+	switch {
+	case storage.IsNotFound(err):
+		c.log.Infof("No delta index found at %s, writing full archive", dst)
+		return c.rebuildFull(srcs, dst, nil)
+	case err != nil:
+		c.log.Warnf("Failed to read delta index of %s, writing full archive: %s", dst, err)
+		return c.rebuildFull(srcs, dst, nil)
+	case len(base.Layers) > c.deltaChain:
+		c.log.Infof("Delta chain of %s reached %d archives, writing full archive", dst, len(base.Layers))
+		return c.rebuildFull(srcs, dst, base.Layers)
+	}
+
+	res := Result{Key: dst}
+
+	files, changed, remove, err := scanFiles(srcs, base.Files)
+	if err != nil {
+		return res, err
+	}
+
+	if len(changed) == 0 && len(remove) == 0 {
+		c.log.Infof("Cache at %s is unchanged, skipping rebuild", dst)
+		res.Skipped = true
+		return res, nil
+	}
+
+	layer := deltaLayer{
+		Key:    fmt.Sprintf("%s-%d", deltaPath(dst), c.now().UnixNano()),
+		Remove: remove,
+	}
+
+	c.log.Infof("Rebuilding %d changed and %d removed paths to %s", len(changed), len(remove), layer.Key)
+
+	started := c.now()
+
+	meta, err := c.rebuildCache(changed, layer.Key)
+	if res.Size = meta.Size; err != nil {
+		return res, err
+	}
+
+	// The delta archive only applies on top of the chain it was compared
+	// with, so drop it if another rebuild changed the chain meanwhile
+	if current, err := readDelta(c.s, dst); err != nil || !sameLayers(current.Layers, base.Layers) {
+		c.log.Warnf("Delta index of %s changed while rebuilding, discarding %s", dst, layer.Key)
+
+		if err := c.s.Delete(layer.Key); err != nil {
+			c.log.Warnf("Failed to delete delta archive %s: %s", layer.Key, err)
+		}
+
+		return res, nil
+	}
+
+	if err := writeDelta(c.s, dst, deltaIndex{
+		Layers: append(base.Layers, layer),
+		Files:  files,
+	}); err != nil {
+		return res, err
+	}
+
+	c.describeLayer(dst, changed, started, meta)
+
+	return res, nil
+}
+
+// rebuildFull writes a full archive and starts a new chain, removing the
+// delta archives of the previous one.
+func (c Cache) rebuildFull(srcs []string, dst string, previous []deltaLayer) (Result, error) {
+	res := Result{Key: dst}
+
+	files, _, _, err := scanFiles(srcs, nil)
+	if err != nil {
+		return res, err
+	}
+
+	started := c.now()
+
+	meta, err := c.rebuildCache(srcs, dst)
+	if res.Size = meta.Size; err != nil {
+		return res, err
+	}
+
+	// Another rebuild may have added delta archives meanwhile
+	if current, err := readDelta(c.s, dst); err == nil {
+		previous = append(previous, current.Layers...)
+	}
+
+	if err := writeDelta(c.s, dst, deltaIndex{
+		Layers: []deltaLayer{{Key: dst}},
+		Files:  files,
+	}); err != nil {
+		return res, err
+	}
+
+	c.deleteLayers(dst, previous)
+	c.describe(dst, srcs, started, meta)
+
+	return res, nil
+}
+
+// dropDelta removes the delta index of the key before a full archive is
+// written without one, so restores don't apply the old chain on top of it.
+// It returns the delta archives of the old chain.
+func (c Cache) dropDelta(key string) []deltaLayer {
+	idx, err := readDelta(c.s, key)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+
+	if err := c.s.Delete(deltaPath(key)); err != nil {
+		c.log.Warnf("Failed to delete delta index of %s: %s", key, err)
+		return nil
+	}
+
+	return idx.Layers
+}
+
+// deleteLayers removes the delta archives of the key. The full archive at
+// the key itself is kept.
+func (c Cache) deleteLayers(key string, layers []deltaLayer) {
+	for _, layer := range layers {
+		if layer.Key == key {
+			continue
+		}
+
+		if err := c.s.Delete(layer.Key); err != nil {
+			c.log.Warnf("Failed to delete delta archive %s: %s", layer.Key, err)
+		}
+	}
+}
+
+// sameLayers reports whether two chains are made of the same archives.
+func sameLayers(a, b []deltaLayer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Key != b[i].Key {
+			return false
+		}
+	}
+
+	return true
+}
+
+// restoreDelta restores every archive of the chain in order and returns the
+// number of bytes downloaded.
+func (c Cache) restoreDelta(src string, idx deltaIndex) (int64, error) {
+	c.log.Infof("Restoring cache from %s with %d delta archives", src, len(idx.Layers)-1)
+
+	var size int64
+
+	for _, layer := range idx.Layers {
+		for _, p := range layer.Remove {
+			name, err := localPath(p)
+			if err != nil {
+				return size, fmt.Errorf("invalid delta index for %s: %s", src, err)
+			}
+
+			if err := os.RemoveAll(name); err != nil {
+				return size, err
+			}
+		}
+
+		n, err := c.restoreCache(layer.Key, 0)
+		size += n
+
+		if err != nil {
+			return size, err
+		}
+	}
+
+	return size, nil
+}
+
+// localPath returns the path of a file of the delta index. Like archive
+// entries, it must stay below the working directory, so a corrupted index
+// can't remove anything else.
+func localPath(p string) (string, error) {
+	name := filepath.Clean(filepath.FromSlash(p))
+
+	if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q leaves the working directory", p)
+	}
+
+	return name, nil
+}
+
+// scanFiles walks the sources like the archive does and compares them with
+// the base files. It returns the current files, the paths to pack into a
+// delta archive and the paths to remove before unpacking it.
+func scanFiles(srcs []string, base map[string]deltaFile) (map[string]deltaFile, []string, []string, error) {
+	files := make(map[string]deltaFile)
+
+	var changed, remove []string
+	var added string
+
+	for _, s := range srcs {
+		if _, err := os.Stat(s); err != nil {
+			return nil, nil, nil, err
+		}
+
+		err := filepath.Walk(s, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			name := strings.TrimPrefix(filepath.ToSlash(path), "/")
+
+			f := deltaFile{
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+				Mode:    fi.Mode(),
+			}
+
+			// Everything below a new directory is packed with it
+			if added != "" && strings.HasPrefix(name, added+"/") {
+				files[name], err = hashFile(path, f)
+				return err
+			}
+			added = ""
+
+			old, ok := base[name]
+
+			switch {
+			case fi.IsDir() && ok && old.Mode.IsDir():
+				files[name] = old
+				return nil
+
+			case fi.IsDir():
+				added = name
+
+			// Archives keep modification times in seconds only
+			case ok && old.Mode.Type() == f.Mode.Type() && old.Size == f.Size && old.ModTime.Unix() == f.ModTime.Unix():
+				files[name] = old
+				return nil
+			}
+
+			if f, err = hashFile(path, f); err != nil {
+				return err
+			}
+			files[name] = f
+
+			if ok && !f.Mode.IsDir() && old.Mode.Type() == f.Mode.Type() && old.Hash == f.Hash {
+				files[name] = old
+				return nil
+			}
+
+			changed = append(changed, path)
+			if ok {
+				remove = append(remove, name)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	for name := range base {
+		if _, ok := files[name]; !ok {
+			remove = append(remove, name)
+		}
+	}
+
+	sort.Strings(remove)
+
+	return files, changed, remove, nil
+}
+
+// hashFile sets the hash of a regular file or symlink.
+func hashFile(path string, f deltaFile) (deltaFile, error) {
+	switch {
+	case f.Mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(path)
+		if err != nil {
+			return f, err
+		}
+
+		f.Hash = link
+
+	case f.Mode.IsRegular():
+		file, err := os.Open(path)
+		if err != nil {
+			return f, err
+		}
+
+		defer file.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, file); err != nil {
+			return f, err
+		}
+
+		f.Hash = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return f, nil
+}
@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestDelta(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("delta rebuilds", func() {
+		var (
+			dir string
+			s   storage.Storage
+			c   Cache
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "delta")
+			os.MkdirAll(filepath.Join(dir, "build", "mount", "dir"), 0755)
+			os.MkdirAll(filepath.Join(dir, "restore"), 0755)
+			os.Chdir(filepath.Join(dir, "build"))
+
+			writeFile("mount/a.txt", "hello\n")
+			writeFile("mount/dir/b.txt", "hello2\n")
+
+			s, _ = memory.New(nil)
+
+			now := time.Now()
+			c = NewDefault(s, WithDelta(2), WithClock(func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			}))
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should write a full archive first", func() {
+			err := c.Rebuild([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+
+			idx, err := readDelta(s, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to read delta index")
+			g.Assert(len(idx.Layers)).Equal(1)
+			g.Assert(idx.Layers[0].Key).Equal("cache.tar")
+			g.Assert(len(idx.Files)).Equal(4)
+		})
+
+		g.It("Should upload only what changed", func() {
+			c.Rebuild([]string{"mount"}, "cache.tar")
+
+			writeFile("mount/a.txt", "changed\n")
+			os.Remove("mount/dir/b.txt")
+			os.MkdirAll("mount/new", 0755)
+			writeFile("mount/new/c.txt", "new\n")
+
+			err := c.Rebuild([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+
+			idx, _ := readDelta(s, "cache.tar")
+			g.Assert(len(idx.Layers)).Equal(2)
+			g.Assert(strings.Join(idx.Layers[1].Remove, ",")).Equal("mount/a.txt,mount/dir/b.txt")
+
+			// Nothing changed since
+			c.Rebuild([]string{"mount"}, "cache.tar")
+			idx, _ = readDelta(s, "cache.tar")
+			g.Assert(len(idx.Layers)).Equal(2)
+
+			os.Chdir(filepath.Join(dir, "restore"))
+			g.Assert(c.Restore("cache.tar", "") == nil).IsTrue("failed to restore")
+
+			g.Assert(readFile("mount/a.txt")).Equal("changed\n")
+			g.Assert(readFile("mount/new/c.txt")).Equal("new\n")
+			_, err = os.Stat("mount/dir/b.txt")
+			g.Assert(os.IsNotExist(err)).IsTrue("failed to remove deleted file")
+		})
+
+		g.It("Should write a full archive when the chain is too long", func() {
+			c.Rebuild([]string{"mount"}, "cache.tar")
+
+			var layers []string
+			for i := 0; i < 3; i++ {
+				writeFile("mount/a.txt", strings.Repeat("x", i+1))
+				c.Rebuild([]string{"mount"}, "cache.tar")
+
+				idx, _ := readDelta(s, "cache.tar")
+				layers = append(layers, idx.Layers[len(idx.Layers)-1].Key)
+			}
+
+			idx, _ := readDelta(s, "cache.tar")
+			g.Assert(len(idx.Layers)).Equal(1)
+
+			ok, _ := storage.Exists(s, layers[0])
+			g.Assert(ok).IsFalse("failed to remove old delta archive")
+
+			os.Chdir(filepath.Join(dir, "restore"))
+			c.Restore("cache.tar", "")
+			g.Assert(readFile("mount/a.txt")).Equal("xxx")
+		})
+
+		g.It("Should drop the chain when rebuilt without delta archives", func() {
+			c.Rebuild([]string{"mount"}, "cache.tar")
+			writeFile("mount/a.txt", "changed\n")
+			c.Rebuild([]string{"mount"}, "cache.tar")
+
+			idx, _ := readDelta(s, "cache.tar")
+			layer := idx.Layers[1].Key
+
+			writeFile("mount/a.txt", "full\n")
+			err := NewDefault(s).Rebuild([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+
+			ok, _ := storage.Exists(s, deltaPath("cache.tar"))
+			g.Assert(ok).IsFalse("failed to remove delta index")
+			ok, _ = storage.Exists(s, layer)
+			g.Assert(ok).IsFalse("failed to remove delta archive")
+
+			os.Chdir(filepath.Join(dir, "restore"))
+			g.Assert(c.Restore("cache.tar", "") == nil).IsTrue("failed to restore")
+			g.Assert(readFile("mount/a.txt")).Equal("full\n")
+
+			// The next delta rebuild starts a new chain
+			os.Chdir(filepath.Join(dir, "build"))
+			c.Rebuild([]string{"mount"}, "cache.tar")
+
+			idx, _ = readDelta(s, "cache.tar")
+			g.Assert(len(idx.Layers)).Equal(1)
+		})
+
+		g.It("Should discard a delta archive when the chain changed meanwhile", func() {
+			var m storage.Storage
+			m, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				// Another rebuild writes its index while this one uploads
+				if op == "put" && strings.HasPrefix(p, "cache.tar~delta-") {
+					idx, _ := readDelta(m, "cache.tar")
+					idx.Layers = append(idx.Layers, deltaLayer{Key: "cache.tar~delta-1"})
+					writeDelta(m, "cache.tar", idx)
+				}
+				return nil
+			}})
+			c := NewDefault(m, WithDelta(2))
+
+			c.Rebuild([]string{"mount"}, "cache.tar")
+			writeFile("mount/a.txt", "changed\n")
+
+			err := c.Rebuild([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+
+			idx, _ := readDelta(m, "cache.tar")
+			g.Assert(len(idx.Layers)).Equal(2)
+			g.Assert(idx.Layers[1].Key).Equal("cache.tar~delta-1")
+
+			files, _ := m.List("cache.tar~delta-")
+			g.Assert(len(files)).Equal(0)
+		})
+
+		g.It("Should not remove paths outside the working directory", func() {
+			c.Rebuild([]string{"mount"}, "cache.tar")
+			writeFile(filepath.Join(dir, "outside.txt"), "keep\n")
+
+			for _, p := range []string{"../outside.txt", "/tmp", "mount/../.."} {
+				idx, _ := readDelta(s, "cache.tar")
+				idx.Layers[0].Remove = []string{p}
+				writeDelta(s, "cache.tar", idx)
+
+				os.Chdir(filepath.Join(dir, "restore"))
+				_, err := c.restoreDelta("cache.tar", idx)
+				g.Assert(err != nil).IsTrue("failed to reject " + p)
+			}
+
+			g.Assert(readFile(filepath.Join(dir, "outside.txt"))).Equal("keep\n")
+		})
+	})
+}
+
+func writeFile(name, content string) {
+	ioutil.WriteFile(name, []byte(content), 0644)
+
+	// Make sure the change is visible with the second precision of archives
+	t := time.Now().Add(time.Duration(len(content)) * time.Second)
+	os.Chtimes(name, t, t)
+}
+
+func readFile(name string) string {
+	b, _ := ioutil.ReadFile(name)
+	return string(b)
+}
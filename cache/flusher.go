@@ -3,52 +3,164 @@ package cache
 import (
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/logger"
 	"github.com/drone/drone-cache-lib/storage"
 )
 
 // DirtyFunc defines when an cache item is outdated.
 type DirtyFunc func(storage.FileEntry) bool
 
+// MetadataDirtyFunc defines when an cache item is outdated based on its
+// entry and metadata. The metadata is nil if the item has none.
+type MetadataDirtyFunc func(storage.FileEntry, *Metadata) bool
+
 // Flusher defines an object to clear the cache.
 type Flusher struct {
-	store storage.Storage
-	dirty func(storage.FileEntry) bool
+	store   storage.Storage
+	dirty   MetadataDirtyFunc
+	meta    bool
+	collect bool
+	log     logger.Logger
+}
+
+// FlusherOption configures a Flusher.
+type FlusherOption func(*Flusher)
+
+// WithFlusherLogger sets the logger the flusher writes to.
+func WithFlusherLogger(l logger.Logger) FlusherOption {
+	return func(f *Flusher) {
+		f.log = l
+	}
+}
+
+// WithCollect makes Flush remove the data shared between cache items that
+// no item refers to anymore, like the chunks of the dedup storage. This
+// works on the whole storage, not only the flushed prefix.
+func WithCollect() FlusherOption {
+	return func(f *Flusher) {
+		f.collect = true
+	}
 }
 
 // NewFlusher creates a new cache flusher.
-func NewFlusher(s storage.Storage, fn DirtyFunc) Flusher {
-	return Flusher{store: s, dirty: fn}
+func NewFlusher(s storage.Storage, fn DirtyFunc, opts ...FlusherOption) Flusher {
+	return newFlusher(s, func(file storage.FileEntry, _ *Metadata) bool {
+		return fn(file)
+	}, false, opts)
+}
+
+// NewMetadataFlusher creates a new cache flusher that reads the metadata of
+// every cache item for fn.
+func NewMetadataFlusher(s storage.Storage, fn MetadataDirtyFunc, opts ...FlusherOption) Flusher {
+	return newFlusher(s, fn, true, opts)
+}
+
+func newFlusher(s storage.Storage, fn MetadataDirtyFunc, meta bool, opts []FlusherOption) Flusher {
+	f := Flusher{store: s, dirty: fn, meta: meta}
+
+	for _, opt := range opts {
+		opt(&f)
+	}
+
+	f.log = logger.OrDiscard(f.log)
+
+	return f
 }
 
 // NewDefaultFlusher creates a new cache flusher with default expire.
-func NewDefaultFlusher(s storage.Storage) Flusher {
-	return Flusher{store: s, dirty: IsExpired}
+func NewDefaultFlusher(s storage.Storage, opts ...FlusherOption) Flusher {
+	return NewFlusher(s, IsExpired, opts...)
 }
 
 // Flush cleans the cache if it's expired.
 func (f *Flusher) Flush(src string) error {
-	log.Infof("Cleaning files from %s", src)
+	f.log.Infof("Cleaning files from %s", src)
 
 	files, err := f.store.List(src)
 	if err != nil {
 		return err
 	}
 
+	// Split the sidecar objects from the cache items they belong to
+	var entries []storage.FileEntry
+	sidecars := make(map[string][]string)
+
 	for _, file := range files {
-		if f.dirty(file) {
+		// Remove archives of rebuilds that never moved them into place
+		if isTempKey(file.Path) {
+			if time.Since(file.LastModified) > tempExpiry {
+				if err := f.store.Delete(file.Path); err != nil {
+					f.log.Warnf("Failed to delete %s: %s", file.Path, err)
+				}
+			}
+
+			continue
+		}
+
+		if key, ok := sidecarKey(file.Path); ok {
+			sidecars[key] = append(sidecars[key], file.Path)
+			continue
+		}
+
+		entries = append(entries, file)
+	}
+
+	for _, file := range entries {
+		var meta *Metadata
+
+		for _, p := range sidecars[file.Path] {
+			switch {
+			case p == accessPath(file.Path):
+				if t, err := readAccess(f.store, file.Path); err == nil {
+					file.LastAccessed = t
+				}
+
+			case p == metadataPath(file.Path) && f.meta:
+				m, err := readMetadata(f.store, file.Path)
+				if err != nil {
+					f.log.Warnf("Failed to read metadata of %s: %s", file.Path, err)
+					continue
+				}
+
+				meta = &m
+			}
+		}
+
+		if f.dirty(file, meta) {
 			err := f.store.Delete(file.Path)
 			if err != nil {
 				return err
 			}
+
+			continue
+		}
+
+		delete(sidecars, file.Path)
+	}
+
+	// Remove sidecar objects whose cache item is gone, except the locks of
+	// items that are being written
+	for key, paths := range sidecars {
+		for _, p := range paths {
+			if p == lockPath(key) && !lockExpired(f.store, key, time.Now()) {
+				continue
+			}
+
+			if err := f.store.Delete(p); err != nil {
+				f.log.Warnf("Failed to delete %s of %s: %s", p, key, err)
+			}
 		}
 	}
 
-	return nil
+	if !f.collect {
+		return nil
+	}
+
+	return storage.Collect(f.store)
 }
 
 // IsExpired checks if the cache is expired.
 func IsExpired(file storage.FileEntry) bool {
-	// Check if older then 30 days
-	return file.LastModified.Before(time.Now().AddDate(0, 0, -30))
+	// Check if not used for 30 days
+	return file.LastUsed().Before(time.Now().AddDate(0, 0, -30))
 }
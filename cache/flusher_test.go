@@ -4,11 +4,15 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/dedup"
 	"github.com/drone/drone-cache-lib/storage/dummy"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/retry"
 	"github.com/franela/goblin"
 )
 
@@ -71,6 +75,71 @@ func TestFlusher(t *testing.T) {
 				checkFileExists("/tmp/fixtures/cleanup/proj1/newtest/archive.txt", g)
 			})
 		})
+
+		g.Describe("Memory storage", func() {
+			g.It("Should cleanup items written before the expiry", func() {
+				now := time.Now().AddDate(0, 0, -40)
+				s, err := memory.New(&memory.Options{Clock: func() time.Time { return now }})
+				g.Assert(err == nil).IsTrue("failed to create storage")
+
+				s.Put("proj1/oldtest/archive.tar", strings.NewReader("hello\ngo\n"))
+				now = time.Now()
+				s.Put("proj1/master/archive.tar", strings.NewReader("hello\ngo\n"))
+
+				f := NewDefaultFlusher(s)
+				err = f.Flush("proj1/")
+				g.Assert(err == nil).IsTrue("failed to flush")
+
+				files, _ := s.List("proj1/")
+				g.Assert(len(files)).Equal(1)
+				g.Assert(files[0].Path).Equal("proj1/master/archive.tar")
+			})
+
+			g.It("Should keep cache items named like sidecars of other items", func() {
+				s, _ := memory.New(nil)
+
+				s.Put("deps/Gemfile.lock", strings.NewReader("gems"))
+				s.Put("deps/Gemfile.lock~access", strings.NewReader(time.Now().UTC().Format(time.RFC3339Nano)))
+				s.Put("deps/gone.tar~meta", strings.NewReader("{}"))
+
+				f := NewFlusher(s, noFind)
+				g.Assert(f.Flush("deps/") == nil).IsTrue("failed to flush")
+
+				files, _ := s.List("deps/")
+				g.Assert(len(files)).Equal(2)
+				g.Assert(files[0].Path).Equal("deps/Gemfile.lock")
+				g.Assert(files[1].Path).Equal("deps/Gemfile.lock~access")
+			})
+
+			g.It("Should collect shared data behind wrappers", func() {
+				m, _ := memory.New(nil)
+				d, _ := dedup.New(m, &dedup.Options{GracePeriod: time.Nanosecond})
+				s, _ := retry.New(d, nil)
+
+				s.Put("proj1/oldtest/archive.tar", strings.NewReader("hello\ngo\n"))
+
+				f := NewFlusher(s, func(storage.FileEntry) bool { return true }, WithCollect())
+				err := f.Flush("proj1/")
+				g.Assert(err == nil).IsTrue("failed to flush")
+
+				files, _ := m.List("")
+				g.Assert(len(files)).Equal(0)
+			})
+
+			g.It("Should only collect shared data when asked to", func() {
+				m, _ := memory.New(nil)
+				s, _ := dedup.New(m, &dedup.Options{GracePeriod: time.Nanosecond})
+
+				s.Put("proj1/oldtest/archive.tar", strings.NewReader("hello\ngo\n"))
+
+				f := NewFlusher(s, func(storage.FileEntry) bool { return true })
+				err := f.Flush("proj1/")
+				g.Assert(err == nil).IsTrue("failed to flush")
+
+				files, _ := m.List("")
+				g.Assert(len(files)).Equal(1)
+			})
+		})
 	})
 }
 
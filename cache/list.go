@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// List returns the cache items stored below prefix. The sidecar and
+// temporary objects stored next to them are left out, and LastAccessed is
+// set for items with a recorded access time.
+func List(s storage.Storage, prefix string) ([]storage.FileEntry, error) {
+	files, err := s.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []storage.FileEntry
+	accessed := make(map[string]bool)
+
+	for _, file := range files {
+		if isTempKey(file.Path) {
+			continue
+		}
+
+		if key, ok := sidecarKey(file.Path); ok {
+			if file.Path == accessPath(key) {
+				accessed[key] = true
+			}
+
+			continue
+		}
+
+		items = append(items, file)
+	}
+
+	for i, file := range items {
+		if !accessed[file.Path] {
+			continue
+		}
+
+		if t, err := readAccess(s, file.Path); err == nil {
+			items[i].LastAccessed = t
+		}
+	}
+
+	return items, nil
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestList(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("List", func() {
+		g.It("Should list cache items with their access time", func() {
+			accessed := time.Now().Add(time.Hour).UTC()
+			s, _ := memory.New(nil)
+
+			s.Put("proj/cache.tar", strings.NewReader("cache"))
+			s.Put("proj/cache.tar~meta", strings.NewReader("{}"))
+			s.Put("proj/cache.tar~lock", strings.NewReader("{}"))
+			s.Put("proj/cache.tar~delta", strings.NewReader("{}"))
+			s.Put("proj/cache.tar~delta-1", strings.NewReader("delta"))
+			s.Put("proj/cache.tar~tmp-0123456789abcdef", strings.NewReader("uploading"))
+			s.Put("proj/other.tar", strings.NewReader("other"))
+			writeAccess(s, "proj/cache.tar", accessed)
+
+			files, err := List(s, "proj/")
+			g.Assert(err == nil).IsTrue("failed to list")
+			g.Assert(len(files)).Equal(2)
+			g.Assert(files[0].Path).Equal("proj/cache.tar")
+			g.Assert(files[0].LastAccessed.Equal(accessed)).IsTrue("failed to read the access time")
+			g.Assert(files[1].Path).Equal("proj/other.tar")
+			g.Assert(files[1].LastAccessed.IsZero()).IsTrue("unexpected access time")
+		})
+	})
+}
@@ -0,0 +1,266 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// LockPolicy decides what Rebuild does when another build holds the lock of
+// the cache key.
+type LockPolicy int
+
+const (
+	// LockSkip skips the rebuild and keeps the cache item the other build
+	// writes.
+	LockSkip LockPolicy = iota
+
+	// LockWait waits until the other build released the lock or the lock
+	// expired, then rebuilds.
+	LockWait
+)
+
+// DefaultLockTTL is the time after which the lock of a build that stopped
+// renewing it is considered stale.
+const DefaultLockTTL = 5 * time.Minute
+
+// DefaultLockPoll is the time between two attempts to take a held lock.
+const DefaultLockPoll = 5 * time.Second
+
+// lockSuffix is appended to a cache key to name its lease object.
+const lockSuffix = "~lock"
+
+// minLockRenew bounds how often a lease is renewed for very short TTLs.
+const minLockRenew = 10 * time.Millisecond
+
+// lease is the content of a lock object. The holder extends the expiry
+// while it rebuilds the cache item.
+type lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// leaseError is returned by readLease for a lease object that can't be
+// parsed.
+type leaseError struct {
+	key string
+	err error
+}
+
+func (e *leaseError) Error() string {
+	return fmt.Sprintf("invalid lease for %s: %s", e.key, e.err)
+}
+
+// isInvalidLease reports whether err is a *leaseError.
+func isInvalidLease(err error) bool {
+	_, ok := err.(*leaseError)
+	return ok
+}
+
+// lockPath returns the path of the lease object for the key.
+func lockPath(key string) string {
+	return key + lockSuffix
+}
+
+// readLease returns the lease of the key.
+func readLease(s storage.Storage, key string) (lease, error) {
+	var buf bytes.Buffer
+	var l lease
+
+	if err := s.Get(lockPath(key), &buf); err != nil {
+		return l, err
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &l); err != nil {
+		return l, &leaseError{key: key, err: err}
+	}
+
+	return l, nil
+}
+
+// encodeLease returns the content of the lease object.
+func encodeLease(l lease) *bytes.Reader {
+	b, _ := json.Marshal(l)
+	return bytes.NewReader(b)
+}
+
+// lockExpired reports whether the lease of the key is missing, invalid or
+// expired at now. A lease the storage failed to return is not.
+func lockExpired(s storage.Storage, key string, now time.Time) bool {
+	l, err := readLease(s, key)
+	if storage.IsNotFound(err) || isInvalidLease(err) {
+		return true
+	}
+
+	return err == nil && now.After(l.Expires)
+}
+
+// lockOwner returns a name identifying this process in leases.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return host + "-" + randomID()
+}
+
+// heldLock is a lease taken by this process, renewed in the background
+// until it is released. lost is set by renew once another build took the
+// lease over.
+type heldLock struct {
+	c     Cache
+	key   string
+	owner string
+	lost  bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// lock takes the lease of the key. It reports false without an error when
+// another build holds the lease and the policy is LockSkip. Expired and
+// invalid leases are deleted before they are taken over, so two builds
+// doing that at the same time may both take the lease. Only one of them
+// keeps it, the other one notices when renewing or releasing it. A lease
+// the storage failed to return is never taken over.
+func (c Cache) lock(key string) (*heldLock, bool, error) {
+	owner := lockOwner()
+	waiting := false
+
+	for {
+		err := storage.Create(c.s, lockPath(key), encodeLease(lease{
+			Owner:   owner,
+			Expires: c.now().Add(c.lockTTL),
+		}))
+
+		if err == nil {
+			c.log.Debugf("Acquired lock of %s as %s", key, owner)
+
+			l := &heldLock{
+				c:     c,
+				key:   key,
+				owner: owner,
+				stop:  make(chan struct{}),
+				done:  make(chan struct{}),
+			}
+
+			go l.renew()
+
+			return l, true, nil
+		}
+
+		if !storage.IsAlreadyExists(err) {
+			return nil, false, err
+		}
+
+		current, err := readLease(c.s, key)
+
+		switch {
+		case storage.IsNotFound(err):
+			// Released meanwhile
+			continue
+
+		case isInvalidLease(err):
+			c.log.Warnf("Replacing invalid lock of %s: %s", key, err)
+
+		case err != nil && c.lockPolicy == LockWait:
+			c.log.Warnf("Failed to read lock of %s, retrying: %s", key, err)
+
+			time.Sleep(c.lockPoll)
+			continue
+
+		case err != nil:
+			return nil, false, err
+
+		case c.now().After(current.Expires):
+			c.log.Infof("Taking over lock of %s held by %s, expired at %s", key, current.Owner, current.Expires)
+
+		case c.lockPolicy == LockSkip:
+			return nil, false, nil
+
+		default:
+			if !waiting {
+				c.log.Infof("Waiting for lock of %s held by %s", key, current.Owner)
+				waiting = true
+			}
+
+			time.Sleep(c.lockPoll)
+			continue
+		}
+
+		if err := c.s.Delete(lockPath(key)); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// renew extends the lease until the lock is released or another build took
+// it over.
+func (l *heldLock) renew() {
+	defer close(l.done)
+
+	interval := l.c.lockTTL / 3
+	if interval < minLockRenew {
+		interval = minLockRenew
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := readLease(l.c.s, l.key)
+		if err == nil && current.Owner != l.owner {
+			l.c.log.Warnf("Lost lock of %s to %s", l.key, current.Owner)
+			l.lost = true
+			return
+		}
+
+		err = l.c.s.Put(lockPath(l.key), encodeLease(lease{
+			Owner:   l.owner,
+			Expires: l.c.now().Add(l.c.lockTTL),
+		}))
+
+		if err != nil {
+			l.c.log.Warnf("Failed to renew lock of %s: %s", l.key, err)
+		}
+	}
+}
+
+// unlock stops renewing the lease and removes it, unless another build
+// took it over. It reports whether the lease was lost before it was
+// released.
+func (l *heldLock) unlock() bool {
+	close(l.stop)
+	<-l.done
+
+	current, err := readLease(l.c.s, l.key)
+
+	switch {
+	case l.lost:
+		return true
+
+	case storage.IsNotFound(err):
+		l.c.log.Warnf("Lost lock of %s, it was removed", l.key)
+		return true
+
+	case err != nil:
+		l.c.log.Warnf("Failed to read lock of %s before releasing it: %s", l.key, err)
+		return false
+
+	case current.Owner != l.owner:
+		l.c.log.Warnf("Lost lock of %s to %s", l.key, current.Owner)
+		return true
+	}
+
+	if err := l.c.s.Delete(lockPath(l.key)); err != nil {
+		l.c.log.Warnf("Failed to release lock of %s: %s", l.key, err)
+	}
+
+	return false
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestLock(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("rebuild lock", func() {
+		var (
+			dir string
+			s   storage.Storage
+			now time.Time
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "lock")
+			os.Chdir(dir)
+
+			os.Mkdir("mount", 0755)
+			ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+
+			now = time.Now()
+			s, _ = memory.New(nil)
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		hold := func(owner string, expires time.Time) {
+			s.Put(lockPath("cache.tar"), encodeLease(lease{Owner: owner, Expires: expires}))
+		}
+
+		g.It("Should release the lock after rebuilding", func() {
+			c := New(s, tar.New(), WithLock(LockSkip, time.Minute))
+
+			res, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+			g.Assert(res.Skipped).IsFalse()
+			g.Assert(res.LockLost).IsFalse()
+
+			ok, _ := storage.Exists(s, "cache.tar")
+			g.Assert(ok).IsTrue("failed to upload")
+
+			ok, _ = storage.Exists(s, lockPath("cache.tar"))
+			g.Assert(ok).IsFalse("failed to release lock")
+		})
+
+		g.It("Should skip while another build holds the lock", func() {
+			hold("other", now.Add(time.Minute))
+			c := New(s, tar.New(), WithLock(LockSkip, time.Minute))
+
+			res, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to skip")
+			g.Assert(res).Equal(Result{Key: "cache.tar", Skipped: true, Locked: true})
+
+			ok, _ := storage.Exists(s, "cache.tar")
+			g.Assert(ok).IsFalse("uploaded without lock")
+
+			l, _ := readLease(s, "cache.tar")
+			g.Assert(l.Owner).Equal("other")
+		})
+
+		g.It("Should take over an expired lock", func() {
+			hold("other", now.Add(-time.Second))
+			c := New(s, tar.New(), WithLock(LockSkip, time.Minute))
+
+			res, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+			g.Assert(res.Skipped).IsFalse()
+
+			ok, _ := storage.Exists(s, lockPath("cache.tar"))
+			g.Assert(ok).IsFalse("failed to release lock")
+		})
+
+		g.It("Should wait until the lock is released", func() {
+			hold("other", now.Add(time.Minute))
+			c := New(s, tar.New(), WithLock(LockWait, time.Minute))
+			c.lockPoll = 10 * time.Millisecond
+
+			done := make(chan Result)
+			go func() {
+				res, _ := c.RebuildResult([]string{"mount"}, "cache.tar")
+				done <- res
+			}()
+
+			select {
+			case <-done:
+				g.Fail("rebuilt while the lock was held")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			s.Delete(lockPath("cache.tar"))
+
+			res := <-done
+			g.Assert(res.Skipped).IsFalse()
+
+			ok, _ := storage.Exists(s, "cache.tar")
+			g.Assert(ok).IsTrue("failed to upload")
+		})
+
+		g.It("Should not release a lock taken over by another build", func() {
+			c := New(s, tar.New(), WithLock(LockSkip, time.Minute))
+
+			l, ok, err := c.lock("cache.tar")
+			g.Assert(err == nil && ok).IsTrue("failed to lock")
+
+			hold("other", now.Add(time.Minute))
+			g.Assert(l.unlock()).IsTrue("failed to report the lost lock")
+
+			current, _ := readLease(s, "cache.tar")
+			g.Assert(current.Owner).Equal("other")
+		})
+
+		g.It("Should report a lock taken over while rebuilding", func() {
+			s, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				if op == "put" && !strings.HasSuffix(p, lockSuffix) {
+					hold("other", now.Add(time.Minute))
+				}
+				return nil
+			}})
+			c := New(s, tar.New(), WithLock(LockSkip, time.Minute))
+
+			res, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+			g.Assert(res.LockLost).IsTrue("failed to report the lost lock")
+
+			current, _ := readLease(s, "cache.tar")
+			g.Assert(current.Owner).Equal("other")
+		})
+
+		g.It("Should keep active locks when flushing", func() {
+			s.Put("proj/active.tar~lock", encodeLease(lease{Owner: "other", Expires: now.Add(time.Minute)}))
+			s.Put("proj/stale.tar~lock", encodeLease(lease{Owner: "other", Expires: now.Add(-time.Minute)}))
+			s.Put("proj/broken.tar~lock", strings.NewReader("{"))
+
+			f := NewDefaultFlusher(s)
+			g.Assert(f.Flush("proj/") == nil).IsTrue("failed to flush")
+
+			files, _ := s.List("proj/")
+			g.Assert(len(files)).Equal(1)
+			g.Assert(files[0].Path).Equal("proj/active.tar~lock")
+		})
+
+		g.It("Should not take over a lock it failed to read", func() {
+			s, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				if op == "get" && p == lockPath("cache.tar") {
+					return errors.New("connection reset")
+				}
+				return nil
+			}})
+			hold("other", now.Add(-time.Second))
+			c := New(s, tar.New(), WithLock(LockSkip, time.Minute))
+
+			_, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsFalse("failed to return error")
+
+			ok, _ := storage.Exists(s, lockPath("cache.tar"))
+			g.Assert(ok).IsTrue("removed the lock")
+			ok, _ = storage.Exists(s, "cache.tar")
+			g.Assert(ok).IsFalse("uploaded without lock")
+		})
+
+		g.It("Should renew locks with a very short ttl", func() {
+			c := New(s, tar.New(), WithLock(LockSkip, time.Nanosecond))
+
+			res, err := c.RebuildResult([]string{"mount"}, "cache.tar")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+			g.Assert(res.Skipped).IsFalse()
+		})
+	})
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// metadataSuffix is appended to a cache key to name its metadata object.
+const metadataSuffix = "~meta"
+
+// Metadata describes how a cache item was built. It is written next to the
+// item by every rebuild.
+type Metadata struct {
+	// Key is the cache key.
+	Key string `json:"key"`
+
+	// Archive is the key of the archive the rebuild uploaded. It differs
+	// from Key for the delta archives in Layers.
+	Archive string `json:"archive"`
+
+	// CreatedAt is the time the rebuild started.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Build describes the build that wrote the item.
+	Build BuildInfo `json:"build"`
+
+	// Format is the archive format, for example "tar.gz".
+	Format string `json:"format,omitempty"`
+
+	// Size is the size of the archive in bytes.
+	Size int64 `json:"size"`
+
+	// UncompressedSize is the size of the uncompressed archive stream and
+	// Files the number of files in the archive. Both are zero if the
+	// archive doesn't report progress.
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+	Files            int   `json:"files,omitempty"`
+
+	// Sources are the paths packed into the archive.
+	Sources []string `json:"sources"`
+
+	// Digest is the SHA-256 digest of the archive, prefixed by "sha256:".
+	Digest string `json:"digest"`
+
+	// Layers describes the delta archives restored after the archive,
+	// oldest first. It is empty for items without delta archives.
+	Layers []Metadata `json:"layers,omitempty"`
+}
+
+// BuildInfo identifies the build that wrote a cache item.
+type BuildInfo struct {
+	Repo   string `json:"repo,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	Number int    `json:"number,omitempty"`
+	Link   string `json:"link,omitempty"`
+
+	// Tool names the program that wrote the cache item and its version.
+	Tool string `json:"tool,omitempty"`
+}
+
+// metadataPath returns the path of the metadata object for the key.
+func metadataPath(key string) string {
+	return key + metadataSuffix
+}
+
+// readMetadata returns the metadata of the key.
+func readMetadata(s storage.Storage, key string) (Metadata, error) {
+	var buf bytes.Buffer
+	var meta Metadata
+
+	if err := s.Get(metadataPath(key), &buf); err != nil {
+		return meta, err
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &meta); err != nil {
+		return meta, fmt.Errorf("invalid metadata for %s: %s", key, err)
+	}
+
+	return meta, nil
+}
+
+// writeMetadata stores the metadata of the key.
+func writeMetadata(s storage.Storage, key string, meta Metadata) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(metadataPath(key), bytes.NewReader(b))
+}
+
+// Metadata returns the metadata written by the last rebuild of the key. It
+// returns an error matching storage.IsNotFound if the key has none, for
+// example because it was written by an older version.
+func (c Cache) Metadata(key string) (Metadata, error) {
+	return readMetadata(c.s, key)
+}
+
+// describe stores the metadata of a rebuild of dst from the sources. The
+// metadata is informational, failing to write it doesn't fail the rebuild.
+func (c Cache) describe(dst string, srcs []string, started time.Time, meta Metadata) {
+	meta.Key = dst
+	meta.CreatedAt = started.UTC()
+	meta.Build = c.build
+	meta.Sources = srcs
+
+	if err := writeMetadata(c.s, dst, meta); err != nil {
+		c.log.Warnf("Failed to write metadata of %s: %s", dst, err)
+	}
+}
+
+// describeLayer adds the metadata of a delta archive of dst, packed from the
+// changed sources, to the layers of the item. The rest of the metadata keeps
+// describing the full archive.
+func (c Cache) describeLayer(dst string, srcs []string, started time.Time, layer Metadata) {
+	meta, err := readMetadata(c.s, dst)
+	if err != nil {
+		c.log.Warnf("Failed to read metadata of %s, not describing %s: %s", dst, layer.Archive, err)
+		return
+	}
+
+	layer.Key = dst
+	layer.CreatedAt = started.UTC()
+	layer.Build = c.build
+	layer.Sources = srcs
+
+	meta.Layers = append(meta.Layers, layer)
+
+	if err := writeMetadata(c.s, dst, meta); err != nil {
+		c.log.Warnf("Failed to write metadata of %s: %s", dst, err)
+	}
+}
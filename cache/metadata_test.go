@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestMetadata(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("metadata", func() {
+		var (
+			dir   string
+			s     storage.Storage
+			now   time.Time
+			build BuildInfo
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "metadata")
+			os.Chdir(dir)
+
+			os.Mkdir("mount", 0755)
+			ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+
+			now = time.Date(2020, 8, 5, 20, 23, 42, 0, time.UTC)
+			s, _ = memory.New(nil)
+			build = BuildInfo{Repo: "octocat/hello-world", Commit: "7fd1a60", Number: 42, Tool: "drone-cache 1.0.0"}
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should describe rebuilt cache items", func() {
+			c := New(s, tar.New(), WithBuildInfo(build), WithClock(func() time.Time { return now }))
+			g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			var buf bytes.Buffer
+			s.Get("cache.tar", &buf)
+			sum := sha256.Sum256(buf.Bytes())
+
+			meta, err := c.Metadata("cache.tar")
+			g.Assert(err == nil).IsTrue("failed to read metadata")
+			g.Assert(meta).Equal(Metadata{
+				Key:              "cache.tar",
+				Archive:          "cache.tar",
+				CreatedAt:        now,
+				Build:            build,
+				Format:           "tar",
+				Size:             2560,
+				UncompressedSize: 2560,
+				Files:            1,
+				Sources:          []string{"mount"},
+				Digest:           "sha256:" + hex.EncodeToString(sum[:]),
+			})
+		})
+
+		g.It("Should report missing metadata as not found", func() {
+			_, err := New(s, tar.New()).Metadata("cache.tar")
+			g.Assert(storage.IsNotFound(err)).IsTrue("failed to report missing metadata")
+		})
+
+		g.It("Should describe delta archives as layers", func() {
+			c := New(s, tar.New(), WithDelta(3), WithClock(func() time.Time { return now }))
+			g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			created := now
+			full, _ := c.Metadata("cache.tar")
+
+			ioutil.WriteFile("mount/other.txt", []byte("changed"), 0644)
+			now = now.Add(time.Minute)
+			g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			idx, _ := readDelta(s, "cache.tar")
+			meta, err := c.Metadata("cache.tar")
+			g.Assert(err == nil).IsTrue("failed to read metadata")
+			g.Assert(meta.Archive).Equal("cache.tar")
+			g.Assert(meta.Sources).Equal([]string{"mount"})
+			g.Assert(meta.Size).Equal(full.Size)
+			g.Assert(meta.Digest).Equal(full.Digest)
+			g.Assert(meta.CreatedAt).Equal(created)
+
+			g.Assert(len(meta.Layers)).Equal(1)
+			g.Assert(meta.Layers[0].Key).Equal("cache.tar")
+			g.Assert(meta.Layers[0].Archive).Equal(idx.Layers[1].Key)
+			g.Assert(meta.Layers[0].Sources).Equal([]string{"mount/other.txt"})
+			g.Assert(meta.Layers[0].CreatedAt).Equal(now)
+
+			// A full rebuild starts over
+			c = New(s, tar.New(), WithClock(func() time.Time { return now }))
+			g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			meta, _ = c.Metadata("cache.tar")
+			g.Assert(len(meta.Layers)).Equal(0)
+		})
+
+		g.It("Should pass metadata to the flusher", func() {
+			c := New(s, tar.New(), WithBuildInfo(build))
+			g.Assert(c.Rebuild([]string{"mount"}, "proj/old.tar") == nil).IsTrue("failed to rebuild")
+			g.Assert(c.Rebuild([]string{"mount"}, "proj/new.tar") == nil).IsTrue("failed to rebuild")
+			s.Put("proj/legacy.tar", strings.NewReader("legacy"))
+
+			seen := make(map[string]*Metadata)
+			f := NewMetadataFlusher(s, func(file storage.FileEntry, meta *Metadata) bool {
+				seen[file.Path] = meta
+				return file.Path == "proj/old.tar"
+			})
+			g.Assert(f.Flush("proj/") == nil).IsTrue("failed to flush")
+
+			g.Assert(len(seen)).Equal(3)
+			g.Assert(seen["proj/new.tar"].Build).Equal(build)
+			g.Assert(seen["proj/legacy.tar"] == nil).IsTrue("passed metadata of item without any")
+
+			_, err := c.Metadata("proj/old.tar")
+			g.Assert(storage.IsNotFound(err)).IsTrue("failed to delete metadata with the item")
+		})
+	})
+}
@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// DefaultParallelism is the number of mounts processed at the same time.
+const DefaultParallelism = 4
+
+// MountResult is the outcome of rebuilding or restoring a single mount.
+type MountResult struct {
+	// Mount is the source path.
+	Mount string
+
+	// Key is the cache key the mount was written to or restored from. It
+	// is the fallback key if the mount was restored from the fallback.
+	Key string
+
+	// Err is the error that stopped the mount, if any. Restoring a mount
+	// without a cache reports an error matching storage.IsNotFound.
+	Err error
+}
+
+// MountKey returns the key of a single mount derived from the base key. The
+// archive extension of the base key is kept, so a mount of "node_modules"
+// with the base key "repo/master/cache.tar" is stored below
+// "repo/master/cache/".
+func MountKey(base, mount string) string {
+	ext := path.Ext(base)
+	if strings.HasSuffix(base, ".tar.gz") {
+		ext = ".tar.gz"
+	}
+
+	clean := filepath.ToSlash(filepath.Clean(mount))
+	sum := sha256.Sum256([]byte(clean))
+
+	// Keep the name readable, the digest keeps it unique
+	name := strings.Trim(strings.Replace(clean, "/", "_", -1), "._")
+	if name == "" {
+		name = "root"
+	}
+
+	return strings.TrimSuffix(base, ext) + "/" + name + "-" + hex.EncodeToString(sum[:4]) + ext
+}
+
+// RebuildMounts rebuilds every mount into its own cache item, keyed by
+// MountKey, so a change to one mount doesn't upload the others again.
+func (c Cache) RebuildMounts(srcs []string, dst string) []MountResult {
+	return c.eachMount(srcs, func(mount string) (string, error) {
+		key := MountKey(dst, mount)
+		return key, c.Rebuild([]string{mount}, key)
+	})
+}
+
+// RestoreMounts restores every mount from its own cache item, keyed by
+// MountKey. A mount without a cache item under src is restored from its
+// cache item under fallback.
+func (c Cache) RestoreMounts(srcs []string, src string, fallback string) []MountResult {
+	return c.eachMount(srcs, func(mount string) (string, error) {
+		var fb string
+		if fallback != "" {
+			fb = MountKey(fallback, mount)
+		}
+
+		res, err := c.restoreFallback(MountKey(src, mount), fb)
+
+		switch {
+		case storage.IsNotFound(err):
+			c.log.Infof("No cache found for %s at %s", mount, res.Key)
+		case err != nil:
+			c.log.Warnf("Cache for %s could not be restored %s", mount, err)
+		}
+
+		return res.Key, err
+	})
+}
+
+// eachMount runs fn for every mount with the configured parallelism.
+func (c Cache) eachMount(srcs []string, fn func(mount string) (string, error)) []MountResult {
+	results := make([]MountResult, len(srcs))
+
+	n := c.parallelism
+	if n <= 0 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+
+	var wg sync.WaitGroup
+	for i, mount := range srcs {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, mount string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			key, err := fn(mount)
+			results[i] = MountResult{Mount: mount, Key: key, Err: err}
+		}(i, mount)
+	}
+
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestMounts(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("per mount caches", func() {
+		var (
+			dir string
+			s   storage.Storage
+			c   Cache
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "mounts")
+			os.MkdirAll(filepath.Join(dir, "build", "node_modules"), 0755)
+			os.MkdirAll(filepath.Join(dir, "build", "vendor"), 0755)
+			os.MkdirAll(filepath.Join(dir, "restore"), 0755)
+			os.Chdir(filepath.Join(dir, "build"))
+
+			ioutil.WriteFile("node_modules/a.js", []byte("a"), 0644)
+			ioutil.WriteFile("vendor/b.go", []byte("b"), 0644)
+
+			s, _ = memory.New(nil)
+			c = NewDefault(s, WithParallelism(2))
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.Describe("MountKey", func() {
+			g.It("Should derive keys from the base key", func() {
+				g.Assert(MountKey("repo/master/cache.tar", "node_modules")).Equal("repo/master/cache/node_modules-" + digest("node_modules") + ".tar")
+				g.Assert(MountKey("repo/master/cache.tar.gz", "a/b")).Equal("repo/master/cache/a_b-" + digest("a/b") + ".tar.gz")
+				g.Assert(MountKey("cache.tar", "a/b") != MountKey("cache.tar", "a_b")).IsTrue("keys collide")
+			})
+		})
+
+		g.It("Should rebuild and restore every mount on its own", func() {
+			results := c.RebuildMounts([]string{"node_modules", "vendor", "missing"}, "cache.tar")
+			g.Assert(len(results)).Equal(3)
+			g.Assert(results[0].Err == nil).IsTrue("failed to rebuild node_modules")
+			g.Assert(results[1].Err == nil).IsTrue("failed to rebuild vendor")
+			g.Assert(results[2].Err != nil).IsTrue("failed to report missing mount")
+
+			// Two archives and their metadata
+			files, _ := s.List("cache/")
+			g.Assert(len(files)).Equal(4)
+
+			os.Chdir(filepath.Join(dir, "restore"))
+			results = c.RestoreMounts([]string{"node_modules", "vendor", "missing"}, "feature.tar", "cache.tar")
+			g.Assert(results[0].Err == nil).IsTrue("failed to restore node_modules")
+			g.Assert(results[0].Key).Equal(MountKey("cache.tar", "node_modules"))
+			g.Assert(storage.IsNotFound(results[2].Err)).IsTrue("failed to report missing cache")
+
+			g.Assert(readFile("node_modules/a.js")).Equal("a")
+			g.Assert(readFile("vendor/b.go")).Equal("b")
+		})
+	})
+}
+
+func digest(mount string) string {
+	key := MountKey("x", mount)
+	return key[len(key)-8:]
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"time"
+)
+
+// tempSuffix is appended to a cache key, followed by a random id, to name
+// the object an archive is uploaded to before it is moved into place.
+const tempSuffix = "~tmp-"
+
+// tempExpiry is the time after its last modification a temporary object is
+// considered abandoned by the Flusher.
+const tempExpiry = time.Hour
+
+// tempPattern matches the temporary objects of cache keys.
+var tempPattern = regexp.MustCompile(`~tmp-[0-9a-f]{16}$`)
+
+// tempKey returns a new temporary object name for the key.
+func tempKey(key string) string {
+	return key + tempSuffix + randomID()
+}
+
+// isTempKey reports whether p is a temporary object.
+func isTempKey(p string) bool {
+	return tempPattern.MatchString(p)
+}
+
+// randomID returns 16 random hex digits.
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/retry"
+	"github.com/franela/goblin"
+)
+
+func TestPublish(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("publishing", func() {
+		var (
+			dir string
+			mu  sync.Mutex
+			ops []string
+			s   storage.Storage
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "publish")
+			os.Chdir(dir)
+
+			os.Mkdir("mount", 0755)
+			ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+
+			ops = nil
+			s, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				mu.Lock()
+				ops = append(ops, op+" "+p)
+				mu.Unlock()
+				return nil
+			}})
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should upload to a temporary key and rename it", func() {
+			g.Assert(NewDefault(s).Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			g.Assert(len(ops)).Equal(4)
+			g.Assert(ops[0]).Equal("get cache.tar~delta")
+			g.Assert(strings.HasPrefix(ops[1], "put cache.tar~tmp-")).IsTrue(ops[1])
+			g.Assert(isTempKey(strings.TrimPrefix(ops[1], "put "))).IsTrue(ops[1])
+			g.Assert(ops[2]).Equal("rename " + strings.TrimPrefix(ops[1], "put "))
+			g.Assert(ops[3]).Equal("put cache.tar~meta")
+
+			files, _ := s.List("")
+			g.Assert(len(files)).Equal(2)
+			g.Assert(files[0].Path).Equal("cache.tar")
+		})
+
+		g.It("Should delete the temporary key if it can't be renamed", func() {
+			s, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				if op == "rename" {
+					return errors.New("permission denied")
+				}
+				return nil
+			}})
+
+			g.Assert(NewDefault(s).Rebuild([]string{"mount"}, "cache.tar") != nil).IsTrue("failed to return error")
+
+			files, _ := s.List("")
+			g.Assert(len(files)).Equal(0)
+		})
+
+		g.It("Should upload directly to storages that can't rename", func() {
+			g.Assert(NewDefault(plainStorage{s}).Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			g.Assert(ops).Equal([]string{"get cache.tar~delta", "put cache.tar", "put cache.tar~meta"})
+		})
+
+		g.It("Should upload directly through wrappers of storages that can't rename", func() {
+			r, _ := retry.New(plainStorage{s}, nil)
+			g.Assert(NewDefault(r).Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+
+			g.Assert(ops).Equal([]string{"get cache.tar~delta", "put cache.tar", "put cache.tar~meta"})
+		})
+
+		g.It("Should flush abandoned temporary keys", func() {
+			now := time.Now().Add(-2 * time.Hour)
+			s, _ = memory.New(&memory.Options{Clock: func() time.Time { return now }})
+
+			s.Put("proj/cache.tar", strings.NewReader("cache"))
+			s.Put("proj/cache.tar~tmp-0123456789abcdef", strings.NewReader("abandoned"))
+			now = now.Add(2 * time.Hour)
+			s.Put("proj/cache.tar~tmp-fedcba9876543210", strings.NewReader("uploading"))
+
+			f := NewFlusher(s, func(storage.FileEntry) bool { return false })
+			g.Assert(f.Flush("proj/") == nil).IsTrue("failed to flush")
+
+			files, _ := s.List("proj/")
+			g.Assert(len(files)).Equal(2)
+			g.Assert(files[0].Path).Equal("proj/cache.tar")
+			g.Assert(files[1].Path).Equal("proj/cache.tar~tmp-fedcba9876543210")
+		})
+	})
+}
+
+// plainStorage hides the optional capabilities of a storage.
+type plainStorage struct {
+	storage.Storage
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sidecarPattern matches objects stored next to a cache item, named by
+// appending "~" and their kind to its key. The Flusher removes them together
+// with the item. Cache keys ending like a sidecar are rejected, so a cache
+// item is never taken for the sidecar of another one.
+var sidecarPattern = regexp.MustCompile(`^(.+)~(access|delta|delta-\d+|lock|meta)$`)
+
+// sidecarKey returns the cache key a sidecar object belongs to.
+func sidecarKey(p string) (string, bool) {
+	m := sidecarPattern.FindStringSubmatch(p)
+	if m == nil {
+		return "", false
+	}
+
+	return m[1], true
+}
+
+// checkKey returns an error if the cache key is named like a sidecar or
+// temporary object.
+func checkKey(key string) error {
+	if _, ok := sidecarKey(key); ok || isTempKey(key) {
+		return fmt.Errorf("cache key %s ends with a reserved suffix", key)
+	}
+
+	return nil
+}
+
+// ArchiveKey returns the cache key whose archive format the object p is
+// stored in: p itself for cache items, the key of the item for its delta
+// archives and temporary objects. It reports false for other sidecar
+// objects, which aren't archives.
+func ArchiveKey(p string) (string, bool) {
+	if isTempKey(p) {
+		return tempPattern.ReplaceAllString(p, ""), true
+	}
+
+	m := sidecarPattern.FindStringSubmatch(p)
+	if m == nil {
+		return p, true
+	}
+
+	if strings.HasPrefix(m[2], "delta-") {
+		return m[1], true
+	}
+
+	return "", false
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/filesystem"
+)
+
+// backends open a storage from a URL, by scheme.
+var backends = map[string]func(u *url.URL, log logger.Logger) (storage.Storage, error){
+	"file": openFile,
+}
+
+// openStorage opens the storage the URL points to.
+func openStorage(raw string, log logger.Logger) (storage.Storage, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("no storage set, use -storage or $%s", storageEnv)
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	open, ok := backends[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported storage %s", raw)
+	}
+
+	return open(u, log)
+}
+
+// openFile opens a directory of the local filesystem, for example
+// file:///mnt/cache.
+func openFile(u *url.URL, log logger.Logger) (storage.Storage, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, fmt.Errorf("unsupported host %s in %s", u.Host, u)
+	}
+
+	if u.Path == "" {
+		return nil, fmt.Errorf("no directory in %s", u)
+	}
+
+	return filesystem.New(&filesystem.Options{
+		Root:   filepath.FromSlash(u.Path),
+		Logger: log,
+	})
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/drone/drone-cache-lib/archive/util"
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/drone/drone-cache-lib/progress"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+func runRebuild(ctx *cli, args []string) error {
+	skip := ctx.flags.Bool("skip-existing", false, "keep an existing cache item")
+
+	args, err := ctx.parse(args, 2, -1)
+	if err != nil {
+		return err
+	}
+
+	var opts []cache.Option
+	if *skip {
+		opts = append(opts, cache.WithSkipExisting())
+	}
+
+	c, err := ctx.cache(args[0], opts...)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.RebuildResult(args[1:], args[0])
+	if err != nil {
+		return err
+	}
+
+	if res.Skipped {
+		fmt.Fprintf(ctx.out, "Kept %s\n", res.Key)
+		return nil
+	}
+
+	fmt.Fprintf(ctx.out, "Rebuilt %s (%s)\n", res.Key, progress.FormatBytes(res.Size))
+	return nil
+}
+
+func runRestore(ctx *cli, args []string) error {
+	fallback := ctx.flags.String("fallback", "", "cache item restored if KEY has none")
+
+	args, err := ctx.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	c, err := ctx.cache(args[0])
+	if err != nil {
+		return err
+	}
+
+	res, err := c.RestoreResult(args[0], *fallback)
+	if err != nil {
+		return err
+	}
+
+	if !res.Hit {
+		return fmt.Errorf("no cache found at %s", res.Key)
+	}
+
+	fmt.Fprintf(ctx.out, "Restored %s (%s)\n", res.Key, progress.FormatBytes(res.Size))
+	return nil
+}
+
+func runList(ctx *cli, args []string) error {
+	args, err := ctx.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	s, err := ctx.open()
+	if err != nil {
+		return err
+	}
+
+	var prefix string
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+
+	files, err := cache.List(s, prefix)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	now := time.Now()
+	w := tabwriter.NewWriter(ctx.out, 0, 4, 2, ' ', tabwriter.AlignRight)
+
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%s\t %s\n", progress.FormatBytes(file.Size), formatAge(now.Sub(file.LastUsed())), file.Path)
+	}
+
+	return w.Flush()
+}
+
+func runInspect(ctx *cli, args []string) error {
+	args, err := ctx.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	s, err := ctx.open()
+	if err != nil {
+		return err
+	}
+
+	key := args[0]
+
+	// Delta archives are written in the format of their cache item
+	item, ok := cache.ArchiveKey(key)
+	if !ok {
+		return fmt.Errorf("%s is not an archive", key)
+	}
+
+	if _, err := util.FromFilename(item); err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(s.Get(key, writer))
+	}()
+
+	defer reader.Close()
+
+	var r io.Reader = reader
+	if !strings.HasSuffix(item, ".tar") {
+		gr, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	w := tabwriter.NewWriter(ctx.out, 0, 4, 2, ' ', 0)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := header.Name
+		if header.Typeflag == tar.TypeSymlink {
+			name += " -> " + header.Linkname
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", header.FileInfo().Mode(), header.Size, header.ModTime.UTC().Format(time.RFC3339), name)
+	}
+
+	return w.Flush()
+}
+
+func runFlush(ctx *cli, args []string) error {
+	age := ctx.flags.Int("age", 30, "days a cache item is kept after it was last used")
+	dryRun := ctx.flags.Bool("dry-run", false, "only print what would be removed")
+
+	args, err := ctx.parse(args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	if *age <= 0 {
+		return fmt.Errorf("invalid age: %d", *age)
+	}
+
+	s, err := ctx.open()
+	if err != nil {
+		return err
+	}
+
+	s = &flushStorage{Storage: s, out: ctx.out, dryRun: *dryRun}
+
+	opts := []cache.FlusherOption{cache.WithFlusherLogger(ctx.log)}
+	if !*dryRun {
+		opts = append(opts, cache.WithCollect())
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -*age)
+
+	f := cache.NewFlusher(s, func(file storage.FileEntry) bool {
+		return file.LastUsed().Before(cutoff)
+	}, opts...)
+
+	return f.Flush(args[0])
+}
+
+func runRemove(ctx *cli, args []string) error {
+	args, err := ctx.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	s, err := ctx.open()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range args {
+		ok, err := storage.Exists(s, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			fmt.Fprintf(ctx.out, "Nothing stored at %s\n", key)
+			continue
+		}
+
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(ctx.out, "Removed %s\n", key)
+	}
+
+	return nil
+}
+
+func runCopy(ctx *cli, args []string) error {
+	to := ctx.flags.String("to", "", "storage URL to copy to, defaults to the source storage")
+
+	args, err := ctx.parse(args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	src, dst := args[0], args[0]
+	if len(args) > 1 {
+		dst = args[1]
+	}
+
+	if *to == "" && src == dst {
+		return errors.New("copy to the same key needs another storage, use -to")
+	}
+
+	from, err := ctx.open()
+	if err != nil {
+		return err
+	}
+
+	into := from
+	if *to != "" {
+		if into, err = openStorage(*to, ctx.log); err != nil {
+			return err
+		}
+	}
+
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(from.Get(src, writer))
+	}()
+
+	t := progress.NewTracker(nil, progress.Upload, 0)
+
+	err = into.Put(dst, t.Reader(reader))
+	reader.CloseWithError(err)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(ctx.out, "Copied %s to %s (%s)\n", src, dst, progress.FormatBytes(t.Event().BytesRead))
+	return nil
+}
+
+// flushStorage prints the files the Flusher deletes, and only prints them
+// in a dry run.
+type flushStorage struct {
+	storage.Storage
+	out    io.Writer
+	dryRun bool
+}
+
+func (s *flushStorage) Delete(p string) error {
+	if s.dryRun {
+		fmt.Fprintf(s.out, "Would remove %s\n", p)
+		return nil
+	}
+
+	if err := s.Storage.Delete(p); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(s.out, "Removed %s\n", p)
+	return nil
+}
+
+// Unwrap returns the storage the files are deleted from, so the Flusher
+// collects shared data in it.
+func (s *flushStorage) Unwrap() storage.Storage {
+	return s.Storage
+}
+
+// formatAge formats a duration in its two largest units, for example
+// "3d4h".
+func formatAge(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	minutes := int(d/time.Minute) % 60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("%dm", minutes)
+	}
+
+	return fmt.Sprintf("%ds", int(d/time.Second))
+}
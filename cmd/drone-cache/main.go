@@ -0,0 +1,150 @@
+// Command drone-cache manages cache items with the semantics of the cache
+// library, for example to look into or clean up a cache bucket.
+//
+// Usage:
+//
+//	drone-cache <command> [flags] [arguments]
+//
+// The storage is selected by URL with the -storage flag or the
+// DRONE_CACHE_STORAGE environment variable, for example file:///mnt/cache.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/drone/drone-cache-lib/archive/util"
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/progress"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// storageEnv is the environment variable holding the default storage URL.
+const storageEnv = "DRONE_CACHE_STORAGE"
+
+// command is a subcommand of the tool.
+type command struct {
+	usage string
+	help  string
+	run   func(ctx *cli, args []string) error
+}
+
+var commands = map[string]command{
+	"rebuild": {"[-skip-existing] KEY PATH...", "Pack the paths and store them as the cache item KEY", runRebuild},
+	"restore": {"[-fallback KEY] KEY", "Restore the cache item KEY into the working directory", runRestore},
+	"ls":      {"[PREFIX]", "List the cache items with their sizes and the time since their last use", runList},
+	"inspect": {"KEY", "List the contents of the archive stored as KEY", runInspect},
+	"flush":   {"[-age DAYS] [-dry-run] PREFIX", "Remove cache items not used within the age and unused shared data", runFlush},
+	"rm":      {"KEY...", "Remove stored files", runRemove},
+	"cp":      {"[-to URL] SRC [DST]", "Copy a stored file, to another storage with -to", runCopy},
+}
+
+// cli is passed to every command.
+type cli struct {
+	flags   *flag.FlagSet
+	storage *string
+	out     io.Writer
+	log     logger.Logger
+}
+
+func main() {
+	l := logrus.New()
+	l.SetOutput(os.Stderr)
+
+	if err := run(os.Args[1:], os.Stdout, logger.NewLogrus(l)); err != nil {
+		fmt.Fprintf(os.Stderr, "drone-cache: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command named by the first argument.
+func run(args []string, out io.Writer, log logger.Logger) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		usage(out)
+		return nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(out)
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: drone-cache %s [-storage URL] %s\n\n%s.\n", args[0], cmd.usage, cmd.help)
+	}
+
+	ctx := &cli{
+		flags:   flags,
+		storage: flags.String("storage", os.Getenv(storageEnv), "storage URL, for example file:///mnt/cache"),
+		out:     out,
+		log:     log,
+	}
+
+	return cmd.run(ctx, args[1:])
+}
+
+// parse parses the flags of the command and checks the number of
+// arguments. A negative max allows any number.
+func (ctx *cli) parse(args []string, min, max int) ([]string, error) {
+	if err := ctx.flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	rest := ctx.flags.Args()
+	if len(rest) < min || (max >= 0 && len(rest) > max) {
+		ctx.flags.Usage()
+		return nil, fmt.Errorf("wrong number of arguments for %s", ctx.flags.Name())
+	}
+
+	return rest, nil
+}
+
+// open opens the storage selected by the -storage flag.
+func (ctx *cli) open() (storage.Storage, error) {
+	return openStorage(*ctx.storage, ctx.log)
+}
+
+// cache creates a cache on the storage, with the archive format selected
+// by the extension of the key.
+func (ctx *cli) cache(key string, opts ...cache.Option) (cache.Cache, error) {
+	s, err := ctx.open()
+	if err != nil {
+		return cache.Cache{}, err
+	}
+
+	a, err := util.FromFilename(key)
+	if err != nil {
+		return cache.Cache{}, err
+	}
+
+	opts = append([]cache.Option{
+		cache.WithLogger(ctx.log),
+		cache.WithProgress(progress.NewLogger(ctx.log, 0)),
+	}, opts...)
+
+	return cache.New(s, a, opts...), nil
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintf(out, "Usage: drone-cache <command> [-storage URL] [flags] [arguments]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-8s %s\n", name, commands[name].help)
+	}
+
+	fmt.Fprintf(out, "\nThe storage defaults to $%s.\n", storageEnv)
+}
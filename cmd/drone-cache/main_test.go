@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/franela/goblin"
+)
+
+func TestCommands(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("drone-cache", func() {
+		var (
+			dir   string
+			store string
+		)
+
+		exec := func(args ...string) (string, error) {
+			var buf bytes.Buffer
+			err := run(args, &buf, logger.Discard)
+			return buf.String(), err
+		}
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "drone-cache")
+			store = "file://" + filepath.ToSlash(filepath.Join(dir, "store"))
+
+			os.MkdirAll(filepath.Join(dir, "work", "vendor"), 0755)
+			ioutil.WriteFile(filepath.Join(dir, "work", "vendor", "file.txt"), []byte("cached"), 0644)
+			os.Chdir(filepath.Join(dir, "work"))
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should rebuild, list, inspect and restore a cache item", func() {
+			out, err := exec("rebuild", "-storage", store, "repo/cache.tar", "vendor")
+			g.Assert(err == nil).IsTrue("failed to rebuild")
+			g.Assert(out).Equal("Rebuilt repo/cache.tar (2.5 KiB)\n")
+
+			out, err = exec("ls", "-storage", store, "repo/")
+			g.Assert(err == nil).IsTrue("failed to list")
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			g.Assert(len(lines)).Equal(1)
+			g.Assert(strings.HasSuffix(lines[0], " repo/cache.tar")).IsTrue(lines[0])
+			g.Assert(strings.Contains(lines[0], "2.5 KiB")).IsTrue(lines[0])
+
+			out, err = exec("inspect", "-storage", store, "repo/cache.tar")
+			g.Assert(err == nil).IsTrue("failed to inspect")
+			g.Assert(strings.Contains(out, "vendor/file.txt")).IsTrue(out)
+
+			exec("cp", "-storage", store, "repo/cache.tar", "repo/cache.tar~delta-1")
+
+			out, err = exec("inspect", "-storage", store, "repo/cache.tar~delta-1")
+			g.Assert(err == nil).IsTrue("failed to inspect a delta archive")
+			g.Assert(strings.Contains(out, "vendor/file.txt")).IsTrue(out)
+
+			_, err = exec("inspect", "-storage", store, "repo/cache.tar~meta")
+			g.Assert(err != nil).IsTrue("inspected the metadata")
+
+			os.RemoveAll("vendor")
+
+			out, err = exec("restore", "-storage", store, "repo/cache.tar")
+			g.Assert(err == nil).IsTrue("failed to restore")
+			g.Assert(out).Equal("Restored repo/cache.tar (2.5 KiB)\n")
+
+			b, _ := ioutil.ReadFile("vendor/file.txt")
+			g.Assert(string(b)).Equal("cached")
+		})
+
+		g.It("Should fail to restore a missing cache item", func() {
+			_, err := exec("restore", "-storage", store, "missing.tar")
+			g.Assert(err.Error()).Equal("no cache found at missing.tar")
+		})
+
+		g.It("Should copy between storages", func() {
+			exec("rebuild", "-storage", store, "cache.tar", "vendor")
+
+			other := "file://" + filepath.ToSlash(filepath.Join(dir, "other"))
+			out, err := exec("cp", "-storage", store, "-to", other, "cache.tar", "copy.tar")
+			g.Assert(err == nil).IsTrue("failed to copy")
+			g.Assert(out).Equal("Copied cache.tar to copy.tar (2.5 KiB)\n")
+
+			_, err = os.Stat(filepath.Join(dir, "other", "copy.tar"))
+			g.Assert(err == nil).IsTrue("failed to write the copy")
+
+			_, err = exec("cp", "-storage", store, "cache.tar")
+			g.Assert(err != nil).IsTrue("copied a file onto itself")
+		})
+
+		g.It("Should flush unused cache items", func() {
+			exec("rebuild", "-storage", store, "repo/old.tar", "vendor")
+			exec("rebuild", "-storage", store, "repo/new.tar", "vendor")
+
+			old := time.Now().AddDate(0, 0, -10)
+			os.Chtimes(filepath.Join(dir, "store", "repo", "old.tar"), old, old)
+
+			out, err := exec("flush", "-storage", store, "-age", "7", "-dry-run", "repo/")
+			g.Assert(err == nil).IsTrue("failed to flush")
+			g.Assert(out).Equal("Would remove repo/old.tar\nWould remove repo/old.tar~meta\n")
+
+			_, err = os.Stat(filepath.Join(dir, "store", "repo", "old.tar"))
+			g.Assert(err == nil).IsTrue("removed in a dry run")
+
+			out, err = exec("flush", "-storage", store, "-age", "7", "repo/")
+			g.Assert(err == nil).IsTrue("failed to flush")
+			g.Assert(out).Equal("Removed repo/old.tar\nRemoved repo/old.tar~meta\n")
+		})
+
+		g.It("Should remove stored files", func() {
+			exec("rebuild", "-storage", store, "cache.tar", "vendor")
+
+			out, err := exec("rm", "-storage", store, "cache.tar", "cache.tar~meta", "missing.tar")
+			g.Assert(err == nil).IsTrue("failed to remove")
+			g.Assert(out).Equal("Removed cache.tar\nRemoved cache.tar~meta\nNothing stored at missing.tar\n")
+
+			out, _ = exec("ls", "-storage", store)
+			g.Assert(out).Equal("")
+		})
+
+		g.It("Should not remove files outside the storage", func() {
+			ioutil.WriteFile(filepath.Join(dir, "outside.tar"), []byte("outside"), 0644)
+
+			_, err := exec("rm", "-storage", store, "../outside.tar")
+			g.Assert(err != nil).IsTrue("failed to reject the key")
+
+			_, err = os.Stat(filepath.Join(dir, "outside.tar"))
+			g.Assert(err == nil).IsTrue("removed a file outside the storage")
+		})
+
+		g.It("Should reject unknown commands and storages", func() {
+			_, err := exec("mv")
+			g.Assert(err.Error()).Equal("unknown command mv")
+
+			_, err = exec("ls", "-storage", "ftp://example.com/cache")
+			g.Assert(err.Error()).Equal("unsupported storage ftp://example.com/cache")
+
+			os.Setenv(storageEnv, "")
+			_, err = exec("ls")
+			g.Assert(err.Error()).Equal("no storage set, use -storage or $DRONE_CACHE_STORAGE")
+		})
+	})
+}
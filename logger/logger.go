@@ -0,0 +1,41 @@
+package logger
+
+// Fields are structured data attached to log messages.
+type Fields map[string]interface{}
+
+// Logger is the interface the library writes log messages to.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+
+	// WithFields returns a logger that attaches the fields to every
+	// message.
+	WithFields(fields Fields) Logger
+}
+
+// Discard is a Logger that drops every message. It is used when no logger
+// is configured, so the library is silent by default.
+var Discard Logger = discard{}
+
+// OrDiscard returns l, or Discard if l is nil.
+func OrDiscard(l Logger) Logger {
+	if l == nil {
+		return Discard
+	}
+
+	return l
+}
+
+type discard struct{}
+
+func (discard) Debugf(string, ...interface{}) {}
+func (discard) Infof(string, ...interface{})  {}
+func (discard) Warnf(string, ...interface{})  {}
+func (discard) Errorf(string, ...interface{}) {}
+
+func (d discard) WithFields(Fields) Logger {
+	return d
+}
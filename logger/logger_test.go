@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogger(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("OrDiscard", func() {
+		g.It("Should default to Discard", func() {
+			g.Assert(OrDiscard(nil) == Discard).IsTrue()
+			g.Assert(Discard.WithFields(Fields{"key": "value"}) == Discard).IsTrue()
+		})
+
+		g.It("Should keep a configured logger", func() {
+			l := NewLogrus(logrus.New())
+			g.Assert(OrDiscard(l) == l).IsTrue()
+		})
+	})
+
+	g.Describe("NewLogrus", func() {
+		g.It("Should write messages with fields", func() {
+			var buf bytes.Buffer
+			out := logrus.New()
+			out.SetOutput(&buf)
+
+			l := NewLogrus(out).WithFields(Fields{"key": "cache.tar"})
+			l.Debugf("hidden")
+			l.Warnf("Failed to read %s", "index")
+
+			line := strings.TrimSpace(buf.String())
+			g.Assert(strings.Contains(line, "level=warning")).IsTrue(line)
+			g.Assert(strings.Contains(line, `msg="Failed to read index"`)).IsTrue(line)
+			g.Assert(strings.Contains(line, "key=cache.tar")).IsTrue(line)
+			g.Assert(strings.Contains(line, "hidden")).IsFalse(line)
+		})
+	})
+}
@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrus creates a Logger writing to l, for example
+// logrus.StandardLogger().
+func NewLogrus(l logrus.FieldLogger) Logger {
+	return logrusLogger{l: l}
+}
+
+func (l logrusLogger) Debugf(format string, args ...interface{}) {
+	l.l.Debugf(format, args...)
+}
+
+func (l logrusLogger) Infof(format string, args ...interface{}) {
+	l.l.Infof(format, args...)
+}
+
+func (l logrusLogger) Warnf(format string, args ...interface{}) {
+	l.l.Warnf(format, args...)
+}
+
+func (l logrusLogger) Errorf(format string, args ...interface{}) {
+	l.l.Errorf(format, args...)
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l: l.l.WithFields(logrus.Fields(fields))}
+}
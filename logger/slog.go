@@ -0,0 +1,61 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog creates a Logger writing to l, for example slog.Default(). Fields
+// become attributes of the records.
+func NewSlog(l *slog.Logger) Logger {
+	return slogLogger{l: l}
+}
+
+func (l slogLogger) Debugf(format string, args ...interface{}) {
+	l.log(slog.LevelDebug, format, args)
+}
+
+func (l slogLogger) Infof(format string, args ...interface{}) {
+	l.log(slog.LevelInfo, format, args)
+}
+
+func (l slogLogger) Warnf(format string, args ...interface{}) {
+	l.log(slog.LevelWarn, format, args)
+}
+
+func (l slogLogger) Errorf(format string, args ...interface{}) {
+	l.log(slog.LevelError, format, args)
+}
+
+func (l slogLogger) WithFields(fields Fields) Logger {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]interface{}, 0, len(fields))
+	for _, k := range keys {
+		attrs = append(attrs, slog.Any(k, fields[k]))
+	}
+
+	return slogLogger{l: l.l.With(attrs...)}
+}
+
+// log formats the message only if the level is enabled.
+func (l slogLogger) log(level slog.Level, format string, args []interface{}) {
+	ctx := context.Background()
+
+	if l.l.Enabled(ctx, level) {
+		l.l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
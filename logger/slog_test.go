@@ -0,0 +1,33 @@
+//go:build go1.21
+// +build go1.21
+
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/franela/goblin"
+)
+
+func TestSlog(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("NewSlog", func() {
+		g.It("Should write messages with attributes", func() {
+			var buf bytes.Buffer
+			out := slog.New(slog.NewTextHandler(&buf, nil))
+
+			l := NewSlog(out).WithFields(Fields{"key": "cache.tar", "attempt": 2})
+			l.Debugf("hidden")
+			l.Infof("Restoring %s", "cache.tar")
+
+			line := strings.TrimSpace(buf.String())
+			g.Assert(strings.Contains(line, "level=INFO")).IsTrue(line)
+			g.Assert(strings.Contains(line, `msg="Restoring cache.tar" attempt=2 key=cache.tar`)).IsTrue(line)
+			g.Assert(strings.Contains(line, "hidden")).IsFalse(line)
+		})
+	})
+}
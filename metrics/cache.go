@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/drone/drone-cache-lib/cache"
+)
+
+// Cache wraps a cache.Cache and records the result, duration and archive
+// size of every rebuild and restore.
+type Cache struct {
+	c cache.Cache
+	m Metrics
+}
+
+// NewCache creates a Cache recording the rebuilds and restores of c to m.
+func NewCache(c cache.Cache, m Metrics) *Cache {
+	return &Cache{
+		c: c,
+		m: m,
+	}
+}
+
+// Rebuild rebuilds the cache like cache.Cache.Rebuild.
+func (c *Cache) Rebuild(srcs []string, dst string) error {
+	start := time.Now()
+	res, err := c.c.RebuildResult(srcs, dst)
+
+	result := "success"
+	switch {
+	case err != nil:
+		result = "error"
+	case res.Skipped:
+		result = "skipped"
+	}
+
+	c.m.Counter(Rebuilds, Labels{"result": result}, 1)
+	c.m.Histogram(RebuildDuration, Labels{}, time.Since(start).Seconds())
+
+	if err == nil && !res.Skipped {
+		c.m.Histogram(ArchiveSize, Labels{"operation": "rebuild"}, float64(res.Size))
+	}
+
+	return err
+}
+
+// Restore restores the cache like cache.Cache.Restore. Like it, it logs
+// errors instead of returning them.
+func (c *Cache) Restore(src string, fallback string) error {
+	start := time.Now()
+	res, err := c.c.RestoreResult(src, fallback)
+
+	result := "miss"
+	switch {
+	case err != nil:
+		result = "error"
+	case res.Hit && res.Fallback:
+		result = "fallback"
+	case res.Hit:
+		result = "hit"
+	}
+
+	c.m.Counter(Restores, Labels{"result": result}, 1)
+	c.m.Histogram(RestoreDuration, Labels{}, time.Since(start).Seconds())
+
+	if res.Hit {
+		c.m.Histogram(ArchiveSize, Labels{"operation": "restore"}, float64(res.Size))
+	}
+
+	switch {
+	case err != nil:
+		c.c.Logger().Warnf("Cache could not be restored %s", err)
+	case !res.Hit:
+		c.c.Logger().Infof("No cache found at %s", res.Key)
+	}
+
+	return nil
+}
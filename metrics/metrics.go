@@ -0,0 +1,47 @@
+package metrics
+
+// Names of the metrics recorded by the storage and cache middleware.
+const (
+	// StorageOperations counts storage operations by operation and result,
+	// which is "success", "not_found", "exists" or "error".
+	StorageOperations = "drone_cache_storage_operations_total"
+
+	// StorageDuration observes the duration of storage operations in
+	// seconds, by operation.
+	StorageDuration = "drone_cache_storage_duration_seconds"
+
+	// StorageBytes counts the bytes transferred by Get and Put, by
+	// operation.
+	StorageBytes = "drone_cache_storage_bytes_total"
+
+	// Restores counts restores by result, which is "hit", "fallback",
+	// "miss" or "error".
+	Restores = "drone_cache_restores_total"
+
+	// RestoreDuration observes the duration of restores in seconds.
+	RestoreDuration = "drone_cache_restore_duration_seconds"
+
+	// Rebuilds counts rebuilds by result, which is "success", "skipped" or
+	// "error".
+	Rebuilds = "drone_cache_rebuilds_total"
+
+	// RebuildDuration observes the duration of rebuilds in seconds.
+	RebuildDuration = "drone_cache_rebuild_duration_seconds"
+
+	// ArchiveSize observes the size of uploaded and downloaded archives in
+	// bytes, by operation, which is "rebuild" or "restore".
+	ArchiveSize = "drone_cache_archive_size_bytes"
+)
+
+// Labels are the dimensions of a measurement.
+type Labels map[string]string
+
+// Metrics records measurements. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	// Counter adds value to the counter.
+	Counter(name string, labels Labels, value float64)
+
+	// Histogram adds an observation of value to the histogram.
+	Histogram(name string, labels Labels, value float64)
+}
@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+// recorder keeps the sum of every counter and the number of observations
+// of every histogram by name and labels.
+type recorder struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newRecorder() *recorder {
+	return &recorder{values: make(map[string]float64)}
+}
+
+func (r *recorder) Counter(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[key(name, labels)] += value
+}
+
+func (r *recorder) Histogram(name string, labels Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[key(name, labels)]++
+}
+
+func (r *recorder) get(name string, labels Labels) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.values[key(name, labels)]
+}
+
+func key(name string, labels Labels) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(pairs)
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func TestMetrics(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("NewStorage", func() {
+		g.It("Should record operations, results and bytes", func() {
+			m, _ := memory.New(nil)
+			r := newRecorder()
+			s := NewStorage(m, r)
+
+			s.Put("cache.tar", strings.NewReader("hello"))
+			s.Get("cache.tar", ioutil.Discard)
+			s.Get("missing.tar", ioutil.Discard)
+			s.List("")
+			s.Delete("cache.tar")
+
+			g.Assert(r.get(StorageOperations, Labels{"operation": "put", "result": "success"})).Equal(1.0)
+			g.Assert(r.get(StorageOperations, Labels{"operation": "get", "result": "success"})).Equal(1.0)
+			g.Assert(r.get(StorageOperations, Labels{"operation": "get", "result": "not_found"})).Equal(1.0)
+			g.Assert(r.get(StorageOperations, Labels{"operation": "list", "result": "success"})).Equal(1.0)
+			g.Assert(r.get(StorageOperations, Labels{"operation": "delete", "result": "success"})).Equal(1.0)
+			g.Assert(r.get(StorageDuration, Labels{"operation": "get"})).Equal(2.0)
+			g.Assert(r.get(StorageBytes, Labels{"operation": "put"})).Equal(5.0)
+			g.Assert(r.get(StorageBytes, Labels{"operation": "get"})).Equal(5.0)
+		})
+
+		g.It("Should record errors", func() {
+			m, _ := memory.New(&memory.Options{Fail: func(op, p string) error {
+				return errors.New("connection reset")
+			}})
+			r := newRecorder()
+
+			storage.Stat(NewStorage(m, r), "cache.tar")
+			g.Assert(r.get(StorageOperations, Labels{"operation": "stat", "result": "error"})).Equal(1.0)
+		})
+	})
+
+	g.Describe("NewCache", func() {
+		var dir string
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "metrics")
+			os.Chdir(dir)
+			os.Mkdir("mount", 0755)
+			ioutil.WriteFile("mount/file.txt", []byte("cached"), 0644)
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should record rebuilds and restores", func() {
+			m, _ := memory.New(nil)
+			r := newRecorder()
+			c := NewCache(cache.NewDefault(m, cache.WithSkipExisting()), r)
+
+			g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+			g.Assert(c.Rebuild([]string{"mount"}, "cache.tar") == nil).IsTrue("failed to rebuild")
+			g.Assert(c.Rebuild([]string{"missing"}, "other.tar") != nil).IsTrue("expected an error")
+
+			c.Restore("cache.tar", "")
+			c.Restore("missing.tar", "cache.tar")
+			c.Restore("missing.tar", "")
+
+			g.Assert(r.get(Rebuilds, Labels{"result": "success"})).Equal(1.0)
+			g.Assert(r.get(Rebuilds, Labels{"result": "skipped"})).Equal(1.0)
+			g.Assert(r.get(Rebuilds, Labels{"result": "error"})).Equal(1.0)
+			g.Assert(r.get(RebuildDuration, Labels{})).Equal(3.0)
+			g.Assert(r.get(ArchiveSize, Labels{"operation": "rebuild"})).Equal(1.0)
+
+			g.Assert(r.get(Restores, Labels{"result": "hit"})).Equal(1.0)
+			g.Assert(r.get(Restores, Labels{"result": "fallback"})).Equal(1.0)
+			g.Assert(r.get(Restores, Labels{"result": "miss"})).Equal(1.0)
+			g.Assert(r.get(RestoreDuration, Labels{})).Equal(3.0)
+			g.Assert(r.get(ArchiveSize, Labels{"operation": "restore"})).Equal(2.0)
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		m, _ := memory.New(nil)
+		return NewStorage(m, newRecorder())
+	})
+}
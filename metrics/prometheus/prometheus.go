@@ -0,0 +1,340 @@
+package prometheus
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/drone/drone-cache-lib/metrics"
+)
+
+// Default histogram buckets, chosen by the unit suffix of the metric name.
+var (
+	DurationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	SizeBuckets     = []float64{1 << 20, 10 << 20, 100 << 20, 500 << 20, 1 << 30, 5 << 30, 10 << 30}
+	DefaultBuckets  = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+)
+
+// Options contains configuration for the registry.
+type Options struct {
+	// Labels are added to every sample, for example the repository.
+	Labels metrics.Labels
+
+	// Buckets are the upper bounds of the histograms by metric name.
+	// Metrics ending in _seconds default to DurationBuckets, metrics ending
+	// in _bytes to SizeBuckets and all others to DefaultBuckets.
+	Buckets map[string][]float64
+
+	// Client is used to push to a gateway. It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// Registry keeps metrics in memory and exports them in the Prometheus text
+// format.
+type Registry struct {
+	opts Options
+
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+type family struct {
+	kind    string
+	buckets []float64
+	series  map[string]*series
+}
+
+type series struct {
+	labels metrics.Labels
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// New creates an empty registry.
+func New(opts *Options) *Registry {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.Client == nil {
+		o.Client = http.DefaultClient
+	}
+
+	return &Registry{
+		opts:     o,
+		families: make(map[string]*family),
+	}
+}
+
+// Counter adds value to the counter.
+func (r *Registry) Counter(name string, labels metrics.Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s := r.series(name, "counter", labels); s != nil {
+		s.value += value
+	}
+}
+
+// Histogram adds an observation of value to the histogram.
+func (r *Registry) Histogram(name string, labels metrics.Labels, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.series(name, "histogram", labels)
+	if s == nil {
+		return
+	}
+
+	for i, le := range r.families[name].buckets {
+		if value <= le {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.value += value
+}
+
+// series returns the series of the metric with the labels, creating it if
+// needed. It returns nil if the metric was recorded with another kind.
+func (r *Registry) series(name, kind string, labels metrics.Labels) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{
+			kind:   kind,
+			series: make(map[string]*series),
+		}
+
+		if kind == "histogram" {
+			f.buckets = r.buckets(name)
+		}
+
+		r.families[name] = f
+	}
+
+	if f.kind != kind {
+		return nil
+	}
+
+	key := formatLabels(labels, "", "")
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			labels: labels,
+			counts: make([]uint64, len(f.buckets)),
+		}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+func (r *Registry) buckets(name string) []float64 {
+	if b, ok := r.opts.Buckets[name]; ok {
+		b = append([]float64(nil), b...)
+		sort.Float64s(b)
+
+		return b
+	}
+
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return DurationBuckets
+	case strings.HasSuffix(name, "_bytes"):
+		return SizeBuckets
+	}
+
+	return DefaultBuckets
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(cw, "# TYPE %s %s\n", name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			s := f.series[key]
+			labels := r.labels(s.labels)
+
+			if f.kind == "counter" {
+				fmt.Fprintf(cw, "%s%s %s\n", name, formatLabels(labels, "", ""), formatFloat(s.value))
+				continue
+			}
+
+			for i, le := range f.buckets {
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", name, formatLabels(labels, "le", formatFloat(le)), s.counts[i])
+			}
+
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", name, formatLabels(labels, "le", "+Inf"), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", name, formatLabels(labels, "", ""), formatFloat(s.value))
+			fmt.Fprintf(cw, "%s_count%s %d\n", name, formatLabels(labels, "", ""), s.count)
+		}
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+
+	return cw.n, bw.Flush()
+}
+
+// WriteFile writes all metrics to the file, for example for the textfile
+// collector of the node exporter. The file is replaced atomically.
+func (r *Registry) WriteFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err := r.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Push replaces the metrics of the job on a Pushgateway at addr.
+func (r *Registry) Push(addr string, job string) error {
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(addr, "/") + "/metrics/job/" + url.PathEscape(job)
+
+	req, err := http.NewRequest(http.MethodPut, u, &buf)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := r.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to push metrics to %s: %s: %s", u, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// labels returns the labels of a series with the registry's labels added.
+func (r *Registry) labels(labels metrics.Labels) metrics.Labels {
+	if len(r.opts.Labels) == 0 {
+		return labels
+	}
+
+	all := make(metrics.Labels, len(labels)+len(r.opts.Labels))
+	for k, v := range r.opts.Labels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+
+	return all
+}
+
+// formatLabels formats the labels, and the extra label if its name isn't
+// empty, sorted by name.
+func formatLabels(labels metrics.Labels, name, value string) string {
+	pairs := make([]string, 0, len(labels)+1)
+	for k, v := range labels {
+		pairs = append(pairs, k+`="`+escape(v)+`"`)
+	}
+	sort.Strings(pairs)
+
+	if name != "" {
+		pairs = append(pairs, name+`="`+escape(value)+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return escaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	w.err = err
+
+	return n, err
+}
@@ -0,0 +1,110 @@
+package prometheus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/metrics"
+	"github.com/franela/goblin"
+)
+
+const expected = `# TYPE drone_cache_restore_duration_seconds histogram
+drone_cache_restore_duration_seconds_bucket{repo="octocat/hello",le="1"} 1
+drone_cache_restore_duration_seconds_bucket{repo="octocat/hello",le="10"} 2
+drone_cache_restore_duration_seconds_bucket{repo="octocat/hello",le="+Inf"} 3
+drone_cache_restore_duration_seconds_sum{repo="octocat/hello"} 70.5
+drone_cache_restore_duration_seconds_count{repo="octocat/hello"} 3
+# TYPE drone_cache_restores_total counter
+drone_cache_restores_total{repo="octocat/hello",result="hit"} 2
+drone_cache_restores_total{repo="octocat/hello",result="miss \"quoted\""} 1
+`
+
+func TestPrometheus(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Registry", func() {
+		var r *Registry
+
+		g.BeforeEach(func() {
+			r = New(&Options{
+				Labels:  metrics.Labels{"repo": "octocat/hello"},
+				Buckets: map[string][]float64{metrics.RestoreDuration: {10, 1}},
+			})
+
+			r.Counter(metrics.Restores, metrics.Labels{"result": "hit"}, 1)
+			r.Counter(metrics.Restores, metrics.Labels{"result": "hit"}, 1)
+			r.Counter(metrics.Restores, metrics.Labels{"result": `miss "quoted"`}, 1)
+			r.Histogram(metrics.RestoreDuration, metrics.Labels{}, 0.5)
+			r.Histogram(metrics.RestoreDuration, metrics.Labels{}, 10)
+			r.Histogram(metrics.RestoreDuration, metrics.Labels{}, 60)
+
+			// A metric keeps the kind it was first recorded with
+			r.Histogram(metrics.Restores, metrics.Labels{"result": "hit"}, 1)
+		})
+
+		g.It("Should write the text format", func() {
+			var buf bytes.Buffer
+			n, err := r.WriteTo(&buf)
+
+			g.Assert(err == nil).IsTrue("failed to write")
+			g.Assert(n).Equal(int64(buf.Len()))
+			g.Assert(buf.String()).Equal(expected)
+		})
+
+		g.It("Should use default buckets by unit", func() {
+			g.Assert(New(nil).buckets(metrics.RebuildDuration)).Equal(DurationBuckets)
+			g.Assert(New(nil).buckets(metrics.ArchiveSize)).Equal(SizeBuckets)
+			g.Assert(New(nil).buckets("other")).Equal(DefaultBuckets)
+		})
+
+		g.It("Should write a file", func() {
+			dir, _ := ioutil.TempDir("", "prometheus")
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "cache.prom")
+			g.Assert(r.WriteFile(path) == nil).IsTrue("failed to write file")
+
+			content, _ := ioutil.ReadFile(path)
+			g.Assert(string(content)).Equal(expected)
+
+			files, _ := ioutil.ReadDir(dir)
+			g.Assert(len(files)).Equal(1)
+		})
+
+		g.It("Should push to a gateway", func() {
+			var method, path, contentType, body string
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				b, _ := ioutil.ReadAll(req.Body)
+
+				method = req.Method
+				path = req.URL.EscapedPath()
+				contentType = req.Header.Get("Content-Type")
+				body = string(b)
+			}))
+			defer srv.Close()
+
+			g.Assert(r.Push(srv.URL+"/", "drone cache") == nil).IsTrue("failed to push")
+			g.Assert(method).Equal(http.MethodPut)
+			g.Assert(path).Equal("/metrics/job/drone%20cache")
+			g.Assert(contentType).Equal("text/plain; version=0.0.4")
+			g.Assert(body).Equal(expected)
+		})
+
+		g.It("Should report a rejected push", func() {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				http.Error(w, "invalid metric", http.StatusBadRequest)
+			}))
+			defer srv.Close()
+
+			err := r.Push(srv.URL, "drone")
+			g.Assert(err != nil).IsTrue("expected an error")
+			g.Assert(err.Error()).Equal("failed to push metrics to " + srv.URL + "/metrics/job/drone: 400 Bad Request: invalid metric")
+		})
+	})
+}
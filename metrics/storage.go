@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"io"
+	"time"
+
+	"github.com/drone/drone-cache-lib/progress"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+type metricsStorage struct {
+	s storage.Storage
+	m Metrics
+}
+
+// NewStorage creates an implementation of Storage that records the count,
+// result and duration of every operation of s, and the bytes transferred by
+// Get and Put.
+func NewStorage(s storage.Storage, m Metrics) storage.Storage {
+	return &metricsStorage{
+		s: s,
+		m: m,
+	}
+}
+
+func (s *metricsStorage) Get(p string, dst io.Writer) error {
+	t := progress.NewTracker(nil, progress.Download, 0)
+
+	err := s.record("get", func() error {
+		return s.s.Get(p, t.Writer(dst))
+	})
+
+	s.m.Counter(StorageBytes, Labels{"operation": "get"}, float64(t.Event().BytesWritten))
+	return err
+}
+
+func (s *metricsStorage) Put(p string, src io.Reader) error {
+	t := progress.NewTracker(nil, progress.Upload, 0)
+
+	err := s.record("put", func() error {
+		return s.s.Put(p, t.Reader(src))
+	})
+
+	s.m.Counter(StorageBytes, Labels{"operation": "put"}, float64(t.Event().BytesRead))
+	return err
+}
+
+func (s *metricsStorage) Create(p string, src io.Reader) error {
+	t := progress.NewTracker(nil, progress.Upload, 0)
+
+	err := s.record("create", func() error {
+		return storage.Create(s.s, p, t.Reader(src))
+	})
+
+	s.m.Counter(StorageBytes, Labels{"operation": "create"}, float64(t.Event().BytesRead))
+	return err
+}
+
+func (s *metricsStorage) List(p string) ([]storage.FileEntry, error) {
+	var files []storage.FileEntry
+
+	err := s.record("list", func() (err error) {
+		files, err = s.s.List(p)
+		return err
+	})
+
+	return files, err
+}
+
+func (s *metricsStorage) Stat(p string) (storage.FileEntry, error) {
+	var file storage.FileEntry
+
+	err := s.record("stat", func() (err error) {
+		file, err = storage.Stat(s.s, p)
+		return err
+	})
+
+	return file, err
+}
+
+func (s *metricsStorage) Rename(src, dst string) error {
+	return s.record("rename", func() error {
+		return storage.Rename(s.s, src, dst)
+	})
+}
+
+func (s *metricsStorage) Delete(p string) error {
+	return s.record("delete", func() error {
+		return s.s.Delete(p)
+	})
+}
+
+// Unwrap returns the wrapped storage.
+func (s *metricsStorage) Unwrap() storage.Storage {
+	return s.s
+}
+
+// record runs the operation and records its result and duration.
+func (s *metricsStorage) record(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+
+	result := "success"
+	switch {
+	case storage.IsNotFound(err):
+		result = "not_found"
+	case storage.IsAlreadyExists(err):
+		result = "exists"
+	case err != nil:
+		result = "error"
+	}
+
+	s.m.Counter(StorageOperations, Labels{"operation": op, "result": result}, 1)
+	s.m.Histogram(StorageDuration, Labels{"operation": op}, time.Since(start).Seconds())
+
+	return err
+}
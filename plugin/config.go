@@ -0,0 +1,224 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// DefaultFlushAge is the number of days a cache item is kept after it was
+// last used.
+const DefaultFlushAge = 30
+
+// DefaultArchive is the name of the archive in the default cache key.
+const DefaultArchive = "archive.tar"
+
+// Config contains the plugin settings, read from the PLUGIN_* environment
+// variables, and the build, read from the DRONE_* environment variables.
+type Config struct {
+	// Mount are the paths to cache, from PLUGIN_MOUNT.
+	Mount []string
+
+	// Rebuild, Restore and Flush select the mode, from PLUGIN_REBUILD,
+	// PLUGIN_RESTORE and PLUGIN_FLUSH. Rebuild and Restore are exclusive.
+	Rebuild bool
+	Restore bool
+	Flush   bool
+
+	// FlushAge is the number of days a cache item is kept after it was last
+	// used, from PLUGIN_FLUSH_AGE.
+	FlushAge int
+
+	// FlushPath is the prefix of the cache items flushed, from
+	// PLUGIN_FLUSH_PATH. It defaults to the repository.
+	FlushPath string
+
+	// CacheKey is the cache item to rebuild or restore, from
+	// PLUGIN_CACHE_KEY. It defaults to DefaultArchive below the repository
+	// and branch. Its extension selects the archive format.
+	CacheKey string
+
+	// Fallback is restored when CacheKey has no cache item, from
+	// PLUGIN_FALLBACK. It defaults to the cache key of the target branch of
+	// pull requests, and of the default branch otherwise.
+	Fallback string
+
+	// Backend names the storage backend, from PLUGIN_BACKEND. It may be
+	// empty if only one backend is registered.
+	Backend string
+
+	// Debug enables debug logging, from PLUGIN_DEBUG.
+	Debug bool
+
+	// Output is the file step outputs are written to, from DRONE_OUTPUT.
+	Output string
+
+	Build Build
+
+	getenv func(string) string
+}
+
+// Build describes the build running the plugin.
+type Build struct {
+	Repo          string // DRONE_REPO
+	DefaultBranch string // DRONE_REPO_BRANCH
+	Branch        string // DRONE_BRANCH
+	TargetBranch  string // DRONE_TARGET_BRANCH
+	Commit        string // DRONE_COMMIT_SHA
+	Event         string // DRONE_BUILD_EVENT
+	Number        int    // DRONE_BUILD_NUMBER
+	Link          string // DRONE_BUILD_LINK
+}
+
+// LoadEnv loads the configuration from the environment of the process.
+func LoadEnv() (Config, error) {
+	return Load(os.Getenv)
+}
+
+// Load loads the configuration from the environment variables returned by
+// getenv, fills in defaults and validates it.
+func Load(getenv func(string) string) (Config, error) {
+	c := Config{getenv: getenv}
+
+	var err error
+	flag := func(name string) bool {
+		v, perr := parseBool(getenv(name))
+		if perr != nil && err == nil {
+			err = fmt.Errorf("invalid %s: %s", name, perr)
+		}
+
+		return v
+	}
+
+	c.Mount = splitList(getenv("PLUGIN_MOUNT"))
+	c.Rebuild = flag("PLUGIN_REBUILD")
+	c.Restore = flag("PLUGIN_RESTORE")
+	c.Flush = flag("PLUGIN_FLUSH")
+	c.Debug = flag("PLUGIN_DEBUG")
+	c.FlushPath = getenv("PLUGIN_FLUSH_PATH")
+	c.CacheKey = getenv("PLUGIN_CACHE_KEY")
+	c.Fallback = getenv("PLUGIN_FALLBACK")
+	c.Backend = getenv("PLUGIN_BACKEND")
+	c.Output = getenv("DRONE_OUTPUT")
+
+	c.FlushAge = DefaultFlushAge
+	if v := getenv("PLUGIN_FLUSH_AGE"); v != "" {
+		n, perr := strconv.Atoi(v)
+		if perr != nil && err == nil {
+			err = fmt.Errorf("invalid PLUGIN_FLUSH_AGE: %s", perr)
+		}
+
+		c.FlushAge = n
+	}
+
+	c.Build = Build{
+		Repo:          getenv("DRONE_REPO"),
+		DefaultBranch: getenv("DRONE_REPO_BRANCH"),
+		Branch:        getenv("DRONE_BRANCH"),
+		TargetBranch:  getenv("DRONE_TARGET_BRANCH"),
+		Commit:        getenv("DRONE_COMMIT_SHA"),
+		Event:         getenv("DRONE_BUILD_EVENT"),
+		Link:          getenv("DRONE_BUILD_LINK"),
+	}
+
+	if v := getenv("DRONE_BUILD_NUMBER"); v != "" {
+		n, perr := strconv.Atoi(v)
+		if perr != nil && err == nil {
+			err = fmt.Errorf("invalid DRONE_BUILD_NUMBER: %s", perr)
+		}
+
+		c.Build.Number = n
+	}
+
+	if err != nil {
+		return c, err
+	}
+
+	c.defaults()
+
+	return c, c.Validate()
+}
+
+// defaults derives the cache keys and flush path from the build.
+func (c *Config) defaults() {
+	if c.CacheKey == "" && c.Build.Repo != "" && c.Build.Branch != "" {
+		c.CacheKey = path.Join(c.Build.Repo, c.Build.Branch, DefaultArchive)
+	}
+
+	if c.Fallback == "" && c.Build.Repo != "" {
+		branch := c.Build.DefaultBranch
+		if c.Build.Event == "pull_request" && c.Build.TargetBranch != "" {
+			branch = c.Build.TargetBranch
+		}
+
+		if branch != "" {
+			c.Fallback = path.Join(c.Build.Repo, branch, path.Base(c.CacheKey))
+		}
+	}
+
+	if c.Fallback == c.CacheKey {
+		c.Fallback = ""
+	}
+
+	if c.FlushPath == "" && c.Build.Repo != "" {
+		c.FlushPath = c.Build.Repo + "/"
+	}
+}
+
+// Validate checks that the configuration selects a mode and has the
+// settings the mode needs.
+func (c Config) Validate() error {
+	switch {
+	case !c.Rebuild && !c.Restore && !c.Flush:
+		return errors.New("no mode selected, set rebuild, restore or flush")
+	case c.Rebuild && c.Restore:
+		return errors.New("rebuild and restore can't be used together")
+	case (c.Rebuild || c.Restore) && len(c.Mount) == 0:
+		return errors.New("no mount set")
+	case (c.Rebuild || c.Restore) && c.CacheKey == "":
+		return errors.New("no cache key set and none can be derived from the build")
+	case c.Flush && c.FlushAge <= 0:
+		return fmt.Errorf("invalid flush age: %d", c.FlushAge)
+	case c.Flush && c.FlushPath == "":
+		return errors.New("no flush path set and none can be derived from the build")
+	}
+
+	return nil
+}
+
+// Setting returns the plugin setting with the name, read from the
+// environment variable PLUGIN_<NAME>. Storage backends use it to read their
+// own settings.
+func (c Config) Setting(name string) string {
+	if c.getenv == nil {
+		return ""
+	}
+
+	return c.getenv("PLUGIN_" + strings.ToUpper(name))
+}
+
+// parseBool parses a flag, treating an empty value as false.
+func parseBool(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(v)
+}
+
+// splitList splits a comma separated list, as Drone passes list settings,
+// dropping empty items.
+func splitList(v string) []string {
+	var items []string
+
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,201 @@
+// Package plugin runs a Drone cache plugin. A plugin only supplies the
+// constructors of its storage backends:
+//
+//	func main() {
+//		err := plugin.Run(plugin.Registry{
+//			"mybackend": func(c plugin.Config) (storage.Storage, error) {
+//				return mybackend.New(&mybackend.Options{
+//					Server: c.Setting("server"),
+//				})
+//			},
+//		})
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drone/drone-cache-lib/archive/util"
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/progress"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// StorageFunc creates a storage backend from the configuration.
+type StorageFunc func(c Config) (storage.Storage, error)
+
+// Registry maps the names of storage backends to their constructors.
+type Registry map[string]StorageFunc
+
+// Storage creates the backend selected by the configuration. The backend
+// name may be omitted if the registry has a single backend.
+func (r Registry) Storage(c Config) (storage.Storage, error) {
+	name := c.Backend
+	if name == "" && len(r) == 1 {
+		for n := range r {
+			name = n
+		}
+	}
+
+	fn, ok := r[name]
+	if !ok {
+		names := make([]string, 0, len(r))
+		for n := range r {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return nil, fmt.Errorf("unknown storage backend %q, use one of %s", name, strings.Join(names, ", "))
+	}
+
+	return fn(c)
+}
+
+// Plugin runs the mode selected by the configuration.
+type Plugin struct {
+	Config   Config
+	Backends Registry
+
+	// Tool names the plugin and its version in the metadata of cache items.
+	Tool string
+
+	// Logger receives log messages. Nothing is logged if it is nil.
+	Logger logger.Logger
+}
+
+// Run loads the configuration from the environment and runs the plugin
+// with the backends, logging to the standard logrus logger.
+func Run(backends Registry) error {
+	c, err := LoadEnv()
+	if err != nil {
+		return err
+	}
+
+	if c.Debug {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	p := Plugin{
+		Config:   c,
+		Backends: backends,
+		Logger:   logger.NewLogrus(logrus.StandardLogger()),
+	}
+
+	return p.Exec()
+}
+
+// Exec rebuilds or restores the cache, then flushes it, as configured, and
+// writes the step outputs. A cache that can't be restored is logged and
+// doesn't fail the step.
+func (p Plugin) Exec() error {
+	log := logger.OrDiscard(p.Logger)
+
+	s, err := p.Backends.Storage(p.Config)
+	if err != nil {
+		return err
+	}
+
+	outputs := make(map[string]string)
+
+	if p.Config.Rebuild || p.Config.Restore {
+		a, err := util.FromFilename(p.Config.CacheKey)
+		if err != nil {
+			return err
+		}
+
+		c := cache.New(s, a,
+			cache.WithLogger(log),
+			cache.WithProgress(progress.NewLogger(log, 0)),
+			cache.WithBuildInfo(cache.BuildInfo{
+				Repo:   p.Config.Build.Repo,
+				Branch: p.Config.Build.Branch,
+				Commit: p.Config.Build.Commit,
+				Number: p.Config.Build.Number,
+				Link:   p.Config.Build.Link,
+				Tool:   p.Tool,
+			}),
+		)
+
+		if p.Config.Rebuild {
+			res, err := c.RebuildResult(p.Config.Mount, p.Config.CacheKey)
+			if err != nil {
+				return err
+			}
+
+			outputs["CACHE_KEY"] = res.Key
+			outputs["CACHE_SKIPPED"] = strconv.FormatBool(res.Skipped)
+			outputs["CACHE_SIZE"] = strconv.FormatInt(res.Size, 10)
+		}
+
+		if p.Config.Restore {
+			res, err := c.RestoreResult(p.Config.CacheKey, p.Config.Fallback)
+
+			switch {
+			case err != nil:
+				log.Warnf("Cache could not be restored %s", err)
+			case !res.Hit:
+				log.Infof("No cache found at %s", res.Key)
+			}
+
+			outputs["CACHE_KEY"] = res.Key
+			outputs["CACHE_HIT"] = strconv.FormatBool(res.Hit)
+			outputs["CACHE_FALLBACK"] = strconv.FormatBool(res.Fallback)
+			outputs["CACHE_SIZE"] = strconv.FormatInt(res.Size, 10)
+		}
+	}
+
+	if p.Config.Flush {
+		cutoff := time.Now().AddDate(0, 0, -p.Config.FlushAge)
+
+		f := cache.NewFlusher(s, func(file storage.FileEntry) bool {
+			return file.LastUsed().Before(cutoff)
+		}, cache.WithFlusherLogger(log))
+
+		if err := f.Flush(p.Config.FlushPath); err != nil {
+			return err
+		}
+	}
+
+	return writeOutputs(p.Config.Output, outputs)
+}
+
+// writeOutputs appends the outputs to the file in the KEY=value format of
+// Drone step outputs. Nothing is written if no file is set.
+func writeOutputs(name string, outputs map[string]string) error {
+	if name == "" || len(outputs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(outputs))
+	for k := range outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, outputs[k])
+	}
+
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
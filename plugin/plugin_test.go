@@ -0,0 +1,214 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/franela/goblin"
+)
+
+func TestConfig(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	build := map[string]string{
+		"DRONE_REPO":          "octocat/hello-world",
+		"DRONE_REPO_BRANCH":   "master",
+		"DRONE_BRANCH":        "feature",
+		"DRONE_TARGET_BRANCH": "develop",
+		"DRONE_COMMIT_SHA":    "7fd1a60",
+		"DRONE_BUILD_EVENT":   "push",
+		"DRONE_BUILD_NUMBER":  "42",
+	}
+
+	g.Describe("Load", func() {
+		g.It("Should read the settings and derive defaults", func() {
+			c, err := Load(env(build, map[string]string{
+				"PLUGIN_MOUNT":   "node_modules, vendor,",
+				"PLUGIN_RESTORE": "true",
+				"PLUGIN_SERVER":  "cache.example.com",
+			}))
+			g.Assert(err == nil).IsTrue("failed to load")
+
+			g.Assert(c.Mount).Equal([]string{"node_modules", "vendor"})
+			g.Assert(c.Restore).IsTrue()
+			g.Assert(c.Rebuild).IsFalse()
+			g.Assert(c.CacheKey).Equal("octocat/hello-world/feature/archive.tar")
+			g.Assert(c.Fallback).Equal("octocat/hello-world/master/archive.tar")
+			g.Assert(c.FlushPath).Equal("octocat/hello-world/")
+			g.Assert(c.FlushAge).Equal(DefaultFlushAge)
+			g.Assert(c.Build.Number).Equal(42)
+			g.Assert(c.Setting("server")).Equal("cache.example.com")
+		})
+
+		g.It("Should fall back to the target branch of pull requests", func() {
+			c, err := Load(env(build, map[string]string{
+				"DRONE_BUILD_EVENT": "pull_request",
+				"PLUGIN_MOUNT":      "vendor",
+				"PLUGIN_RESTORE":    "true",
+				"PLUGIN_CACHE_KEY":  "octocat/feature.tar.gz",
+			}))
+			g.Assert(err == nil).IsTrue("failed to load")
+			g.Assert(c.Fallback).Equal("octocat/hello-world/develop/feature.tar.gz")
+		})
+
+		g.It("Should not fall back to the cache key itself", func() {
+			c, err := Load(env(build, map[string]string{
+				"DRONE_BRANCH":   "master",
+				"PLUGIN_MOUNT":   "vendor",
+				"PLUGIN_REBUILD": "true",
+			}))
+			g.Assert(err == nil).IsTrue("failed to load")
+			g.Assert(c.Fallback).Equal("")
+		})
+
+		g.It("Should reject invalid settings", func() {
+			_, err := Load(env(build, nil))
+			g.Assert(err.Error()).Equal("no mode selected, set rebuild, restore or flush")
+
+			_, err = Load(env(build, map[string]string{"PLUGIN_MOUNT": "vendor", "PLUGIN_REBUILD": "true", "PLUGIN_RESTORE": "true"}))
+			g.Assert(err.Error()).Equal("rebuild and restore can't be used together")
+
+			_, err = Load(env(build, map[string]string{"PLUGIN_REBUILD": "true"}))
+			g.Assert(err.Error()).Equal("no mount set")
+
+			_, err = Load(env(build, map[string]string{"PLUGIN_FLUSH": "yes"}))
+			g.Assert(strings.HasPrefix(err.Error(), "invalid PLUGIN_FLUSH:")).IsTrue(err.Error())
+
+			_, err = Load(env(build, map[string]string{"PLUGIN_FLUSH": "true", "PLUGIN_FLUSH_AGE": "0"}))
+			g.Assert(err.Error()).Equal("invalid flush age: 0")
+		})
+	})
+
+	g.Describe("Registry", func() {
+		g.It("Should select the only backend by default", func() {
+			m, _ := memory.New(nil)
+			r := Registry{"memory": func(Config) (storage.Storage, error) { return m, nil }}
+
+			s, err := r.Storage(Config{})
+			g.Assert(err == nil).IsTrue("failed to create storage")
+			g.Assert(s == m).IsTrue("returned another storage")
+		})
+
+		g.It("Should reject unknown backends", func() {
+			r := Registry{
+				"a": func(Config) (storage.Storage, error) { return nil, nil },
+				"b": func(Config) (storage.Storage, error) { return nil, nil },
+			}
+
+			_, err := r.Storage(Config{})
+			g.Assert(err.Error()).Equal(`unknown storage backend "", use one of a, b`)
+		})
+	})
+}
+
+func TestPlugin(t *testing.T) {
+	g := goblin.Goblin(t)
+	wd, _ := os.Getwd()
+
+	g.Describe("Exec", func() {
+		var (
+			dir string
+			now time.Time
+			s   storage.Storage
+			r   Registry
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "plugin")
+			os.Chdir(dir)
+
+			os.Mkdir("vendor", 0755)
+			ioutil.WriteFile("vendor/file.txt", []byte("cached"), 0644)
+
+			now = time.Now()
+			s, _ = memory.New(&memory.Options{Clock: func() time.Time { return now }})
+			r = Registry{"memory": func(Config) (storage.Storage, error) { return s, nil }}
+		})
+
+		g.AfterEach(func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should rebuild and restore the cache", func() {
+			output := filepath.Join(dir, "output")
+			base := map[string]string{
+				"DRONE_REPO":   "octocat/hello-world",
+				"DRONE_BRANCH": "master",
+				"DRONE_OUTPUT": output,
+				"PLUGIN_MOUNT": "vendor",
+			}
+
+			c, err := Load(env(base, map[string]string{"PLUGIN_REBUILD": "true"}))
+			g.Assert(err == nil).IsTrue("failed to load")
+			g.Assert(Plugin{Config: c, Backends: r}.Exec() == nil).IsTrue("failed to rebuild")
+
+			os.RemoveAll("vendor")
+
+			c, err = Load(env(base, map[string]string{"PLUGIN_RESTORE": "true"}))
+			g.Assert(err == nil).IsTrue("failed to load")
+			g.Assert(Plugin{Config: c, Backends: r}.Exec() == nil).IsTrue("failed to restore")
+
+			b, _ := ioutil.ReadFile("vendor/file.txt")
+			g.Assert(string(b)).Equal("cached")
+
+			b, _ = ioutil.ReadFile(output)
+			g.Assert(string(b)).Equal(strings.Join([]string{
+				"CACHE_KEY=octocat/hello-world/master/archive.tar",
+				"CACHE_SIZE=2560",
+				"CACHE_SKIPPED=false",
+				"CACHE_FALLBACK=false",
+				"CACHE_HIT=true",
+				"CACHE_KEY=octocat/hello-world/master/archive.tar",
+				"CACHE_SIZE=2560",
+			}, "\n") + "\n")
+		})
+
+		g.It("Should not fail on a missing cache", func() {
+			c, err := Load(env(map[string]string{
+				"PLUGIN_MOUNT":     "vendor",
+				"PLUGIN_RESTORE":   "true",
+				"PLUGIN_CACHE_KEY": "missing.tar",
+			}, nil))
+			g.Assert(err == nil).IsTrue("failed to load")
+			g.Assert(Plugin{Config: c, Backends: r}.Exec() == nil).IsTrue("failed on missing cache")
+		})
+
+		g.It("Should flush unused cache items", func() {
+			now = now.AddDate(0, 0, -10)
+			s.Put("octocat/hello-world/old/archive.tar", strings.NewReader("old"))
+			now = time.Now()
+			s.Put("octocat/hello-world/new/archive.tar", strings.NewReader("new"))
+
+			c, err := Load(env(map[string]string{
+				"DRONE_REPO":       "octocat/hello-world",
+				"PLUGIN_FLUSH":     "true",
+				"PLUGIN_FLUSH_AGE": "7",
+			}, nil))
+			g.Assert(err == nil).IsTrue("failed to load")
+			g.Assert(Plugin{Config: c, Backends: r}.Exec() == nil).IsTrue("failed to flush")
+
+			files, _ := s.List("octocat/")
+			g.Assert(len(files)).Equal(1)
+			g.Assert(files[0].Path).Equal("octocat/hello-world/new/archive.tar")
+		})
+	})
+}
+
+// env returns a getenv function reading the variables, with the ones in
+// override taking precedence.
+func env(vars, override map[string]string) func(string) string {
+	return func(name string) string {
+		if v, ok := override[name]; ok {
+			return v
+		}
+
+		return vars[name]
+	}
+}
@@ -0,0 +1,140 @@
+package progress
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+)
+
+// DefaultInterval is the time between two lines written by a Logger.
+const DefaultInterval = 5 * time.Second
+
+type logObserver struct {
+	log      logger.Logger
+	interval time.Duration
+	now      func() time.Time
+
+	mu   sync.Mutex
+	last map[stageKey]time.Time
+}
+
+// stageKey identifies a stage working on a single key, stages of different
+// keys can run at the same time.
+type stageKey struct {
+	key   string
+	stage Stage
+}
+
+// NewLogger creates an observer that logs the progress of every stage of
+// every key to l at most once per interval, and when the stage is done or
+// failed. A zero interval uses DefaultInterval.
+func NewLogger(l logger.Logger, interval time.Duration) Observer {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	return &logObserver{
+		log:      logger.OrDiscard(l),
+		interval: interval,
+		now:      time.Now,
+		last:     make(map[stageKey]time.Time),
+	}
+}
+
+func (l *logObserver) Observe(e Event) {
+	now := l.now()
+	k := stageKey{key: e.Key, stage: e.Stage}
+
+	// The last event of a stage is always logged
+	final := e.Done || e.Err != nil
+
+	l.mu.Lock()
+	last, ok := l.last[k]
+	if !final && ok && now.Sub(last) < l.interval {
+		l.mu.Unlock()
+		return
+	}
+
+	if final {
+		delete(l.last, k)
+	} else {
+		l.last[k] = now
+	}
+	l.mu.Unlock()
+
+	// Failures are reported by the caller, only conclude a stage whose
+	// progress was logged
+	log := l.log.WithFields(logger.Fields{"stage": string(e.Stage)})
+	if e.Err != nil {
+		if ok {
+			log.Warnf("%s", Format(e))
+		}
+		return
+	}
+
+	log.Infof("%s", Format(e))
+}
+
+// verbs describe the stages while running and when done.
+var verbs = map[Stage][2]string{
+	Pack:     {"Packing", "Packed"},
+	Upload:   {"Uploading", "Uploaded"},
+	Download: {"Downloading", "Downloaded"},
+	Unpack:   {"Unpacking", "Unpacked"},
+}
+
+// Format describes the event in a single line.
+func Format(e Event) string {
+	n := e.BytesRead
+	if e.BytesWritten > n {
+		n = e.BytesWritten
+	}
+
+	size := FormatBytes(n)
+	if e.Total > 0 {
+		size = fmt.Sprintf("%s of %s (%d%%)", size, FormatBytes(e.Total), n*100/e.Total)
+	}
+
+	verb := verbs[e.Stage][0]
+	if e.Done {
+		verb = verbs[e.Stage][1]
+	}
+
+	line := fmt.Sprintf("%s %s", verb, size)
+	if e.Stage == Pack || e.Stage == Unpack {
+		line = fmt.Sprintf("%s %d files, %s", verb, e.Files, size)
+
+		if !e.Done && e.Path != "" {
+			line += ", at " + e.Path
+		}
+	}
+
+	if e.Err != nil {
+		line = fmt.Sprintf("%s, failed: %s", line, e.Err)
+	}
+
+	if e.Key != "" {
+		line = fmt.Sprintf("%s: %s", e.Key, line)
+	}
+
+	return line
+}
+
+// FormatBytes formats n bytes with a binary unit, for example "1.5 MiB".
+func FormatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
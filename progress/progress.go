@@ -0,0 +1,200 @@
+package progress
+
+import (
+	"io"
+	"sync"
+)
+
+// Stage names the step of a cache operation progress is reported for.
+type Stage string
+
+const (
+	// Pack is writing the archive from the source files.
+	Pack Stage = "pack"
+
+	// Upload is storing the archive.
+	Upload Stage = "upload"
+
+	// Download is retrieving the archive.
+	Download Stage = "download"
+
+	// Unpack is restoring files from the archive.
+	Unpack Stage = "unpack"
+)
+
+// Event describes the progress of a stage so far.
+type Event struct {
+	Stage Stage
+
+	// Key is the cache key the stage works on, if known.
+	Key string
+
+	// Path is the file currently processed by Pack and Unpack.
+	Path string
+
+	// Files is the number of files processed.
+	Files int
+
+	// BytesRead and BytesWritten count the data read and written by the
+	// stage. Archives count their uncompressed stream.
+	BytesRead    int64
+	BytesWritten int64
+
+	// Total is the estimated number of bytes the stage transfers, or zero
+	// when it isn't known.
+	Total int64
+
+	// Done is set on the last event of a successful stage.
+	Done bool
+
+	// Err is set on the last event of a failed stage.
+	Err error
+}
+
+// Observer receives progress events. Stages may run at the same time, so
+// implementations must be safe for concurrent use.
+type Observer interface {
+	Observe(Event)
+}
+
+// Func adapts a function to an Observer.
+type Func func(Event)
+
+// Observe calls f.
+func (f Func) Observe(e Event) {
+	f(e)
+}
+
+// WithKey returns an observer that sets the key of every event passed to o.
+// It returns nil if o is nil.
+func WithKey(o Observer, key string) Observer {
+	if o == nil {
+		return nil
+	}
+
+	return Func(func(e Event) {
+		e.Key = key
+		o.Observe(e)
+	})
+}
+
+// Tracker accumulates the progress of a stage and reports every change to
+// an observer, if it has one.
+type Tracker struct {
+	o Observer
+
+	mu sync.Mutex
+	e  Event
+}
+
+// NewTracker creates a tracker for the stage. The observer may be nil.
+func NewTracker(o Observer, stage Stage, total int64) *Tracker {
+	return &Tracker{
+		o: o,
+		e: Event{Stage: stage, Total: total},
+	}
+}
+
+// File records that the stage started processing another file.
+func (t *Tracker) File(path string) {
+	t.update(func(e *Event) {
+		e.Files++
+		e.Path = path
+	})
+}
+
+// Read records n bytes read.
+func (t *Tracker) Read(n int64) {
+	t.update(func(e *Event) {
+		e.BytesRead += n
+	})
+}
+
+// Write records n bytes written.
+func (t *Tracker) Write(n int64) {
+	t.update(func(e *Event) {
+		e.BytesWritten += n
+	})
+}
+
+// Done reports that the stage completed.
+func (t *Tracker) Done() {
+	t.update(func(e *Event) {
+		e.Done = true
+	})
+}
+
+// Fail reports that the stage failed with err.
+func (t *Tracker) Fail(err error) {
+	t.update(func(e *Event) {
+		e.Err = err
+	})
+}
+
+// Finish reports that the stage completed if err is nil, and that it
+// failed otherwise.
+func (t *Tracker) Finish(err error) {
+	if err != nil {
+		t.Fail(err)
+		return
+	}
+
+	t.Done()
+}
+
+// Reader returns a reader that records the bytes read from r.
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	return &reader{r: r, t: t}
+}
+
+// Writer returns a writer that records the bytes written to w.
+func (t *Tracker) Writer(w io.Writer) io.Writer {
+	return &writer{w: w, t: t}
+}
+
+// Event returns the progress so far.
+func (t *Tracker) Event() Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.e
+}
+
+func (t *Tracker) update(fn func(*Event)) {
+	t.mu.Lock()
+	fn(&t.e)
+	e := t.e
+	t.mu.Unlock()
+
+	if t.o != nil {
+		t.o.Observe(e)
+	}
+}
+
+type reader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.Read(int64(n))
+	}
+
+	return n, err
+}
+
+type writer struct {
+	w io.Writer
+	t *Tracker
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.t.Write(int64(n))
+	}
+
+	return n, err
+}
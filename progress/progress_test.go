@@ -0,0 +1,195 @@
+package progress
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+	"github.com/sirupsen/logrus"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recorder) Observe(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) last() Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.events[len(r.events)-1]
+}
+
+func TestProgress(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Tracker", func() {
+		g.It("Should accumulate and report progress", func() {
+			r := &recorder{}
+			tr := NewTracker(WithKey(r, "key"), Pack, 100)
+
+			tr.File("a.txt")
+			ioutil.ReadAll(tr.Reader(strings.NewReader("hello")))
+			tr.Writer(ioutil.Discard).Write([]byte("hello world"))
+			tr.Done()
+
+			e := r.last()
+			g.Assert(e.Stage).Equal(Pack)
+			g.Assert(e.Key).Equal("key")
+			g.Assert(e.Path).Equal("a.txt")
+			g.Assert(e.Files).Equal(1)
+			g.Assert(e.BytesRead).Equal(int64(5))
+			g.Assert(e.BytesWritten).Equal(int64(11))
+			g.Assert(e.Total).Equal(int64(100))
+			g.Assert(e.Done).IsTrue()
+		})
+
+		g.It("Should count without an observer", func() {
+			tr := NewTracker(nil, Pack, 0)
+			g.Assert(WithKey(nil, "key") == nil).IsTrue("expected no observer")
+
+			ioutil.ReadAll(tr.Reader(strings.NewReader("hello")))
+			tr.File("a.txt")
+			tr.Done()
+
+			g.Assert(tr.Event().BytesRead).Equal(int64(5))
+			g.Assert(tr.Event().Files).Equal(1)
+		})
+	})
+
+	g.Describe("Format", func() {
+		g.It("Should describe transfers", func() {
+			g.Assert(Format(Event{Stage: Download, Key: "cache.tar", BytesWritten: 512 << 10, Total: 2 << 20})).Equal("cache.tar: Downloading 512.0 KiB of 2.0 MiB (25%)")
+			g.Assert(Format(Event{Stage: Upload, BytesRead: 100, Done: true})).Equal("Uploaded 100 B")
+		})
+
+		g.It("Should describe archives", func() {
+			g.Assert(Format(Event{Stage: Pack, Files: 3, BytesRead: 3 << 30, Path: "a/b.txt"})).Equal("Packing 3 files, 3.0 GiB, at a/b.txt")
+			g.Assert(Format(Event{Stage: Unpack, Files: 3, BytesWritten: 2048, Done: true})).Equal("Unpacked 3 files, 2.0 KiB")
+		})
+	})
+
+	g.Describe("Logger", func() {
+		g.It("Should throttle each stage", func() {
+			var buf bytes.Buffer
+			out := logrus.New()
+			out.SetOutput(&buf)
+
+			now := time.Now()
+			l := NewLogger(logger.NewLogrus(out), time.Second).(*logObserver)
+			l.now = func() time.Time { return now }
+
+			l.Observe(Event{Stage: Upload, BytesRead: 1})
+			l.Observe(Event{Stage: Upload, BytesRead: 2})
+			l.Observe(Event{Stage: Download, BytesWritten: 3})
+			now = now.Add(time.Second)
+			l.Observe(Event{Stage: Upload, BytesRead: 4})
+			l.Observe(Event{Stage: Upload, BytesRead: 5, Done: true})
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			g.Assert(len(lines)).Equal(4)
+			g.Assert(strings.Contains(lines[0], "Uploading 1 B")).IsTrue(lines[0])
+			g.Assert(strings.Contains(lines[1], "Downloading 3 B")).IsTrue(lines[1])
+			g.Assert(strings.Contains(lines[2], "Uploading 4 B")).IsTrue(lines[2])
+			g.Assert(strings.Contains(lines[3], "Uploaded 5 B")).IsTrue(lines[3])
+			g.Assert(strings.Contains(lines[3], "stage=upload")).IsTrue(lines[3])
+		})
+
+		g.It("Should throttle the stages of each key separately", func() {
+			var buf bytes.Buffer
+			out := logrus.New()
+			out.SetOutput(&buf)
+
+			now := time.Now()
+			l := NewLogger(logger.NewLogrus(out), time.Second).(*logObserver)
+			l.now = func() time.Time { return now }
+
+			l.Observe(Event{Stage: Upload, Key: "a.tar", BytesRead: 1})
+			l.Observe(Event{Stage: Upload, Key: "b.tar", BytesRead: 2})
+			l.Observe(Event{Stage: Upload, Key: "a.tar", BytesRead: 3})
+			l.Observe(Event{Stage: Upload, Key: "a.tar", BytesRead: 4, Done: true})
+			l.Observe(Event{Stage: Upload, Key: "b.tar", BytesRead: 5})
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			g.Assert(len(lines)).Equal(3)
+			g.Assert(strings.Contains(lines[0], "a.tar: Uploading 1 B")).IsTrue(lines[0])
+			g.Assert(strings.Contains(lines[1], "b.tar: Uploading 2 B")).IsTrue(lines[1])
+			g.Assert(strings.Contains(lines[2], "a.tar: Uploaded 4 B")).IsTrue(lines[2])
+		})
+
+		g.It("Should forget failed stages", func() {
+			var buf bytes.Buffer
+			out := logrus.New()
+			out.SetOutput(&buf)
+
+			l := NewLogger(logger.NewLogrus(out), time.Second).(*logObserver)
+
+			l.Observe(Event{Stage: Upload, Key: "a.tar", BytesRead: 1})
+			l.Observe(Event{Stage: Upload, Key: "a.tar", BytesRead: 2, Err: errors.New("connection reset")})
+			l.Observe(Event{Stage: Download, Key: "b.tar", Err: errors.New("not found")})
+
+			g.Assert(len(l.last)).Equal(0)
+
+			lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+			g.Assert(len(lines)).Equal(2)
+			g.Assert(strings.Contains(lines[1], "a.tar: Uploading 2 B, failed: connection reset")).IsTrue(lines[1])
+		})
+	})
+
+	g.Describe("NewStorage", func() {
+		g.It("Should report uploads and downloads", func() {
+			m, _ := memory.New(nil)
+			r := &recorder{}
+			s := NewStorage(m, r)
+
+			g.Assert(s.Put("cache.tar", strings.NewReader("hello")) == nil).IsTrue("failed to put")
+			e := r.last()
+			g.Assert(e.Stage).Equal(Upload)
+			g.Assert(e.Key).Equal("cache.tar")
+			g.Assert(e.BytesRead).Equal(int64(5))
+			g.Assert(e.Done).IsTrue()
+
+			var buf bytes.Buffer
+			g.Assert(s.Get("cache.tar", &buf) == nil).IsTrue("failed to get")
+			e = r.last()
+			g.Assert(e.Stage).Equal(Download)
+			g.Assert(e.BytesWritten).Equal(int64(5))
+			g.Assert(e.Total).Equal(int64(5))
+			g.Assert(e.Done).IsTrue()
+		})
+
+		g.It("Should not report failed transfers as done", func() {
+			m, _ := memory.New(nil)
+			r := &recorder{}
+			s := NewStorage(m, r)
+
+			g.Assert(s.Get("missing", ioutil.Discard) != nil).IsTrue("expected an error")
+			e := r.last()
+			g.Assert(e.Done).IsFalse()
+			g.Assert(e.Err != nil).IsTrue("failed to report error")
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		m, _ := memory.New(nil)
+		return NewStorage(m, &recorder{})
+	})
+}
@@ -0,0 +1,77 @@
+package progress
+
+import (
+	"io"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+type progressStorage struct {
+	s storage.Storage
+	o Observer
+}
+
+// NewStorage creates an implementation of Storage that reports the progress
+// of every Get and Put of s to o. Downloads report the size of the file as
+// total when s can look it up without listing.
+func NewStorage(s storage.Storage, o Observer) storage.Storage {
+	return &progressStorage{
+		s: s,
+		o: o,
+	}
+}
+
+func (s *progressStorage) Get(p string, dst io.Writer) error {
+	var total int64
+	if st, ok := s.s.(storage.Stater); ok {
+		if file, err := st.Stat(p); err == nil {
+			total = file.Size
+		}
+	}
+
+	t := NewTracker(WithKey(s.o, p), Download, total)
+
+	err := s.s.Get(p, t.Writer(dst))
+	t.Finish(err)
+
+	return err
+}
+
+func (s *progressStorage) Put(p string, src io.Reader) error {
+	t := NewTracker(WithKey(s.o, p), Upload, 0)
+
+	err := s.s.Put(p, t.Reader(src))
+	t.Finish(err)
+
+	return err
+}
+
+func (s *progressStorage) Create(p string, src io.Reader) error {
+	t := NewTracker(WithKey(s.o, p), Upload, 0)
+
+	err := storage.Create(s.s, p, t.Reader(src))
+	t.Finish(err)
+
+	return err
+}
+
+func (s *progressStorage) List(p string) ([]storage.FileEntry, error) {
+	return s.s.List(p)
+}
+
+func (s *progressStorage) Stat(p string) (storage.FileEntry, error) {
+	return storage.Stat(s.s, p)
+}
+
+func (s *progressStorage) Rename(src, dst string) error {
+	return storage.Rename(s.s, src, dst)
+}
+
+func (s *progressStorage) Delete(p string) error {
+	return s.s.Delete(p)
+}
+
+// Unwrap returns the wrapped storage.
+func (s *progressStorage) Unwrap() storage.Storage {
+	return s.s
+}
@@ -0,0 +1,27 @@
+package storage
+
+// Collector is implemented by storages that keep data shared between files,
+// like the dedup storage, and remove it once no file refers to it.
+type Collector interface {
+	// Collect removes the shared data no file refers to anymore.
+	Collect() error
+}
+
+// Collect runs the Collector capability of the storage, or of the storage it
+// wraps. Storages without it have nothing to collect.
+func Collect(s Storage) error {
+	for s != nil {
+		if c, ok := s.(Collector); ok {
+			return c.Collect()
+		}
+
+		w, ok := s.(Wrapper)
+		if !ok {
+			break
+		}
+
+		s = w.Unwrap()
+	}
+
+	return nil
+}
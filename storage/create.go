@@ -0,0 +1,34 @@
+package storage
+
+import (
+	"io"
+)
+
+// Creator is implemented by storages that can store a file only if it does
+// not exist yet, as a single atomic operation.
+type Creator interface {
+	// Create stores the content of src unless the file exists. It returns
+	// an error matching IsAlreadyExists if it does.
+	Create(p string, src io.Reader) error
+}
+
+// Create stores the content of src at p unless the file exists. It uses the
+// Creator capability of the storage when available and falls back to Stat
+// followed by Put otherwise, which two concurrent callers may both pass.
+func Create(s Storage, p string, src io.Reader) error {
+	if c, ok := s.(Creator); ok {
+		return c.Create(p, src)
+	}
+
+	_, err := Stat(s, p)
+
+	if err == nil {
+		return AlreadyExists(p, nil)
+	}
+
+	if !IsNotFound(err) {
+		return err
+	}
+
+	return s.Put(p, src)
+}
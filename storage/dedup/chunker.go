@@ -0,0 +1,116 @@
+package dedup
+
+import (
+	"io"
+)
+
+// gear holds the random values of the rolling gear hash.
+var gear [256]uint64
+
+func init() {
+	// Fill the table with splitmix64 so chunk boundaries are stable across
+	// builds and versions
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream into content-defined chunks. A boundary is placed
+// where the rolling hash of the last bytes matches the mask, so an insertion
+// only changes the chunks around it.
+type chunker struct {
+	r    io.Reader
+	min  int
+	max  int
+	mask uint64
+
+	buf []byte
+	off int
+	end int
+	eof bool
+}
+
+func newChunker(r io.Reader, min, avg, max int) *chunker {
+	bits := uint(0)
+	for 1<<bits < avg {
+		bits++
+	}
+
+	return &chunker{
+		r:    r,
+		min:  min,
+		max:  max,
+		mask: (1<<bits - 1) << (64 - bits),
+		buf:  make([]byte, 2*max),
+	}
+}
+
+// Next returns the next chunk. The returned slice is only valid until the
+// next call. It returns io.EOF after the last chunk.
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+
+	data := c.buf[c.off:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(data)
+	c.off += n
+
+	return data[:n], nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *chunker) cut(data []byte) int {
+	if len(data) <= c.min {
+		return len(data)
+	}
+
+	if len(data) > c.max {
+		data = data[:c.max]
+	}
+
+	var h uint64
+	for i := c.min; i < len(data); i++ {
+		h = (h << 1) + gear[data[i]]
+
+		if h&c.mask == 0 {
+			return i + 1
+		}
+	}
+
+	return len(data)
+}
+
+// fill makes sure the buffer holds at least max bytes unless the stream has
+// ended.
+func (c *chunker) fill() error {
+	if c.end-c.off >= c.max || c.eof {
+		return nil
+	}
+
+	copy(c.buf, c.buf[c.off:c.end])
+	c.end -= c.off
+	c.off = 0
+
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,433 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// ErrReservedPath is returned when writing or deleting a file below the
+// chunk prefix.
+var ErrReservedPath = errors.New("path reserved for chunks")
+
+// Options contains configuration for the deduplicating storage.
+type Options struct {
+	// ChunkPrefix is where chunks are stored, named by their hash. Files
+	// can't be stored below it. It defaults to "chunks/".
+	ChunkPrefix string
+
+	// MinSize, AvgSize and MaxSize bound the size of chunks in bytes. They
+	// default to 256KiB, 1MiB and 4MiB.
+	MinSize int
+	AvgSize int
+	MaxSize int
+
+	// Concurrency is the number of chunks transferred in parallel. It
+	// defaults to 4.
+	Concurrency int
+
+	// GracePeriod protects recently written chunks from Collect, so a
+	// chunk uploaded or reused by a Put that hasn't written its manifest yet
+	// is kept. A Put refreshes the chunks it reuses once they are older than
+	// half of it, so it must finish within that time. It defaults to one
+	// hour.
+	GracePeriod time.Duration
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
+}
+
+// manifest lists the chunks a file is made of.
+type manifest struct {
+	Version int     `json:"version"`
+	Size    int64   `json:"size"`
+	Chunks  []chunk `json:"chunks"`
+}
+
+type chunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+type dedupStorage struct {
+	s    storage.Storage
+	opts Options
+	now  func() time.Time
+
+	// known records when chunks were last seen to be fresh
+	mu    sync.Mutex
+	known map[string]time.Time
+}
+
+// New creates an implementation of Storage that splits files into
+// content-defined chunks and stores every chunk only once in s. The file
+// itself is a small manifest listing its chunks.
+//
+// Deleting a file only removes its manifest. The returned storage has a
+// Collect method, called by cache.Flusher with the WithCollect option, that
+// removes chunks no manifest refers to anymore.
+//
+// Compressed archives defeat deduplication, so this works best with the
+// plain tar format.
+func New(s storage.Storage, opts *Options) (storage.Storage, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	o.Logger = logger.OrDiscard(o.Logger)
+
+	if o.ChunkPrefix == "" {
+		o.ChunkPrefix = "chunks/"
+	}
+	if o.MinSize <= 0 {
+		o.MinSize = 256 << 10
+	}
+	if o.AvgSize <= o.MinSize {
+		o.AvgSize = 4 * o.MinSize
+	}
+	if o.MaxSize <= o.AvgSize {
+		o.MaxSize = 4 * o.AvgSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 4
+	}
+	if o.GracePeriod <= 0 {
+		o.GracePeriod = time.Hour
+	}
+
+	return &dedupStorage{
+		s:     s,
+		opts:  o,
+		now:   time.Now,
+		known: make(map[string]time.Time),
+	}, nil
+}
+
+func (s *dedupStorage) Get(p string, dst io.Writer) error {
+	if s.isChunk(p) {
+		return storage.NotFound(p, nil)
+	}
+
+	m, err := s.manifest(p)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	// Download ahead in parallel but write to dst in order
+	queue := make(chan chan result, s.opts.Concurrency)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(queue)
+
+		for _, c := range m.Chunks {
+			ch := make(chan result, 1)
+
+			select {
+			case queue <- ch:
+			case <-done:
+				return
+			}
+
+			go func(c chunk) {
+				data, err := s.getChunk(c)
+				ch <- result{data: data, err: err}
+			}(c)
+		}
+	}()
+
+	for ch := range queue {
+		r := <-ch
+		if r.err != nil {
+			return r.err
+		}
+
+		if _, err := dst.Write(r.data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *dedupStorage) Put(p string, src io.Reader) error {
+	if s.isChunk(p) {
+		return &os.PathError{Op: "put", Path: p, Err: ErrReservedPath}
+	}
+
+	c := newChunker(src, s.opts.MinSize, s.opts.AvgSize, s.opts.MaxSize)
+	m := manifest{Version: 1}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		perr error
+	)
+	sem := make(chan struct{}, s.opts.Concurrency)
+
+	for {
+		data, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+
+		m.Chunks = append(m.Chunks, chunk{Hash: hash, Size: int64(len(data))})
+		m.Size += int64(len(data))
+
+		// The chunker reuses its buffer
+		data = append([]byte(nil), data...)
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := s.putChunk(hash, data); err != nil {
+				mu.Lock()
+				perr = err
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if perr != nil {
+		return perr
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return s.s.Put(p, bytes.NewReader(b))
+}
+
+func (s *dedupStorage) List(p string) ([]storage.FileEntry, error) {
+	files, err := s.s.List(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []storage.FileEntry
+	for _, file := range files {
+		if s.isChunk(file.Path) {
+			continue
+		}
+
+		// Report the size of the file instead of its manifest
+		if m, err := s.manifest(file.Path); err == nil {
+			file.Size = m.Size
+		} else if storage.IsNotFound(err) {
+			continue
+		}
+
+		entries = append(entries, file)
+	}
+
+	return entries, nil
+}
+
+func (s *dedupStorage) Stat(p string) (storage.FileEntry, error) {
+	if s.isChunk(p) {
+		return storage.FileEntry{}, storage.NotFound(p, nil)
+	}
+
+	file, err := storage.Stat(s.s, p)
+	if err != nil {
+		return file, err
+	}
+
+	m, err := s.manifest(p)
+	if err != nil {
+		return storage.FileEntry{}, err
+	}
+
+	file.Size = m.Size
+	return file, nil
+}
+
+func (s *dedupStorage) Delete(p string) error {
+	if s.isChunk(p) {
+		return &os.PathError{Op: "delete", Path: p, Err: ErrReservedPath}
+	}
+
+	return s.s.Delete(p)
+}
+
+// Collect removes chunks that no manifest refers to. Chunks written or
+// refreshed within the grace period are kept, so Collect can run while a Put
+// is in progress.
+func (s *dedupStorage) Collect() error {
+	files, err := s.s.List("")
+	if err != nil {
+		return err
+	}
+
+	// Mark every chunk that is still referenced
+	marked := make(map[string]bool)
+	var chunks []storage.FileEntry
+
+	for _, file := range files {
+		if s.isChunk(file.Path) {
+			chunks = append(chunks, file)
+			continue
+		}
+
+		// Sweeping without every manifest would remove chunks still in use
+		m, err := s.manifest(file.Path)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, c := range m.Chunks {
+			marked[c.Hash] = true
+		}
+	}
+
+	// Sweep the rest
+	cutoff := s.now().Add(-s.opts.GracePeriod)
+	var removed int
+
+	for _, file := range chunks {
+		hash := file.Path[strings.LastIndex(file.Path, "/")+1:]
+		if marked[hash] || file.LastModified.After(cutoff) {
+			continue
+		}
+
+		// A Put may have refreshed the chunk since it was listed
+		if current, err := storage.Stat(s.s, file.Path); err != nil || current.LastModified.After(cutoff) {
+			continue
+		}
+
+		if err := s.s.Delete(file.Path); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		delete(s.known, hash)
+		s.mu.Unlock()
+
+		removed++
+	}
+
+	s.opts.Logger.Infof("Removed %d of %d chunks", removed, len(chunks))
+
+	return nil
+}
+
+func (s *dedupStorage) manifest(p string) (manifest, error) {
+	var buf bytes.Buffer
+	var m manifest
+
+	if err := s.s.Get(p, &buf); err != nil {
+		return m, err
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return m, fmt.Errorf("invalid manifest %s: %s", p, err)
+	}
+
+	return m, nil
+}
+
+func (s *dedupStorage) getChunk(c chunk) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(int(c.Size))
+
+	err := s.s.Get(s.chunkPath(c.Hash), &buf)
+
+	// A missing chunk means the file is broken, not that it doesn't exist
+	if storage.IsNotFound(err) {
+		return nil, fmt.Errorf("chunk %s is missing", c.Hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	if hex.EncodeToString(sum[:]) != c.Hash {
+		return nil, fmt.Errorf("chunk %s is corrupted", c.Hash)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// putChunk uploads the chunk unless it exists. An existing chunk that is
+// about to leave the grace period is uploaded again, which refreshes it, so
+// Collect keeps it until the manifest referring to it is written.
+func (s *dedupStorage) putChunk(hash string, data []byte) error {
+	fresh := s.now().Add(-s.opts.GracePeriod / 2)
+
+	s.mu.Lock()
+	seen := s.known[hash]
+	s.mu.Unlock()
+
+	if seen.After(fresh) {
+		return nil
+	}
+
+	p := s.chunkPath(hash)
+
+	file, err := storage.Stat(s.s, p)
+	if err != nil && !storage.IsNotFound(err) {
+		return err
+	}
+
+	seen = file.LastModified
+
+	if err != nil || !seen.After(fresh) {
+		if err := s.s.Put(p, bytes.NewReader(data)); err != nil {
+			return err
+		}
+
+		seen = s.now()
+	}
+
+	s.mu.Lock()
+	s.known[hash] = seen
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *dedupStorage) chunkPath(hash string) string {
+	return s.opts.ChunkPrefix + hash[:2] + "/" + hash
+}
+
+func (s *dedupStorage) isChunk(p string) bool {
+	return strings.HasPrefix(p, s.opts.ChunkPrefix)
+}
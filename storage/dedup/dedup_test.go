@@ -0,0 +1,200 @@
+package dedup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+func TestDedupStorage(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("dedup package", func() {
+		var (
+			inner storage.Storage
+			s     storage.Storage
+			data  []byte
+		)
+
+		g.BeforeEach(func() {
+			inner, _ = memory.New(nil)
+			s, _ = New(inner, smallChunks)
+
+			data = make([]byte, 256<<10)
+			rand.New(rand.NewSource(1)).Read(data)
+		})
+
+		g.Describe("chunker", func() {
+			g.It("Should keep boundaries after an insertion", func() {
+				before := chunks(data)
+				after := chunks(append(append([]byte("inserted"), data[:1000]...), data[1000:]...))
+
+				shared := 0
+				for hash := range after {
+					if before[hash] {
+						shared++
+					}
+				}
+				g.Assert(len(before) > 10).IsTrue("expected more chunks")
+				g.Assert(shared >= len(before)-2).IsTrue("insertion changed too many chunks")
+			})
+		})
+
+		g.Describe("Put and Get", func() {
+			g.It("Should round-trip content", func() {
+				err := s.Put("archive.tar", bytes.NewReader(data))
+				g.Assert(err == nil).IsTrue("failed to put")
+
+				var buf bytes.Buffer
+				err = s.Get("archive.tar", &buf)
+				g.Assert(err == nil).IsTrue("failed to get")
+				g.Assert(bytes.Equal(buf.Bytes(), data)).IsTrue("content differs")
+			})
+
+			g.It("Should store shared chunks once", func() {
+				s.Put("a.tar", bytes.NewReader(data))
+				first := countChunks(inner)
+
+				s.Put("b.tar", bytes.NewReader(append(data, []byte("more")...)))
+				g.Assert(countChunks(inner) <= first+1).IsTrue("stored shared chunks again")
+			})
+
+			g.It("Should report the size of the file", func() {
+				s.Put("archive.tar", bytes.NewReader(data))
+
+				file, err := storage.Stat(s, "archive.tar")
+				g.Assert(err == nil).IsTrue("failed to stat")
+				g.Assert(file.Size).Equal(int64(len(data)))
+			})
+
+			g.It("Should detect corrupted chunks", func() {
+				s.Put("archive.tar", bytes.NewReader(data))
+
+				files, _ := inner.List("chunks/")
+				inner.Put(files[0].Path, bytes.NewReader([]byte("corrupted")))
+
+				err := s.Get("archive.tar", &bytes.Buffer{})
+				g.Assert(err != nil).IsTrue("failed to detect corruption")
+			})
+		})
+
+		g.Describe("Collect", func() {
+			g.It("Should remove unreferenced chunks after the grace period", func() {
+				s.Put("a.tar", bytes.NewReader(data))
+				s.Put("b.tar", bytes.NewReader(data[:1000]))
+				s.Delete("a.tar")
+
+				ds := s.(*dedupStorage)
+				g.Assert(ds.Collect() == nil).IsTrue("failed to collect")
+				g.Assert(countChunks(inner) > 1).IsTrue("removed chunks within grace period")
+
+				ds.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+				g.Assert(ds.Collect() == nil).IsTrue("failed to collect")
+				g.Assert(countChunks(inner)).Equal(1)
+
+				var buf bytes.Buffer
+				g.Assert(s.Get("b.tar", &buf) == nil).IsTrue("removed referenced chunk")
+				g.Assert(bytes.Equal(buf.Bytes(), data[:1000])).IsTrue("content differs")
+			})
+
+			g.It("Should keep chunks reused by a Put without a manifest", func() {
+				now := time.Now()
+				clock := func() time.Time { return now }
+
+				inner, _ = memory.New(&memory.Options{Clock: clock})
+				s, _ = New(inner, smallChunks)
+				ds := s.(*dedupStorage)
+				ds.now = clock
+
+				s.Put("a.tar", bytes.NewReader(data))
+				s.Delete("a.tar")
+
+				// The chunks of a.tar are reused, then collected before
+				// the manifest of b.tar is written
+				now = now.Add(45 * time.Minute)
+				s.Put("b.tar", bytes.NewReader(data))
+				s.Delete("b.tar")
+
+				now = now.Add(30 * time.Minute)
+				g.Assert(ds.Collect() == nil).IsTrue("failed to collect")
+				g.Assert(countChunks(inner) > 1).IsTrue("removed reused chunks")
+			})
+
+			g.It("Should not remove chunks when a manifest can't be read", func() {
+				broken := false
+				inner, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+					if broken && op == "get" && p == "b.tar" {
+						return errors.New("connection reset")
+					}
+					return nil
+				}})
+				s, _ = New(inner, smallChunks)
+				ds := s.(*dedupStorage)
+				ds.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+				s.Put("b.tar", bytes.NewReader(data))
+				n := countChunks(inner)
+
+				broken = true
+				g.Assert(ds.Collect() == nil).IsFalse("failed to return error")
+				g.Assert(countChunks(inner)).Equal(n)
+			})
+		})
+
+		g.Describe("Chunk prefix", func() {
+			g.It("Should be reserved for chunks", func() {
+				s.Put("a.tar", bytes.NewReader(data))
+
+				files, _ := inner.List("chunks/")
+				p := files[0].Path
+
+				err := s.Put(p, bytes.NewReader(data))
+				g.Assert(err == nil).IsFalse("failed to reject put")
+				err = s.Delete(p)
+				g.Assert(err == nil).IsFalse("failed to reject delete")
+				err = s.Get(p, &bytes.Buffer{})
+				g.Assert(storage.IsNotFound(err)).IsTrue("failed to hide chunk")
+
+				ok, _ := storage.Exists(inner, p)
+				g.Assert(ok).IsTrue("deleted chunk")
+			})
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		m, _ := memory.New(nil)
+		s, _ := New(m, smallChunks)
+		return s
+	})
+}
+
+var smallChunks = &Options{MinSize: 1 << 10, AvgSize: 4 << 10, MaxSize: 16 << 10}
+
+func chunks(data []byte) map[string]bool {
+	c := newChunker(bytes.NewReader(data), smallChunks.MinSize, smallChunks.AvgSize, smallChunks.MaxSize)
+	hashes := make(map[string]bool)
+
+	for {
+		b, err := c.Next()
+		if err == io.EOF {
+			return hashes
+		}
+
+		hashes[string(b)] = true
+	}
+}
+
+func countChunks(s storage.Storage) int {
+	files, _ := s.List("chunks/")
+	return len(files)
+}
@@ -5,63 +5,130 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/drone/drone-cache-lib/logger"
 	"github.com/drone/drone-cache-lib/storage"
 )
 
-// Options contains configuration for the S3 connection.
+// tempPrefix names the files written before they are moved into place.
+const tempPrefix = ".dummy-"
+
+// Options contains configuration for the dummy storage. The connection
+// settings are accepted but unused.
 type Options struct {
 	Server   string
 	Username string
 	Password string
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
 }
 
 type dummyStorage struct {
 	opts *Options
+	log  logger.Logger
 }
 
-// New creates an implementation of Storage with Dummy as the backend.
+// New creates an implementation of Storage with Dummy as the backend. Files
+// are stored on the local filesystem at their path, relative to the working
+// directory.
 func New(opts *Options) (storage.Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	return &dummyStorage{
 		opts: opts,
+		log:  logger.OrDiscard(opts.Logger),
 	}, nil
 }
 
 func (s *dummyStorage) Get(p string, dst io.Writer) error {
-	if _, err := os.Stat(p); err != nil {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return storage.NotFound(p, err)
+	}
+	if err != nil {
 		return err
 	}
 
-	return nil
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return storage.NotFound(p, nil)
+	}
+
+	_, err = io.Copy(dst, f)
+	return err
 }
 
 func (s *dummyStorage) Put(p string, src io.Reader) error {
-	log.Infof("Reading for %s", p)
+	s.log.Infof("Reading for %s", p)
 
-	_, err := ioutil.ReadAll(src)
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a failed read never leaves a
+	// partial file behind
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
 
 	if err != nil {
-		log.Errorf("Failed to read for %s", p)
+		s.log.Errorf("Failed to read for %s", p)
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
 		return err
 	}
 
-	log.Infof("Finished reading for %s", p)
+	s.log.Infof("Finished reading for %s", p)
 
 	return nil
 }
 
 func (s *dummyStorage) List(p string) ([]storage.FileEntry, error) {
-	log.Infof("Retrieving list of files from %s", p)
+	s.log.Infof("Retrieving list of files from %s", p)
+
+	// Walk the directory part of the prefix and match the files below it
+	root := p[:strings.LastIndex(p, "/")+1]
+	if root == "" {
+		root = "."
+	}
 
 	var files []storage.FileEntry
-	fwErr := filepath.Walk(p, func(path string, fi os.FileInfo, err error) error {
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			return nil
+		}
+
+		key := filepath.ToSlash(path)
+		if root == "." {
+			key = strings.TrimPrefix(key, "./")
+		}
+
+		if !strings.HasPrefix(key, p) {
+			return nil
+		}
+
 		files = append(files, storage.FileEntry{
-			Path:         path,
+			Path:         key,
 			Size:         fi.Size(),
 			LastModified: fi.ModTime(),
 		})
@@ -69,15 +136,39 @@ func (s *dummyStorage) List(p string) ([]storage.FileEntry, error) {
 		return nil
 	})
 
-	if fwErr != nil {
-		return nil, fwErr
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	return files, nil
 }
 
+func (s *dummyStorage) Stat(p string) (storage.FileEntry, error) {
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return storage.FileEntry{}, storage.NotFound(p, err)
+	}
+	if err != nil {
+		return storage.FileEntry{}, err
+	}
+
+	if fi.IsDir() {
+		return storage.FileEntry{}, storage.NotFound(p, nil)
+	}
+
+	return storage.FileEntry{
+		Path:         p,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
 func (s *dummyStorage) Delete(p string) error {
-	log.Infof("Deleteing %s", p)
+	s.log.Infof("Deleting %s", p)
 
-	return os.Remove(p)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
 }
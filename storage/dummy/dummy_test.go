@@ -0,0 +1,36 @@
+package dummy
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	// The dummy storage resolves paths against the working directory
+	dir, err := ioutil.TempDir("", "dummy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+
+	defer func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		// Every test writes below the same directory, start it out empty
+		if err := os.RemoveAll("storagetest"); err != nil {
+			t.Fatal(err)
+		}
+
+		s, _ := New(nil)
+		return s
+	})
+}
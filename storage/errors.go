@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned when a file does not exist in the storage.
+var ErrNotFound = errors.New("file not found")
+
+// NotFoundError records a missing file and the error reported by the
+// backend, if any.
+type NotFoundError struct {
+	Path string
+	Err  error
+}
+
+// NotFound returns an error for the missing file p that wraps the backend
+// error err. IsNotFound reports true for the returned error.
+func NotFound(p string, err error) error {
+	return &NotFoundError{Path: p, Err: err}
+}
+
+func (e *NotFoundError) Error() string {
+	return ErrNotFound.Error() + ": " + e.Path
+}
+
+// Unwrap returns the error reported by the backend.
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrNotFound.
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// IsNotFound reports whether err, or any error it wraps, is ErrNotFound.
+func IsNotFound(err error) bool {
+	return is(err, ErrNotFound)
+}
+
+// ErrAlreadyExists is returned by Create when the file exists.
+var ErrAlreadyExists = errors.New("file already exists")
+
+// AlreadyExistsError records a file that was expected to be missing and the
+// error reported by the backend, if any.
+type AlreadyExistsError struct {
+	Path string
+	Err  error
+}
+
+// AlreadyExists returns an error for the existing file p that wraps the
+// backend error err. IsAlreadyExists reports true for the returned error.
+func AlreadyExists(p string, err error) error {
+	return &AlreadyExistsError{Path: p, Err: err}
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return ErrAlreadyExists.Error() + ": " + e.Path
+}
+
+// Unwrap returns the error reported by the backend.
+func (e *AlreadyExistsError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrAlreadyExists.
+func (e *AlreadyExistsError) Is(target error) bool {
+	return target == ErrAlreadyExists
+}
+
+// IsAlreadyExists reports whether err, or any error it wraps, is
+// ErrAlreadyExists.
+func IsAlreadyExists(err error) bool {
+	return is(err, ErrAlreadyExists)
+}
+
+// is reports whether err, or any error it wraps, is target.
+func is(err, target error) bool {
+	for err != nil {
+		if err == target {
+			return true
+		}
+
+		if e, ok := err.(interface{ Is(error) bool }); ok && e.Is(target) {
+			return true
+		}
+
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+
+		err = u.Unwrap()
+	}
+
+	return false
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/franela/goblin"
+)
+
+func TestErrors(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("IsNotFound", func() {
+		g.It("Should match the sentinel", func() {
+			g.Assert(IsNotFound(ErrNotFound)).IsTrue("failed to match ErrNotFound")
+		})
+
+		g.It("Should match wrapped errors", func() {
+			err := NotFound("archive.tar", os.ErrNotExist)
+			g.Assert(IsNotFound(err)).IsTrue("failed to match NotFoundError")
+			g.Assert(IsNotFound(&wrapped{err})).IsTrue("failed to match wrapped NotFoundError")
+			g.Assert(err.Error()).Equal("file not found: archive.tar")
+		})
+
+		g.It("Should not match other errors", func() {
+			g.Assert(IsNotFound(nil)).IsFalse("matched nil")
+			g.Assert(IsNotFound(errors.New("connection reset"))).IsFalse("matched other error")
+			g.Assert(IsNotFound(&wrapped{errors.New("connection reset")})).IsFalse("matched wrapped error")
+		})
+	})
+
+	g.Describe("IsAlreadyExists", func() {
+		g.It("Should match wrapped errors", func() {
+			err := AlreadyExists("archive.tar.lock", os.ErrExist)
+			g.Assert(IsAlreadyExists(err)).IsTrue("failed to match AlreadyExistsError")
+			g.Assert(IsAlreadyExists(&wrapped{err})).IsTrue("failed to match wrapped AlreadyExistsError")
+			g.Assert(IsNotFound(err)).IsFalse("matched as not found")
+			g.Assert(err.Error()).Equal("file already exists: archive.tar.lock")
+		})
+	})
+}
+
+type wrapped struct {
+	err error
+}
+
+func (w *wrapped) Error() string { return "wrapped: " + w.err.Error() }
+func (w *wrapped) Unwrap() error { return w.err }
@@ -0,0 +1,265 @@
+package filesystem
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// ErrInvalidPath is returned for paths that resolve outside of the root
+// directory.
+var ErrInvalidPath = errors.New("path outside of the root directory")
+
+// tempPrefix names the files written before they are moved into place.
+const tempPrefix = ".upload-"
+
+// Options contains configuration for the filesystem storage.
+type Options struct {
+	// Root is the directory files are stored in. Paths are relative to it
+	// and separated by slashes.
+	Root string
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
+}
+
+type filesystemStorage struct {
+	root string
+	log  logger.Logger
+}
+
+// New creates an implementation of Storage that keeps files in a directory
+// of the local filesystem.
+func New(opts *Options) (storage.Storage, error) {
+	if opts == nil || opts.Root == "" {
+		return nil, errors.New("no root directory set")
+	}
+
+	root, err := filepath.Abs(opts.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filesystemStorage{
+		root: root,
+		log:  logger.OrDiscard(opts.Logger),
+	}, nil
+}
+
+func (s *filesystemStorage) Get(p string, dst io.Writer) error {
+	name, err := s.path(p)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return storage.NotFound(p, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && fi.IsDir() {
+		return storage.NotFound(p, nil)
+	}
+
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+func (s *filesystemStorage) Put(p string, src io.Reader) error {
+	tmp, err := s.write(p, src)
+	if err != nil {
+		return err
+	}
+
+	name, _ := s.path(p)
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Create writes the file like Put, then links it into place, which fails if
+// the file exists.
+func (s *filesystemStorage) Create(p string, src io.Reader) error {
+	tmp, err := s.write(p, src)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	name, _ := s.path(p)
+	if err := os.Link(tmp, name); err != nil {
+		if os.IsExist(err) {
+			return storage.AlreadyExists(p, err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *filesystemStorage) List(p string) ([]storage.FileEntry, error) {
+	// Walk the directory part of the prefix and match the files below it
+	dir, err := s.path(p[:strings.LastIndex(p, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+
+	var files []storage.FileEntry
+	err = filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), tempPrefix) {
+			return nil
+		}
+
+		key := s.key(name)
+		if !strings.HasPrefix(key, p) {
+			return nil
+		}
+
+		files = append(files, storage.FileEntry{
+			Path:         key,
+			Size:         fi.Size(),
+			LastModified: fi.ModTime(),
+		})
+
+		return nil
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func (s *filesystemStorage) Stat(p string) (storage.FileEntry, error) {
+	name, err := s.path(p)
+	if err != nil {
+		return storage.FileEntry{}, err
+	}
+
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return storage.FileEntry{}, storage.NotFound(p, err)
+	}
+	if err != nil {
+		return storage.FileEntry{}, err
+	}
+
+	if fi.IsDir() {
+		return storage.FileEntry{}, storage.NotFound(p, nil)
+	}
+
+	return storage.FileEntry{
+		Path:         p,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime(),
+	}, nil
+}
+
+func (s *filesystemStorage) Rename(src, dst string) error {
+	from, err := s.path(src)
+	if err != nil {
+		return err
+	}
+
+	to, err := s.path(dst)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+
+	err = os.Rename(from, to)
+	if os.IsNotExist(err) {
+		return storage.NotFound(src, err)
+	}
+
+	return err
+}
+
+func (s *filesystemStorage) Delete(p string) error {
+	name, err := s.path(p)
+	if err != nil {
+		return err
+	}
+
+	s.log.Debugf("Deleting %s", name)
+
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// write copies src to a temporary file next to p and returns its name. A
+// failed copy leaves no file behind.
+func (s *filesystemStorage) write(p string, src io.Reader) (string, error) {
+	name, err := s.path(p)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		s.log.Errorf("Failed to write %s", name)
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// path returns the filesystem path of the key p. It fails for absolute keys
+// and keys that leave the root directory.
+func (s *filesystemStorage) path(p string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(p))
+
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &os.PathError{Op: "resolve", Path: p, Err: ErrInvalidPath}
+	}
+
+	return filepath.Join(s.root, rel), nil
+}
+
+// key returns the key of the filesystem path name below the root.
+func (s *filesystemStorage) key(name string) string {
+	rel, _ := filepath.Rel(s.root, name)
+	return filepath.ToSlash(rel)
+}
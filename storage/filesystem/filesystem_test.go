@@ -0,0 +1,92 @@
+package filesystem
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+func TestFilesystemStorage(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("filesystem package", func() {
+		var (
+			dir string
+			s   storage.Storage
+		)
+
+		g.BeforeEach(func() {
+			dir, _ = ioutil.TempDir("", "filesystem")
+			s, _ = New(&Options{Root: filepath.Join(dir, "root")})
+		})
+
+		g.AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		g.It("Should require a root directory", func() {
+			_, err := New(&Options{})
+			g.Assert(err != nil).IsTrue("failed to return error")
+		})
+
+		g.It("Should store files below the root directory", func() {
+			err := s.Put("proj/master/archive.tar", strings.NewReader("hello\ngo\n"))
+			g.Assert(err == nil).IsTrue("failed to put")
+
+			b, _ := ioutil.ReadFile(filepath.Join(dir, "root", "proj", "master", "archive.tar"))
+			g.Assert(string(b)).Equal("hello\ngo\n")
+
+			files, _ := s.List("proj/")
+			g.Assert(len(files)).Equal(1)
+			g.Assert(files[0].Path).Equal("proj/master/archive.tar")
+		})
+
+		g.It("Should reject paths outside the root directory", func() {
+			ioutil.WriteFile(filepath.Join(dir, "outside.tar"), []byte("hello"), 0644)
+
+			for _, p := range []string{"../outside.tar", "proj/../../outside.tar", "/outside.tar"} {
+				var buf bytes.Buffer
+				g.Assert(s.Get(p, &buf) != nil).IsTrue("read " + p)
+				g.Assert(s.Put(p, strings.NewReader("x")) != nil).IsTrue("wrote " + p)
+				g.Assert(s.Delete(p) != nil).IsTrue("deleted " + p)
+			}
+
+			_, err := s.List("../")
+			g.Assert(err != nil).IsTrue("listed outside the root")
+
+			_, err = os.Stat(filepath.Join(dir, "outside.tar"))
+			g.Assert(err == nil).IsTrue("removed a file outside the root")
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	var dirs []string
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		dir, err := ioutil.TempDir("", "filesystem")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+
+		s, err := New(&Options{Root: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s
+	})
+}
@@ -0,0 +1,34 @@
+// Package stream provides the writers the storage wrappers use to fan out
+// and observe transfers.
+package stream
+
+import (
+	"io"
+)
+
+// DropWriter stops writing after the first error and hides it, so a failing
+// destination never interrupts the others.
+type DropWriter struct {
+	W   io.Writer
+	Err error
+}
+
+func (w *DropWriter) Write(p []byte) (int, error) {
+	if w.Err == nil {
+		_, w.Err = w.W.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// CountWriter counts the bytes written through it.
+type CountWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (w *CountWriter) Write(p []byte) (int, error) {
+	n, err := w.W.Write(p)
+	w.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,216 @@
+package memory
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// Options contains configuration for the in-memory storage.
+type Options struct {
+	// Clock returns the current time used for modification times. It
+	// defaults to time.Now.
+	Clock func() time.Time
+
+	// Latency is added to every operation.
+	Latency time.Duration
+
+	// Fail is called before every operation with the operation name (get,
+	// put, create, list, stat, rename or delete) and the path it works on.
+	// A non-nil error fails the operation.
+	Fail func(op, p string) error
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memoryStorage struct {
+	opts *Options
+	log  logger.Logger
+
+	mu      sync.RWMutex
+	objects map[string]object
+}
+
+// New creates an implementation of Storage that keeps all files in memory.
+func New(opts *Options) (storage.Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	return &memoryStorage{
+		opts:    opts,
+		log:     logger.OrDiscard(opts.Logger),
+		objects: make(map[string]object),
+	}, nil
+}
+
+func (s *memoryStorage) Get(p string, dst io.Writer) error {
+	if err := s.before("get", p); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	obj, ok := s.objects[p]
+	s.mu.RUnlock()
+
+	if !ok {
+		return storage.NotFound(p, nil)
+	}
+
+	_, err := io.Copy(dst, bytes.NewReader(obj.data))
+	return err
+}
+
+func (s *memoryStorage) Put(p string, src io.Reader) error {
+	if err := s.before("put", p); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		s.log.Errorf("Failed to read for %s", p)
+		return err
+	}
+
+	s.mu.Lock()
+	s.objects[p] = object{data: data, modTime: s.now()}
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *memoryStorage) Create(p string, src io.Reader) error {
+	if err := s.before("create", p); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		s.log.Errorf("Failed to read for %s", p)
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[p]; ok {
+		return storage.AlreadyExists(p, nil)
+	}
+
+	s.objects[p] = object{data: data, modTime: s.now()}
+
+	return nil
+}
+
+func (s *memoryStorage) List(p string) ([]storage.FileEntry, error) {
+	if err := s.before("list", p); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var files []storage.FileEntry
+	for name, obj := range s.objects {
+		if !strings.HasPrefix(name, p) {
+			continue
+		}
+
+		files = append(files, storage.FileEntry{
+			Path:         name,
+			Size:         int64(len(obj.data)),
+			LastModified: obj.modTime,
+		})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files, nil
+}
+
+func (s *memoryStorage) Stat(p string) (storage.FileEntry, error) {
+	if err := s.before("stat", p); err != nil {
+		return storage.FileEntry{}, err
+	}
+
+	s.mu.RLock()
+	obj, ok := s.objects[p]
+	s.mu.RUnlock()
+
+	if !ok {
+		return storage.FileEntry{}, storage.NotFound(p, nil)
+	}
+
+	return storage.FileEntry{
+		Path:         p,
+		Size:         int64(len(obj.data)),
+		LastModified: obj.modTime,
+	}, nil
+}
+
+func (s *memoryStorage) Rename(src, dst string) error {
+	if err := s.before("rename", src); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[src]
+	if !ok {
+		return storage.NotFound(src, nil)
+	}
+
+	delete(s.objects, src)
+	s.objects[dst] = obj
+
+	return nil
+}
+
+func (s *memoryStorage) Delete(p string) error {
+	if err := s.before("delete", p); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.objects, p)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// before applies the configured latency and failure injection.
+func (s *memoryStorage) before(op, p string) error {
+	if s.opts.Latency > 0 {
+		time.Sleep(s.opts.Latency)
+	}
+
+	if s.opts.Fail != nil {
+		return s.opts.Fail(op, p)
+	}
+
+	return nil
+}
+
+func (s *memoryStorage) now() time.Time {
+	if s.opts.Clock != nil {
+		return s.opts.Clock()
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,103 @@
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("memory package", func() {
+		g.Describe("Put and Get", func() {
+			g.It("Should round-trip content", func() {
+				s, err := New(nil)
+				g.Assert(err == nil).IsTrue("failed to create storage")
+
+				err = s.Put("proj/master/archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+
+				var buf bytes.Buffer
+				err = s.Get("proj/master/archive.tar", &buf)
+				g.Assert(err == nil).IsTrue("failed to get")
+				g.Assert(buf.String()).Equal("hello\ngo\n")
+			})
+
+			g.It("Should return error on missing file", func() {
+				s, _ := New(nil)
+
+				var buf bytes.Buffer
+				err := s.Get("missing.tar", &buf)
+				g.Assert(err != nil).IsTrue("failed to return error")
+			})
+		})
+
+		g.Describe("List", func() {
+			g.It("Should list by prefix with sizes and times", func() {
+				now := time.Date(2020, 8, 5, 20, 23, 42, 0, time.UTC)
+				s, _ := New(&Options{Clock: func() time.Time { return now }})
+
+				s.Put("proj1/master/archive.tar", strings.NewReader("hello"))
+				s.Put("proj1/newtest/archive.tar", strings.NewReader("hello2"))
+				s.Put("proj2/master/archive.tar", strings.NewReader("hello"))
+
+				files, err := s.List("proj1/")
+				g.Assert(err == nil).IsTrue("failed to list")
+				g.Assert(len(files)).Equal(2)
+				g.Assert(files[0].Path).Equal("proj1/master/archive.tar")
+				g.Assert(files[0].Size).Equal(int64(5))
+				g.Assert(files[1].Size).Equal(int64(6))
+				g.Assert(files[1].LastModified.Equal(now)).IsTrue("unexpected modification time")
+			})
+		})
+
+		g.Describe("Delete", func() {
+			g.It("Should remove the file", func() {
+				s, _ := New(nil)
+				s.Put("archive.tar", strings.NewReader("hello"))
+
+				g.Assert(s.Delete("archive.tar") == nil).IsTrue("failed to delete")
+
+				files, _ := s.List("")
+				g.Assert(len(files)).Equal(0)
+			})
+		})
+
+		g.Describe("Options", func() {
+			g.It("Should inject failures", func() {
+				s, _ := New(&Options{Fail: func(op, p string) error {
+					if op == "put" {
+						return errors.New("connection reset")
+					}
+					return nil
+				}})
+
+				err := s.Put("archive.tar", strings.NewReader("hello"))
+				g.Assert(err != nil).IsTrue("failed to inject error")
+				g.Assert(err.Error()).Equal("connection reset")
+			})
+
+			g.It("Should add latency", func() {
+				s, _ := New(&Options{Latency: 10 * time.Millisecond})
+
+				start := time.Now()
+				s.List("")
+				g.Assert(time.Since(start) >= 10*time.Millisecond).IsTrue("failed to add latency")
+			})
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, _ := New(nil)
+		return s
+	})
+}
@@ -0,0 +1,264 @@
+package mirror
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// errBehind is reported for a replica dropped from a Put because it
+	// fell too far behind the others.
+	errBehind = errors.New("replica fell behind the write quorum")
+
+	// errNoQuorum stops reading the source once too many replicas failed.
+	errNoQuorum = errors.New("write quorum can't be reached")
+)
+
+// cursor is the position of a replica in the broadcast.
+type cursor struct {
+	chunk int
+	off   int
+	read  int64
+
+	// done is set once the Put of the replica returned, err holds its
+	// result or the reason the replica was dropped.
+	done bool
+	err  error
+}
+
+func (c *cursor) active() bool {
+	return !c.done && c.err == nil
+}
+
+// broadcast hands the source of a Put to the readers of all replicas. Every
+// replica reads at its own pace from the chunks buffered for it. A replica
+// that falls limit bytes behind while a quorum of replicas keeps up is
+// dropped, so a slow or hung replica never holds back the others.
+type broadcast struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	quorum int
+	limit  int64
+
+	chunks  [][]byte
+	base    int
+	written int64
+	closed  bool
+	err     error
+
+	cursors []*cursor
+}
+
+func newBroadcast(replicas, quorum int, limit int64) *broadcast {
+	b := &broadcast{
+		quorum:  quorum,
+		limit:   limit,
+		cursors: make([]*cursor, replicas),
+	}
+
+	b.cond = sync.NewCond(&b.mu)
+
+	for i := range b.cursors {
+		b.cursors[i] = &cursor{}
+	}
+
+	return b
+}
+
+// Write buffers p for the replicas. It blocks until a quorum of replicas is
+// less than limit bytes behind, and fails with errNoQuorum once too many
+// replicas failed.
+func (b *broadcast) Write(p []byte) (int, error) {
+	chunk := append([]byte(nil), p...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if b.possible() < b.quorum {
+			return 0, errNoQuorum
+		}
+
+		keeping := 0
+		for _, c := range b.cursors {
+			if c.active() && b.written-c.read < b.limit {
+				keeping++
+			}
+		}
+
+		if keeping >= b.quorum {
+			break
+		}
+
+		b.cond.Wait()
+	}
+
+	for _, c := range b.cursors {
+		if c.active() && b.written-c.read >= b.limit {
+			c.err = errBehind
+		}
+	}
+
+	b.chunks = append(b.chunks, chunk)
+	b.written += int64(len(chunk))
+	b.trim()
+
+	b.cond.Broadcast()
+
+	return len(p), nil
+}
+
+// close ends the source. The readers return err, or io.EOF if it is nil,
+// once they read everything buffered.
+func (b *broadcast) close(err error) {
+	b.mu.Lock()
+	b.closed = true
+	b.err = err
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// reader returns the reader for replica i.
+func (b *broadcast) reader(i int) io.Reader {
+	return &broadcastReader{b: b, c: b.cursors[i]}
+}
+
+// finish records the result of the Put of replica i.
+func (b *broadcast) finish(i int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.cursors[i]
+	c.done = true
+	if c.err == nil {
+		c.err = err
+	}
+
+	b.trim()
+	b.cond.Broadcast()
+}
+
+// wait blocks until a quorum of replicas succeeded or can no longer be
+// reached. It returns the errors of the replicas that failed so far and the
+// replicas that are still writing.
+func (b *broadcast) wait() ([]error, []int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.succeeded() < b.quorum && b.possible() >= b.quorum {
+		b.cond.Wait()
+	}
+
+	errs := make([]error, len(b.cursors))
+	var pending []int
+
+	for i, c := range b.cursors {
+		errs[i] = c.err
+		if c.active() {
+			pending = append(pending, i)
+		}
+	}
+
+	return errs, pending
+}
+
+// result blocks until the Put of replica i returned and returns its error.
+func (b *broadcast) result(i int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.cursors[i]
+	for !c.done {
+		b.cond.Wait()
+	}
+
+	return c.err
+}
+
+func (b *broadcast) read(c *cursor, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c.err == nil && c.chunk == b.base+len(b.chunks) && !b.closed {
+		b.cond.Wait()
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if c.chunk == b.base+len(b.chunks) {
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		return 0, io.EOF
+	}
+
+	chunk := b.chunks[c.chunk-b.base]
+	n := copy(p, chunk[c.off:])
+
+	c.off += n
+	c.read += int64(n)
+
+	if c.off == len(chunk) {
+		c.chunk++
+		c.off = 0
+		b.trim()
+	}
+
+	b.cond.Broadcast()
+
+	return n, nil
+}
+
+// succeeded returns the number of replicas that stored the file.
+func (b *broadcast) succeeded() int {
+	n := 0
+	for _, c := range b.cursors {
+		if c.done && c.err == nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// possible returns the number of replicas that haven't failed.
+func (b *broadcast) possible() int {
+	n := 0
+	for _, c := range b.cursors {
+		if c.err == nil {
+			n++
+		}
+	}
+
+	return n
+}
+
+// trim releases the chunks every active replica has read.
+func (b *broadcast) trim() {
+	first := b.base + len(b.chunks)
+	for _, c := range b.cursors {
+		if c.active() && c.chunk < first {
+			first = c.chunk
+		}
+	}
+
+	for ; b.base < first; b.base++ {
+		b.chunks[0] = nil
+		b.chunks = b.chunks[1:]
+	}
+}
+
+// broadcastReader reads the broadcast for a single replica.
+type broadcastReader struct {
+	b *broadcast
+	c *cursor
+}
+
+func (r *broadcastReader) Read(p []byte) (int, error) {
+	return r.b.read(r.c, p)
+}
@@ -0,0 +1,589 @@
+package mirror
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/internal/stream"
+)
+
+// Options contains configuration for the mirrored storage.
+type Options struct {
+	// WriteQuorum is the number of replicas that must accept a Put or
+	// Delete for it to succeed. It defaults to all replicas.
+	WriteQuorum int
+
+	// OnFailure is called for every replica that failed an operation that
+	// still succeeded overall, so the replica can be repaired later. Replicas
+	// still writing when a Put reached its quorum are reported after the Put
+	// returned.
+	OnFailure func(f Failure)
+
+	// MaxLag is how many bytes a replica may fall behind the write quorum
+	// during a Put before it is dropped from the Put. It defaults to 4MiB.
+	MaxLag int64
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
+}
+
+// Failure describes an operation that failed on a single replica.
+type Failure struct {
+	Replica int
+	Op      string
+	Path    string
+	Err     error
+}
+
+func (f Failure) Error() string {
+	return fmt.Sprintf("replica %d: %s %s: %s", f.Replica, f.Op, f.Path, f.Err)
+}
+
+// QuorumError is returned when too few replicas accepted a write.
+type QuorumError struct {
+	Op       string
+	Path     string
+	Quorum   int
+	Failures []Failure
+}
+
+func (e *QuorumError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = f.Error()
+	}
+
+	return fmt.Sprintf("%s of %s did not reach a quorum of %d: %s", e.Op, e.Path, e.Quorum, strings.Join(msgs, "; "))
+}
+
+type replica struct {
+	s storage.Storage
+
+	mu       sync.Mutex
+	latency  time.Duration
+	failures int
+}
+
+type mirrorStorage struct {
+	replicas []*replica
+	opts     Options
+
+	mu      sync.Mutex
+	writing map[string]map[int]int
+
+	// queue holds, for every path and replica, a channel closed once the
+	// last write or delete of the path on the replica finished
+	queue map[string]map[int]chan struct{}
+}
+
+// New creates an implementation of Storage that mirrors every file to all
+// replicas. Writes go to all replicas concurrently and reads are served by
+// the healthiest, fastest replica that has the file.
+//
+// A Put returns as soon as the write quorum stored the file. Replicas that
+// are still writing finish in the background and serve reads of the file
+// only once they are done. Later writes and deletes of the file wait for
+// them on these replicas, so they are applied in order.
+func New(replicas []storage.Storage, opts *Options) (storage.Storage, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("mirror: no replicas")
+	}
+
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	o.Logger = logger.OrDiscard(o.Logger)
+
+	if o.WriteQuorum <= 0 || o.WriteQuorum > len(replicas) {
+		o.WriteQuorum = len(replicas)
+	}
+	if o.MaxLag <= 0 {
+		o.MaxLag = 4 << 20
+	}
+
+	s := &mirrorStorage{
+		opts:    o,
+		writing: make(map[string]map[int]int),
+		queue:   make(map[string]map[int]chan struct{}),
+	}
+	for _, r := range replicas {
+		s.replicas = append(s.replicas, &replica{s: r})
+	}
+
+	return s, nil
+}
+
+func (s *mirrorStorage) Get(p string, dst io.Writer) error {
+	var notFound, failed error
+
+	for _, i := range s.order(p) {
+		w := &stream.CountWriter{W: dst}
+		err := s.call(i, func(r storage.Storage) error {
+			return r.Get(p, w)
+		})
+
+		// Another replica can only take over before dst received anything
+		if err == nil || w.N > 0 {
+			return err
+		}
+
+		if storage.IsNotFound(err) {
+			notFound = err
+			continue
+		}
+
+		s.opts.Logger.Warnf("Failed to get %s from replica %d: %s", p, i, err)
+		if failed == nil {
+			failed = err
+		}
+	}
+
+	// Only report a missing file if no replica failed to answer
+	if failed != nil {
+		return failed
+	}
+
+	return notFound
+}
+
+func (s *mirrorStorage) Put(p string, src io.Reader) error {
+	return s.write("put", p, src, func(r storage.Storage, src io.Reader) error {
+		return r.Put(p, src)
+	})
+}
+
+// Create creates the file on every replica. It fails with an error matching
+// IsAlreadyExists if any replica that answered has the file.
+func (s *mirrorStorage) Create(p string, src io.Reader) error {
+	var (
+		mu     sync.Mutex
+		exists error
+	)
+
+	err := s.write("create", p, src, func(r storage.Storage, src io.Reader) error {
+		err := storage.Create(r, p, src)
+
+		if storage.IsAlreadyExists(err) {
+			mu.Lock()
+			exists = err
+			mu.Unlock()
+		}
+
+		return err
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if exists != nil {
+		return exists
+	}
+
+	return err
+}
+
+// write stores src on every replica with fn and checks the write quorum.
+func (s *mirrorStorage) write(op, p string, src io.Reader, fn func(storage.Storage, io.Reader) error) error {
+	b := newBroadcast(len(s.replicas), s.opts.WriteQuorum, s.opts.MaxLag)
+
+	for i := range s.replicas {
+		prev, done := s.enqueue(p, i)
+
+		go func(i int) {
+			defer done()
+			<-prev
+
+			b.finish(i, s.call(i, func(r storage.Storage) error {
+				return fn(r, b.reader(i))
+			}))
+		}(i)
+	}
+
+	// Read src once and hand it to every replica that is still reading
+	_, err := io.Copy(b, src)
+	b.close(err)
+
+	if err != nil && err != errNoQuorum {
+		return err
+	}
+
+	errs, pending := b.wait()
+	err = s.quorum(op, p, errs)
+
+	// Don't wait for replicas that are still writing once the quorum is
+	// reached, but keep reads away from them until they are done
+	if len(pending) > 0 {
+		s.begin(p, pending)
+
+		go func(ok bool) {
+			for _, i := range pending {
+				if err := b.result(i); err != nil && ok {
+					s.report([]Failure{{Replica: i, Op: op, Path: p, Err: err}})
+				}
+			}
+
+			s.end(p, pending)
+		}(err == nil)
+	}
+
+	return err
+}
+
+func (s *mirrorStorage) List(p string) ([]storage.FileEntry, error) {
+	results := make([][]storage.FileEntry, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+
+	s.each(func(i int) {
+		errs[i] = s.call(i, func(r storage.Storage) error {
+			var err error
+			results[i], err = r.List(p)
+			return err
+		})
+	})
+
+	// Merge the listings, keeping the newest entry of every file
+	merged := make(map[string]storage.FileEntry)
+	var failures []Failure
+
+	for i, files := range results {
+		if errs[i] != nil {
+			failures = append(failures, Failure{Replica: i, Op: "list", Path: p, Err: errs[i]})
+			continue
+		}
+
+		for _, file := range files {
+			if existing, ok := merged[file.Path]; !ok || file.LastModified.After(existing.LastModified) {
+				merged[file.Path] = file
+			}
+		}
+	}
+
+	if len(failures) == len(s.replicas) {
+		return nil, failures[0].Err
+	}
+
+	s.report(failures)
+
+	files := make([]storage.FileEntry, 0, len(merged))
+	for _, file := range merged {
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return files, nil
+}
+
+func (s *mirrorStorage) Stat(p string) (storage.FileEntry, error) {
+	var notFound, failed error
+
+	for _, i := range s.order(p) {
+		var file storage.FileEntry
+		err := s.call(i, func(r storage.Storage) error {
+			var err error
+			file, err = storage.Stat(r, p)
+			return err
+		})
+
+		switch {
+		case err == nil:
+			return file, nil
+		case storage.IsNotFound(err):
+			notFound = err
+		case failed == nil:
+			failed = err
+		}
+	}
+
+	if failed != nil {
+		return storage.FileEntry{}, failed
+	}
+
+	return storage.FileEntry{}, notFound
+}
+
+func (s *mirrorStorage) Delete(p string) error {
+	errs := make([]error, len(s.replicas))
+	prev := make([]<-chan struct{}, len(s.replicas))
+	done := make([]func(), len(s.replicas))
+
+	for i := range s.replicas {
+		prev[i], done[i] = s.enqueue(p, i)
+	}
+
+	s.each(func(i int) {
+		defer done[i]()
+		<-prev[i]
+
+		errs[i] = s.call(i, func(r storage.Storage) error {
+			return r.Delete(p)
+		})
+	})
+
+	return s.quorum("delete", p, errs)
+}
+
+// Rename renames the file on every replica. A replica that doesn't have src
+// deletes dst instead, so it doesn't serve an older version of it.
+func (s *mirrorStorage) Rename(src, dst string) error {
+	errs := make([]error, len(s.replicas))
+	prev := make([][]<-chan struct{}, len(s.replicas))
+	done := make([][]func(), len(s.replicas))
+
+	paths := []string{src, dst}
+	if src == dst {
+		paths = paths[:1]
+	}
+
+	for i := range s.replicas {
+		for _, p := range paths {
+			ch, fn := s.enqueue(p, i)
+			prev[i] = append(prev[i], ch)
+			done[i] = append(done[i], fn)
+		}
+	}
+
+	s.each(func(i int) {
+		for j := range prev[i] {
+			defer done[i][j]()
+			<-prev[i][j]
+		}
+
+		errs[i] = s.call(i, func(r storage.Storage) error {
+			err := storage.Rename(r, src, dst)
+			if storage.IsNotFound(err) {
+				if derr := r.Delete(dst); derr != nil {
+					return derr
+				}
+			}
+
+			return err
+		})
+	})
+
+	// Only report a missing file if no replica had it
+	missing := 0
+	for _, err := range errs {
+		if storage.IsNotFound(err) {
+			missing++
+		}
+	}
+
+	if missing == len(s.replicas) {
+		return errs[0]
+	}
+
+	return s.quorum("rename", src, errs)
+}
+
+// Collect runs the Collector capability of every replica.
+func (s *mirrorStorage) Collect() error {
+	errs := make([]error, len(s.replicas))
+
+	s.each(func(i int) {
+		errs[i] = storage.Collect(s.replicas[i].s)
+	})
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unwrap returns the first replica. Capabilities found through it are
+// expected of all replicas.
+func (s *mirrorStorage) Unwrap() storage.Storage {
+	return s.replicas[0].s
+}
+
+// quorum checks the per-replica results of a write.
+func (s *mirrorStorage) quorum(op, p string, errs []error) error {
+	var failures []Failure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, Failure{Replica: i, Op: op, Path: p, Err: err})
+		}
+	}
+
+	if len(s.replicas)-len(failures) < s.opts.WriteQuorum {
+		return &QuorumError{Op: op, Path: p, Quorum: s.opts.WriteQuorum, Failures: failures}
+	}
+
+	s.report(failures)
+
+	return nil
+}
+
+// report hands failures of successful operations to OnFailure.
+func (s *mirrorStorage) report(failures []Failure) {
+	for _, f := range failures {
+		s.opts.Logger.Warnf("Replica %d failed to %s %s: %s", f.Replica, f.Op, f.Path, f.Err)
+
+		if s.opts.OnFailure != nil {
+			s.opts.OnFailure(f)
+		}
+	}
+}
+
+// call runs fn against replica i and records its health.
+func (s *mirrorStorage) call(i int, fn func(storage.Storage) error) error {
+	r := s.replicas[i]
+
+	start := time.Now()
+	err := fn(r.s)
+	elapsed := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil && !storage.IsNotFound(err) {
+		r.failures++
+		return err
+	}
+
+	r.failures = 0
+
+	// Keep a moving average so a single slow request doesn't reorder
+	if r.latency == 0 {
+		r.latency = elapsed
+	} else {
+		r.latency = (r.latency*7 + elapsed) / 8
+	}
+
+	return err
+}
+
+// each runs fn for every replica concurrently.
+func (s *mirrorStorage) each(fn func(i int)) {
+	var wg sync.WaitGroup
+
+	for i := range s.replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// order returns the replica indexes with healthy replicas first, then by
+// latency. Replicas still writing p come last.
+func (s *mirrorStorage) order(p string) []int {
+	type health struct {
+		i        int
+		failures int
+		latency  time.Duration
+		writing  bool
+	}
+
+	s.mu.Lock()
+	writing := s.writing[p]
+
+	hs := make([]health, len(s.replicas))
+	for i, r := range s.replicas {
+		r.mu.Lock()
+		hs[i] = health{i: i, failures: r.failures, latency: r.latency, writing: writing[i] > 0}
+		r.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	sort.SliceStable(hs, func(a, b int) bool {
+		if hs[a].writing != hs[b].writing {
+			return !hs[a].writing
+		}
+
+		if (hs[a].failures == 0) != (hs[b].failures == 0) {
+			return hs[a].failures == 0
+		}
+
+		return hs[a].latency < hs[b].latency
+	})
+
+	order := make([]int, len(hs))
+	for i, h := range hs {
+		order[i] = h.i
+	}
+
+	return order
+}
+
+// begin records that the replicas are still writing p.
+func (s *mirrorStorage) begin(p string, replicas []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.writing[p] == nil {
+		s.writing[p] = make(map[int]int)
+	}
+
+	for _, i := range replicas {
+		s.writing[p][i]++
+	}
+}
+
+// end records that the replicas finished writing p.
+func (s *mirrorStorage) end(p string, replicas []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, i := range replicas {
+		if s.writing[p][i]--; s.writing[p][i] == 0 {
+			delete(s.writing[p], i)
+		}
+	}
+
+	if len(s.writing[p]) == 0 {
+		delete(s.writing, p)
+	}
+}
+
+// enqueue orders a write or delete of p on replica i after the earlier ones.
+// It returns a channel closed once they finished, and a function to call
+// when this one finished.
+func (s *mirrorStorage) enqueue(p string, i int) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queue[p] == nil {
+		s.queue[p] = make(map[int]chan struct{})
+	}
+
+	prev, ok := s.queue[p][i]
+	if !ok {
+		prev = make(chan struct{})
+		close(prev)
+	}
+
+	done := make(chan struct{})
+	s.queue[p][i] = done
+
+	return prev, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		close(done)
+
+		if s.queue[p][i] == done {
+			delete(s.queue[p], i)
+		}
+		if len(s.queue[p]) == 0 {
+			delete(s.queue, p)
+		}
+	}
+}
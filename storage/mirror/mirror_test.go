@@ -0,0 +1,238 @@
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+func TestMirrorStorage(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("mirror package", func() {
+		var (
+			healthy, other, broken storage.Storage
+		)
+
+		g.BeforeEach(func() {
+			healthy, _ = memory.New(nil)
+			other, _ = memory.New(nil)
+			broken, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				return errors.New("connection reset")
+			}})
+		})
+
+		g.Describe("New", func() {
+			g.It("Should require a replica", func() {
+				_, err := New(nil, nil)
+				g.Assert(err != nil).IsTrue("failed to return error")
+			})
+		})
+
+		g.Describe("Put", func() {
+			g.It("Should write to all replicas", func() {
+				s, _ := New([]storage.Storage{healthy, other}, nil)
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(get(healthy, "archive.tar")).Equal("hello\ngo\n")
+				g.Assert(get(other, "archive.tar")).Equal("hello\ngo\n")
+			})
+
+			g.It("Should report failed replicas when the quorum is reached", func() {
+				failures := make(chan Failure, 3)
+				s, _ := New([]storage.Storage{healthy, broken, other}, &Options{
+					WriteQuorum: 2,
+					OnFailure: func(f Failure) {
+						failures <- f
+					},
+				})
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+
+				f := <-failures
+				g.Assert(f.Replica).Equal(1)
+				g.Assert(f.Op).Equal("put")
+			})
+
+			g.It("Should not wait for a hung replica once the quorum is reached", func() {
+				hung := &hungStorage{Storage: other, release: make(chan struct{})}
+				defer close(hung.release)
+
+				s, _ := New([]storage.Storage{healthy, hung}, &Options{WriteQuorum: 1})
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(get(healthy, "archive.tar")).Equal("hello\ngo\n")
+				g.Assert(s.(*mirrorStorage).order("archive.tar")[0]).Equal(0)
+			})
+
+			g.It("Should delete after writes that finish in the background", func() {
+				slow := &slowStorage{Storage: other, release: make(chan struct{}), done: make(chan struct{})}
+				s, _ := New([]storage.Storage{healthy, slow}, &Options{WriteQuorum: 1})
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+
+				time.AfterFunc(10*time.Millisecond, func() {
+					close(slow.release)
+				})
+
+				g.Assert(s.Delete("archive.tar") == nil).IsTrue("failed to delete")
+				<-slow.done
+
+				ok, _ := storage.Exists(other, "archive.tar")
+				g.Assert(ok).IsFalse("the background write restored the file")
+			})
+
+			g.It("Should drop a replica that falls behind", func() {
+				hung := &hungStorage{Storage: other, release: make(chan struct{})}
+				defer close(hung.release)
+
+				failures := make(chan Failure, 2)
+				s, _ := New([]storage.Storage{hung, healthy}, &Options{
+					WriteQuorum: 1,
+					MaxLag:      4,
+					OnFailure: func(f Failure) {
+						failures <- f
+					},
+				})
+
+				err := s.Put("archive.tar", iotest.OneByteReader(strings.NewReader("hello\ngo\n")))
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(get(healthy, "archive.tar")).Equal("hello\ngo\n")
+
+				f := <-failures
+				g.Assert(f.Replica).Equal(0)
+				g.Assert(f.Err == errBehind).IsTrue("failed to drop the replica")
+			})
+
+			g.It("Should fail without a quorum", func() {
+				s, _ := New([]storage.Storage{healthy, broken}, nil)
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err != nil).IsTrue("failed to return error")
+
+				qerr, ok := err.(*QuorumError)
+				g.Assert(ok).IsTrue("failed to return quorum error")
+				g.Assert(len(qerr.Failures)).Equal(1)
+			})
+		})
+
+		g.Describe("Get", func() {
+			g.It("Should fail over to another replica", func() {
+				other.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				s, _ := New([]storage.Storage{broken, healthy, other}, nil)
+
+				g.Assert(get(s, "archive.tar")).Equal("hello\ngo\n")
+			})
+
+			g.It("Should prefer healthy replicas", func() {
+				s, _ := New([]storage.Storage{broken, healthy}, nil)
+				get(s, "archive.tar")
+
+				g.Assert(s.(*mirrorStorage).order("archive.tar")[0]).Equal(1)
+			})
+		})
+
+		g.Describe("Create", func() {
+			g.It("Should fail if any replica has the file", func() {
+				other.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				s, _ := New([]storage.Storage{healthy, other}, nil)
+
+				err := storage.Create(s, "archive.tar", strings.NewReader("goodbye\n"))
+				g.Assert(storage.IsAlreadyExists(err)).IsTrue("failed to return already exists")
+			})
+		})
+
+		g.Describe("Rename", func() {
+			g.It("Should rename on every replica", func() {
+				healthy.Put("a.tar", strings.NewReader("a"))
+				other.Put("a.tar", strings.NewReader("a"))
+				s, _ := New([]storage.Storage{healthy, other}, nil)
+
+				g.Assert(storage.CanRename(s)).IsTrue("failed to support rename")
+				g.Assert(storage.Rename(s, "a.tar", "b.tar") == nil).IsTrue("failed to rename")
+				g.Assert(get(healthy, "b.tar")).Equal("a")
+				g.Assert(get(other, "b.tar")).Equal("a")
+			})
+
+			g.It("Should drop the destination from replicas without the file", func() {
+				healthy.Put("a.tar", strings.NewReader("a"))
+				other.Put("b.tar", strings.NewReader("old"))
+				s, _ := New([]storage.Storage{healthy, other}, &Options{WriteQuorum: 1})
+
+				g.Assert(storage.Rename(s, "a.tar", "b.tar") == nil).IsTrue("failed to rename")
+
+				ok, _ := storage.Exists(other, "b.tar")
+				g.Assert(ok).IsFalse("kept an older version")
+			})
+		})
+
+		g.Describe("List", func() {
+			g.It("Should merge the replicas", func() {
+				healthy.Put("a.tar", strings.NewReader("a"))
+				other.Put("b.tar", strings.NewReader("b"))
+				s, _ := New([]storage.Storage{healthy, broken, other}, nil)
+
+				files, err := s.List("")
+				g.Assert(err == nil).IsTrue("failed to list")
+				g.Assert(len(files)).Equal(2)
+				g.Assert(files[0].Path).Equal("a.tar")
+				g.Assert(files[1].Path).Equal("b.tar")
+			})
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		a, _ := memory.New(nil)
+		b, _ := memory.New(nil)
+		c, _ := memory.New(nil)
+
+		s, _ := New([]storage.Storage{a, b, c}, &Options{WriteQuorum: 2})
+		return s
+	})
+}
+
+// hungStorage blocks every Put without reading until release is closed.
+type hungStorage struct {
+	storage.Storage
+	release chan struct{}
+}
+
+func (s *hungStorage) Put(p string, src io.Reader) error {
+	<-s.release
+	return errors.New("timeout")
+}
+
+// slowStorage stores a file once release is closed, and closes done after.
+type slowStorage struct {
+	storage.Storage
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (s *slowStorage) Put(p string, src io.Reader) error {
+	<-s.release
+	defer close(s.done)
+
+	return s.Storage.Put(p, src)
+}
+
+func get(s storage.Storage, p string) string {
+	var buf bytes.Buffer
+	s.Get(p, &buf)
+	return buf.String()
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+)
+
+// ErrNotSupported is returned by Rename when the storage can neither rename
+// nor copy files.
+var ErrNotSupported = errors.New("operation not supported")
+
+// Renamer is implemented by storages that can move a file to another path
+// without transferring its content.
+type Renamer interface {
+	// Rename moves the file src to dst, replacing any existing file at dst
+	// in a single step, so readers of dst see either the old or the new
+	// content. It returns an error matching IsNotFound if src does not
+	// exist.
+	Rename(src, dst string) error
+}
+
+// Copier is implemented by storages that can copy a file to another path
+// without transferring its content through the client.
+type Copier interface {
+	// Copy copies the file src to dst, replacing any existing file at dst.
+	// It returns an error matching IsNotFound if src does not exist.
+	Copy(src, dst string) error
+}
+
+// CanRename reports whether Rename is supported by the storage. Wrappers
+// forwarding Rename support it if the storage they wrap does.
+func CanRename(s Storage) bool {
+	for {
+		switch s.(type) {
+		case Renamer, Copier:
+		default:
+			return false
+		}
+
+		w, ok := s.(Wrapper)
+		if !ok {
+			return true
+		}
+
+		s = w.Unwrap()
+	}
+}
+
+// Rename moves the file src to dst. It uses the Renamer capability of the
+// storage when available, and the Copier capability followed by deleting
+// src otherwise. It returns ErrNotSupported if the storage has neither.
+func Rename(s Storage, src, dst string) error {
+	if r, ok := s.(Renamer); ok {
+		return r.Rename(src, dst)
+	}
+
+	if c, ok := s.(Copier); ok {
+		if err := c.Copy(src, dst); err != nil {
+			return err
+		}
+
+		return s.Delete(src)
+	}
+
+	return ErrNotSupported
+}
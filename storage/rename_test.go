@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/franela/goblin"
+)
+
+func TestRename(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("CanRename", func() {
+		g.It("Should look through wrappers", func() {
+			g.Assert(CanRename(listStorage{})).IsFalse("plain storage can't rename")
+			g.Assert(CanRename(renameStorage{})).IsTrue("renamer can rename")
+			g.Assert(CanRename(wrapStorage{listStorage{}})).IsFalse("wrapper of plain storage can't rename")
+			g.Assert(CanRename(wrapStorage{wrapStorage{renameStorage{}}})).IsTrue("wrapper of renamer can rename")
+		})
+
+		g.It("Should not support renaming through wrappers that don't forward it", func() {
+			g.Assert(CanRename(hideStorage{renameStorage{}})).IsFalse("wrapper doesn't rename")
+			g.Assert(Rename(hideStorage{renameStorage{}}, "a", "b") == ErrNotSupported).IsTrue("failed to return error")
+		})
+	})
+}
+
+// renameStorage supports List and Rename.
+type renameStorage struct {
+	listStorage
+}
+
+func (s renameStorage) Rename(src, dst string) error { return nil }
+
+// wrapStorage forwards Rename to the storage it wraps.
+type wrapStorage struct {
+	Storage
+}
+
+func (s wrapStorage) Unwrap() Storage { return s.Storage }
+
+func (s wrapStorage) Rename(src, dst string) error { return Rename(s.Storage, src, dst) }
+
+// hideStorage wraps a storage without forwarding Rename.
+type hideStorage struct {
+	Storage
+}
+
+func (s hideStorage) Unwrap() Storage { return s.Storage }
@@ -0,0 +1,418 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// Options contains configuration for retrying storage operations.
+type Options struct {
+	// Attempts is the maximum number of attempts per operation. It defaults
+	// to 5.
+	Attempts int
+
+	// InitialBackoff is the delay before the first retry. It defaults to
+	// one second.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts. It defaults to 30
+	// seconds.
+	MaxBackoff time.Duration
+
+	// Multiplier grows the delay after every attempt. It defaults to 2.
+	Multiplier float64
+
+	// Jitter randomizes every delay by up to this fraction. It defaults to
+	// 0.2.
+	Jitter float64
+
+	// Retryable decides whether an error is worth another attempt. It
+	// defaults to IsRetryable.
+	Retryable func(error) bool
+
+	// NoSpool stops copying uploads from sources that can't be rewound to
+	// a temporary file while they are sent. Such uploads are then only
+	// repeated if the failed attempt didn't read from the source.
+	NoSpool bool
+
+	// TempDir is the directory used to spool uploads. It defaults to the
+	// system temporary directory.
+	TempDir string
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
+}
+
+type retryStorage struct {
+	s     storage.Storage
+	opts  Options
+	sleep func(time.Duration)
+}
+
+// New creates an implementation of Storage that retries failed operations
+// of s with exponential backoff.
+//
+// Uploads from a source that is not an io.Seeker are spooled to a temporary
+// file, so they can be repeated after the source was read. Downloads that
+// fail after writing to dst are repeated from the start and skip what dst
+// has already received, as long as s implements storage.Stater and the
+// file is unchanged.
+func New(s storage.Storage, opts *Options) (storage.Storage, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	o.Logger = logger.OrDiscard(o.Logger)
+
+	if o.Attempts <= 0 {
+		o.Attempts = 5
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Second
+	}
+	if o.Multiplier < 1 {
+		o.Multiplier = 2
+	}
+	if o.Jitter < 0 || o.Jitter > 1 {
+		o.Jitter = 0.2
+	}
+	if o.Retryable == nil {
+		o.Retryable = IsRetryable
+	}
+
+	return &retryStorage{
+		s:     s,
+		opts:  o,
+		sleep: time.Sleep,
+	}, nil
+}
+
+func (s *retryStorage) Get(p string, dst io.Writer) error {
+	w := &offsetWriter{w: dst}
+
+	// Remember the file to make sure a repeated download reads the same
+	// version of it. Without a Stat a download can't be resumed.
+	var before storage.FileEntry
+	var serr error
+
+	st, canStat := s.s.(storage.Stater)
+	if canStat {
+		before, serr = st.Stat(p)
+	}
+
+	return s.do("get", p, func() error {
+		// Skip what dst already received from a previous attempt
+		if w.n > w.skip {
+			w.skip = w.n
+		}
+		w.n = 0
+
+		if w.skip > 0 {
+			if !canStat || serr != nil {
+				return permanent{fmt.Errorf("can't resume the download of %s", p)}
+			}
+
+			after, err := st.Stat(p)
+			if err != nil && !storage.IsNotFound(err) {
+				return err
+			}
+
+			if err != nil || after.Size != before.Size || !after.LastModified.Equal(before.LastModified) {
+				return permanent{fmt.Errorf("%s changed while it was downloaded", p)}
+			}
+		}
+
+		err := s.s.Get(p, w)
+
+		// A download can't be repeated once dst itself failed
+		if w.err != nil {
+			return permanent{err}
+		}
+
+		return err
+	})
+}
+
+func (s *retryStorage) Put(p string, src io.Reader) error {
+	return s.upload("put", p, src, func(r io.Reader) error {
+		return s.s.Put(p, r)
+	})
+}
+
+func (s *retryStorage) Create(p string, src io.Reader) error {
+	return s.upload("create", p, src, func(r io.Reader) error {
+		return storage.Create(s.s, p, r)
+	})
+}
+
+// upload runs fn with src until it succeeds, rewinding src before every
+// attempt. Sources that can't be rewound are spooled while they are read,
+// unless disabled.
+func (s *retryStorage) upload(op, p string, src io.Reader, fn func(io.Reader) error) error {
+	if rs, ok := src.(io.ReadSeeker); ok {
+		if start, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			return s.do(op, p, func() error {
+				if _, err := rs.Seek(start, io.SeekStart); err != nil {
+					return permanent{err}
+				}
+
+				return fn(rs)
+			})
+		}
+	}
+
+	r := &streamReader{src: src}
+
+	if !s.opts.NoSpool {
+		f, err := ioutil.TempFile(s.opts.TempDir, "drone-cache-")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		r.spool = f
+	}
+
+	return s.do(op, p, func() error {
+		if err := r.rewind(); err != nil {
+			return permanent{err}
+		}
+
+		err := fn(r)
+
+		// Without a spool, what the attempt read from src is gone
+		if err != nil && !r.rewindable() {
+			return permanent{err}
+		}
+
+		return err
+	})
+}
+
+func (s *retryStorage) List(p string) ([]storage.FileEntry, error) {
+	var files []storage.FileEntry
+
+	err := s.do("list", p, func() error {
+		var err error
+		files, err = s.s.List(p)
+		return err
+	})
+
+	return files, err
+}
+
+func (s *retryStorage) Stat(p string) (storage.FileEntry, error) {
+	var file storage.FileEntry
+
+	err := s.do("stat", p, func() error {
+		var err error
+		file, err = storage.Stat(s.s, p)
+		return err
+	})
+
+	return file, err
+}
+
+func (s *retryStorage) Rename(src, dst string) error {
+	return s.do("rename", src, func() error {
+		return storage.Rename(s.s, src, dst)
+	})
+}
+
+func (s *retryStorage) Delete(p string) error {
+	return s.do("delete", p, func() error {
+		return s.s.Delete(p)
+	})
+}
+
+// Unwrap returns the wrapped storage.
+func (s *retryStorage) Unwrap() storage.Storage {
+	return s.s
+}
+
+// do runs fn until it succeeds, fails with an error that is not retryable
+// or runs out of attempts.
+func (s *retryStorage) do(op, p string, fn func() error) error {
+	var err error
+
+	for attempt := 0; attempt < s.opts.Attempts; attempt++ {
+		if attempt > 0 {
+			delay := s.backoff(attempt)
+			s.opts.Logger.Warnf("Retrying %s of %s in %s: %s", op, p, delay, err)
+			s.sleep(delay)
+		}
+
+		err = fn()
+
+		if pe, ok := err.(permanent); ok {
+			return pe.err
+		}
+
+		if err == nil || !s.opts.Retryable(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+// backoff returns the delay before the given attempt.
+func (s *retryStorage) backoff(attempt int) time.Duration {
+	delay := float64(s.opts.InitialBackoff) * math.Pow(s.opts.Multiplier, float64(attempt-1))
+	if delay > float64(s.opts.MaxBackoff) {
+		delay = float64(s.opts.MaxBackoff)
+	}
+
+	delay *= 1 - s.opts.Jitter + 2*s.opts.Jitter*rand.Float64()
+	return time.Duration(delay)
+}
+
+// IsRetryable reports whether err is worth another attempt. Connection
+// resets and refusals, timeouts, unexpected ends of a stream and errors
+// reporting themselves as temporary are retried, everything else is
+// permanent.
+func IsRetryable(err error) bool {
+	if err == nil || err == storage.ErrNotSupported || storage.IsNotFound(err) || storage.IsAlreadyExists(err) {
+		return false
+	}
+
+	// Look for a known cause first, wrappers like *net.OpError report
+	// themselves as permanent for some of them
+	for e := err; e != nil; e = unwrap(e) {
+		switch e {
+		case context.Canceled, context.DeadlineExceeded:
+			return false
+		case io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED, syscall.ETIMEDOUT, syscall.EPIPE:
+			return true
+		}
+
+		if ne, ok := e.(net.Error); ok && ne.Timeout() {
+			return true
+		}
+	}
+
+	for e := err; e != nil; e = unwrap(e) {
+		if te, ok := e.(interface{ Temporary() bool }); ok {
+			return te.Temporary()
+		}
+	}
+
+	return false
+}
+
+// unwrap returns the error wrapped by err, if any.
+func unwrap(err error) error {
+	if u, ok := err.(interface{ Unwrap() error }); ok {
+		return u.Unwrap()
+	}
+
+	return nil
+}
+
+// permanent marks an error that must not be retried.
+type permanent struct {
+	err error
+}
+
+func (e permanent) Error() string {
+	return e.err.Error()
+}
+
+// streamReader reads a source that can't be rewound. It copies what it reads
+// to the spool file, if any, and reads from the spool after a rewind.
+type streamReader struct {
+	src    io.Reader
+	spool  *os.File
+	n      int64
+	replay bool
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if r.replay {
+		return r.spool.Read(p)
+	}
+
+	n, err := r.src.Read(p)
+	r.n += int64(n)
+
+	if n > 0 && r.spool != nil {
+		if _, err := r.spool.Write(p[:n]); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+// rewindable reports whether the source can be read again from the start.
+func (r *streamReader) rewindable() bool {
+	return r.n == 0 || r.spool != nil
+}
+
+// rewind starts reading the source from the start again. The first rewind
+// spools the rest of the source.
+func (r *streamReader) rewind() error {
+	if r.n == 0 {
+		return nil
+	}
+
+	if !r.replay {
+		if _, err := io.Copy(r.spool, r.src); err != nil {
+			return err
+		}
+
+		r.replay = true
+	}
+
+	_, err := r.spool.Seek(0, io.SeekStart)
+	return err
+}
+
+// offsetWriter discards the first skip bytes written to it.
+type offsetWriter struct {
+	w    io.Writer
+	skip int64
+	n    int64
+	err  error
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	size := len(p)
+
+	if remaining := w.skip - w.n; remaining > 0 {
+		if int64(len(p)) <= remaining {
+			w.n += int64(len(p))
+			return size, nil
+		}
+
+		w.n += remaining
+		p = p[remaining:]
+	}
+
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+
+	if err != nil {
+		w.err = err
+		return size - len(p) + n, err
+	}
+
+	return size, nil
+}
@@ -0,0 +1,258 @@
+package retry
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+func TestRetryStorage(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("retry package", func() {
+		var (
+			fails map[string]int
+			calls map[string]int
+			s     storage.Storage
+		)
+
+		g.BeforeEach(func() {
+			fails = map[string]int{}
+			calls = map[string]int{}
+
+			m, _ := memory.New(&memory.Options{Fail: func(op, p string) error {
+				calls[op]++
+				if fails[op] > 0 {
+					fails[op]--
+					return syscall.ECONNRESET
+				}
+				return nil
+			}})
+
+			s = newTestStorage(m, 3)
+		})
+
+		g.Describe("Put", func() {
+			g.It("Should retry a stream that wasn't read yet", func() {
+				fails["put"] = 2
+
+				reader, writer := io.Pipe()
+				go func() {
+					writer.Write([]byte("hello\ngo\n"))
+					writer.Close()
+				}()
+
+				err := s.Put("archive.tar", reader)
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(calls["put"]).Equal(3)
+
+				var buf bytes.Buffer
+				s.Get("archive.tar", &buf)
+				g.Assert(buf.String()).Equal("hello\ngo\n")
+			})
+
+			g.It("Should not retry a stream that was read without a spool", func() {
+				f := &partialStorage{Storage: memoryStorage(), fails: 1}
+				r, _ := New(f, &Options{Attempts: 3, NoSpool: true})
+				r.(*retryStorage).sleep = func(time.Duration) {}
+				s := r
+
+				err := s.Put("archive.tar", struct{ io.Reader }{strings.NewReader("hello\ngo\n")})
+				g.Assert(err == syscall.ECONNRESET).IsTrue("failed to return error")
+				g.Assert(f.calls).Equal(1)
+			})
+
+			g.It("Should repeat a spooled stream", func() {
+				f := &partialStorage{Storage: memoryStorage(), fails: 2}
+				r := newTestStorage(f, 3)
+
+				err := r.Put("archive.tar", struct{ io.Reader }{strings.NewReader("hello\ngo\n")})
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(f.calls).Equal(3)
+
+				var buf bytes.Buffer
+				f.Get("archive.tar", &buf)
+				g.Assert(buf.String()).Equal("hello\ngo\n")
+			})
+
+			g.It("Should give up after the last attempt", func() {
+				fails["put"] = 3
+
+				err := s.Put("archive.tar", strings.NewReader("hello"))
+				g.Assert(err == syscall.ECONNRESET).IsTrue("failed to return last error")
+				g.Assert(calls["put"]).Equal(3)
+			})
+		})
+
+		g.Describe("Get", func() {
+			g.It("Should not retry a missing file", func() {
+				var buf bytes.Buffer
+				err := s.Get("missing.tar", &buf)
+
+				g.Assert(storage.IsNotFound(err)).IsTrue("failed to return not found")
+				g.Assert(calls["get"]).Equal(1)
+			})
+
+			g.It("Should skip what was already written", func() {
+				m, _ := memory.New(nil)
+				m.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+
+				f := &flakyStorage{Storage: m, failAfter: 4}
+				s := newTestStorage(f, 3)
+
+				var buf bytes.Buffer
+				err := s.Get("archive.tar", &buf)
+				g.Assert(err == nil).IsTrue("failed to get")
+				g.Assert(buf.String()).Equal("hello\ngo\n")
+			})
+
+			g.It("Should not resume a file that changed", func() {
+				m, _ := memory.New(nil)
+				m.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+
+				f := &flakyStorage{Storage: m, failAfter: 4}
+				f.change = func() {
+					m.Put("archive.tar", strings.NewReader("goodbye\ngo\n"))
+				}
+				s := newTestStorage(f, 3)
+
+				var buf bytes.Buffer
+				err := s.Get("archive.tar", &buf)
+				g.Assert(err == nil).IsFalse("failed to return error")
+				g.Assert(buf.String()).Equal("hell")
+			})
+		})
+
+		g.Describe("List and Delete", func() {
+			g.It("Should retry", func() {
+				fails["list"] = 1
+				fails["delete"] = 1
+
+				_, err := s.List("")
+				g.Assert(err == nil).IsTrue("failed to list")
+				g.Assert(s.Delete("archive.tar") == nil).IsTrue("failed to delete")
+				g.Assert(calls["list"]).Equal(2)
+				g.Assert(calls["delete"]).Equal(2)
+			})
+		})
+
+		g.Describe("IsRetryable", func() {
+			g.It("Should classify errors", func() {
+				g.Assert(IsRetryable(syscall.ECONNRESET)).IsTrue("connection reset is retryable")
+				g.Assert(IsRetryable(temporary(true))).IsTrue("temporary errors are retryable")
+				g.Assert(IsRetryable(errors.New("403 Forbidden"))).IsFalse("unknown errors are permanent")
+				g.Assert(IsRetryable(storage.NotFound("archive.tar", nil))).IsFalse("not found is permanent")
+				g.Assert(IsRetryable(temporary(false))).IsFalse("non-temporary errors are permanent")
+			})
+
+			g.It("Should retry a refused connection", func() {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				g.Assert(err == nil).IsTrue("failed to listen")
+				addr := l.Addr().String()
+				l.Close()
+
+				_, err = net.Dial("tcp", addr)
+				g.Assert(err == nil).IsFalse("failed to refuse connection")
+				g.Assert(IsRetryable(err)).IsTrue("refused connections are retryable")
+			})
+		})
+
+		g.Describe("backoff", func() {
+			g.It("Should grow exponentially up to the maximum", func() {
+				r, _ := New(nil, &Options{InitialBackoff: time.Second, MaxBackoff: 3 * time.Second, Jitter: 0})
+				rs := r.(*retryStorage)
+
+				g.Assert(rs.backoff(1)).Equal(time.Second)
+				g.Assert(rs.backoff(2)).Equal(2 * time.Second)
+				g.Assert(rs.backoff(3)).Equal(3 * time.Second)
+			})
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		m, _ := memory.New(nil)
+		return newTestStorage(m, 3)
+	})
+}
+
+func newTestStorage(s storage.Storage, attempts int) storage.Storage {
+	r, _ := New(s, &Options{Attempts: attempts})
+	r.(*retryStorage).sleep = func(time.Duration) {}
+	return r
+}
+
+func memoryStorage() storage.Storage {
+	m, _ := memory.New(nil)
+	return m
+}
+
+// partialStorage fails the first uploads after reading part of the source.
+type partialStorage struct {
+	storage.Storage
+	fails int
+	calls int
+}
+
+func (s *partialStorage) Put(p string, src io.Reader) error {
+	s.calls++
+
+	if s.fails > 0 {
+		s.fails--
+		src.Read(make([]byte, 4))
+		return syscall.ECONNRESET
+	}
+
+	return s.Storage.Put(p, src)
+}
+
+// flakyStorage fails the first download after writing failAfter bytes.
+type flakyStorage struct {
+	storage.Storage
+	failAfter int
+	failed    bool
+
+	// change is called after the failed download, if set
+	change func()
+}
+
+func (s *flakyStorage) Stat(p string) (storage.FileEntry, error) {
+	return storage.Stat(s.Storage, p)
+}
+
+func (s *flakyStorage) Get(p string, dst io.Writer) error {
+	if s.failed {
+		return s.Storage.Get(p, dst)
+	}
+
+	s.failed = true
+
+	var buf bytes.Buffer
+	if err := s.Storage.Get(p, &buf); err != nil {
+		return err
+	}
+
+	dst.Write(buf.Bytes()[:s.failAfter])
+
+	if s.change != nil {
+		s.change()
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+type temporary bool
+
+func (e temporary) Error() string   { return "temporary" }
+func (e temporary) Temporary() bool { return bool(e) }
@@ -0,0 +1,45 @@
+package storage
+
+// Stater is implemented by storages that can look up a single file without
+// listing or downloading it.
+type Stater interface {
+	// Stat returns the entry of the file. It returns an error matching
+	// IsNotFound if the file does not exist.
+	Stat(p string) (FileEntry, error)
+}
+
+// Stat returns the entry of the file p. It uses the Stater capability of the
+// storage when available and falls back to List otherwise.
+func Stat(s Storage, p string) (FileEntry, error) {
+	if st, ok := s.(Stater); ok {
+		return st.Stat(p)
+	}
+
+	files, err := s.List(p)
+	if err != nil {
+		return FileEntry{}, err
+	}
+
+	for _, file := range files {
+		if file.Path == p {
+			return file, nil
+		}
+	}
+
+	return FileEntry{}, NotFound(p, nil)
+}
+
+// Exists reports whether the file p exists in the storage.
+func Exists(s Storage, p string) (bool, error) {
+	_, err := Stat(s, p)
+
+	if IsNotFound(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/franela/goblin"
+)
+
+func TestStat(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("Stat", func() {
+		g.It("Should fall back to List", func() {
+			s := listStorage{
+				{Path: "proj/archive.tar.gz", Size: 4},
+				{Path: "proj/archive.tar", Size: 9, LastModified: time.Now()},
+			}
+
+			file, err := Stat(s, "proj/archive.tar")
+			g.Assert(err == nil).IsTrue("failed to stat")
+			g.Assert(file.Size).Equal(int64(9))
+		})
+
+		g.It("Should return not found from List", func() {
+			s := listStorage{{Path: "proj/archive.tar.gz", Size: 4}}
+
+			_, err := Stat(s, "proj/archive.tar")
+			g.Assert(IsNotFound(err)).IsTrue("failed to return not found")
+
+			ok, err := Exists(s, "proj/archive.tar")
+			g.Assert(err == nil).IsTrue("failed to check existence")
+			g.Assert(ok).IsFalse("reported missing file as existing")
+		})
+	})
+}
+
+// listStorage only supports List.
+type listStorage []FileEntry
+
+func (s listStorage) Get(p string, dst io.Writer) error { return errors.New("not supported") }
+func (s listStorage) Put(p string, src io.Reader) error { return errors.New("not supported") }
+func (s listStorage) Delete(p string) error             { return errors.New("not supported") }
+
+func (s listStorage) List(p string) ([]FileEntry, error) {
+	return s, nil
+}
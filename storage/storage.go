@@ -10,12 +10,37 @@ type FileEntry struct {
 	Path         string
 	Size         int64
 	LastModified time.Time
+
+	// LastAccessed is the last time the item was restored. It is zero when
+	// the access time is unknown.
+	LastAccessed time.Time
+}
+
+// LastUsed returns the later of the modification and access time.
+func (f FileEntry) LastUsed() time.Time {
+	if f.LastAccessed.After(f.LastModified) {
+		return f.LastAccessed
+	}
+
+	return f.LastModified
 }
 
 // Storage is a place that files can be written to and read from.
+//
+// The storagetest package checks an implementation against these semantics.
 type Storage interface {
+	// Get writes the content of the file to dst. It returns an error
+	// matching IsNotFound if the file does not exist.
 	Get(p string, dst io.Writer) error
+
+	// Put stores the content of src, replacing any existing file. A failed
+	// Put must not leave a partial file behind.
 	Put(p string, src io.Reader) error
+
+	// List returns all files whose path starts with the prefix p. Listing a
+	// prefix without files returns an empty list.
 	List(p string) ([]FileEntry, error)
+
+	// Delete removes the file. Deleting a missing file is not an error.
 	Delete(p string) error
 }
@@ -0,0 +1,479 @@
+// Package storagetest provides a conformance suite for implementations of
+// storage.Storage.
+//
+// A backend runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			s, _ := mybackend.New(opts)
+//			return s
+//		})
+//	}
+package storagetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// Factory returns an empty storage for a single test.
+type Factory func(t *testing.T) storage.Storage
+
+// Run runs the conformance suite against the storage returned by fn. Every
+// test gets its own storage from fn.
+func Run(t *testing.T, fn Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, storage.Storage)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"EmptyFile", testEmptyFile},
+		{"LargeFile", testLargeFile},
+		{"Overwrite", testOverwrite},
+		{"FailedPut", testFailedPut},
+		{"GetMissing", testGetMissing},
+		{"DeleteMissing", testDeleteMissing},
+		{"Delete", testDelete},
+		{"ListPrefix", testListPrefix},
+		{"ListMissing", testListMissing},
+		{"ListEntries", testListEntries},
+		{"Stat", testStat},
+		{"StatMissing", testStatMissing},
+		{"Concurrent", testConcurrent},
+		{"ConcurrentOverwrite", testConcurrentOverwrite},
+		{"Create", testCreate},
+		{"ConcurrentCreate", testConcurrentCreate},
+		{"Rename", testRename},
+		{"RenameMissing", testRenameMissing},
+	}
+
+	for _, tt := range tests {
+		test := tt.test
+		t.Run(tt.name, func(t *testing.T) {
+			test(t, fn(t))
+		})
+	}
+}
+
+func testRoundTrip(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/roundtrip.tar", "hello\ngo\n")
+
+	if got := get(t, s, "storagetest/roundtrip.tar"); got != "hello\ngo\n" {
+		t.Errorf("Get returned %q, want %q", got, "hello\ngo\n")
+	}
+}
+
+func testEmptyFile(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/empty.tar", "")
+
+	if got := get(t, s, "storagetest/empty.tar"); got != "" {
+		t.Errorf("Get returned %q, want empty content", got)
+	}
+}
+
+func testLargeFile(t *testing.T, s storage.Storage) {
+	const size = 16 << 20
+
+	// Stream through a pipe so the backend can't rely on a seekable source
+	reader, writer := io.Pipe()
+	want := sha256.New()
+
+	go func() {
+		_, err := io.CopyN(io.MultiWriter(writer, want), rand.New(rand.NewSource(1)), size)
+		writer.CloseWithError(err)
+	}()
+
+	if err := s.Put("storagetest/large.tar", reader); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+
+	got := sha256.New()
+	n := &countWriter{w: got}
+	if err := s.Get("storagetest/large.tar", n); err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+
+	if n.n != size {
+		t.Fatalf("Get returned %d bytes, want %d", n.n, size)
+	}
+
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		t.Errorf("Get returned different content than was put")
+	}
+}
+
+func testOverwrite(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/overwrite.tar", "a much longer first version")
+	put(t, s, "storagetest/overwrite.tar", "second")
+
+	if got := get(t, s, "storagetest/overwrite.tar"); got != "second" {
+		t.Errorf("Get returned %q, want %q", got, "second")
+	}
+}
+
+func testFailedPut(t *testing.T, s storage.Storage) {
+	src := io.MultiReader(strings.NewReader("partial"), errReader{})
+
+	if err := s.Put("storagetest/failed.tar", src); err == nil {
+		t.Fatalf("Put with a failing source returned no error")
+	}
+
+	var buf bytes.Buffer
+	if err := s.Get("storagetest/failed.tar", &buf); !storage.IsNotFound(err) {
+		t.Errorf("Get after a failed Put returned %v, want an error matching storage.IsNotFound", err)
+	}
+}
+
+func testGetMissing(t *testing.T, s storage.Storage) {
+	var buf bytes.Buffer
+
+	err := s.Get("storagetest/missing.tar", &buf)
+	if err == nil {
+		t.Fatalf("Get of a missing file returned no error")
+	}
+
+	if !storage.IsNotFound(err) {
+		t.Errorf("Get of a missing file returned %q, want an error matching storage.IsNotFound", err)
+	}
+}
+
+func testDeleteMissing(t *testing.T, s storage.Storage) {
+	if err := s.Delete("storagetest/missing.tar"); err != nil {
+		t.Errorf("Delete of a missing file failed: %s", err)
+	}
+}
+
+func testDelete(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/delete.tar", "hello")
+
+	if err := s.Delete("storagetest/delete.tar"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Get("storagetest/delete.tar", &buf); !storage.IsNotFound(err) {
+		t.Errorf("Get of a deleted file returned %v, want an error matching storage.IsNotFound", err)
+	}
+
+	if files := list(t, s, "storagetest/"); len(files) != 0 {
+		t.Errorf("List returned %v after Delete, want nothing", files)
+	}
+}
+
+func testListPrefix(t *testing.T, s storage.Storage) {
+	for _, p := range []string{
+		"storagetest/a/b/1.tar",
+		"storagetest/a/b/2.tar",
+		"storagetest/a/c/1.tar",
+		"storagetest/ab/1.tar",
+	} {
+		put(t, s, p, p)
+	}
+
+	cases := []struct {
+		prefix string
+		want   []string
+	}{
+		{"storagetest/a/b/", []string{"storagetest/a/b/1.tar", "storagetest/a/b/2.tar"}},
+		{"storagetest/a/", []string{"storagetest/a/b/1.tar", "storagetest/a/b/2.tar", "storagetest/a/c/1.tar"}},
+		{"storagetest/a", []string{"storagetest/a/b/1.tar", "storagetest/a/b/2.tar", "storagetest/a/c/1.tar", "storagetest/ab/1.tar"}},
+		{"storagetest/a/b/1", []string{"storagetest/a/b/1.tar"}},
+	}
+
+	for _, c := range cases {
+		got := paths(list(t, s, c.prefix))
+
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("List(%q) returned %v, want %v", c.prefix, got, c.want)
+		}
+	}
+}
+
+func testListMissing(t *testing.T, s storage.Storage) {
+	if files := list(t, s, "storagetest/missing/"); len(files) != 0 {
+		t.Errorf("List of a missing prefix returned %v, want nothing", files)
+	}
+}
+
+func testListEntries(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/entries.tar", "hello\ngo\n")
+
+	files := list(t, s, "storagetest/entries.tar")
+	if len(files) != 1 {
+		t.Fatalf("List returned %d files, want 1", len(files))
+	}
+
+	if files[0].Path != "storagetest/entries.tar" {
+		t.Errorf("List returned path %q, want %q", files[0].Path, "storagetest/entries.tar")
+	}
+
+	if files[0].Size != 9 {
+		t.Errorf("List returned size %d, want 9", files[0].Size)
+	}
+
+	if files[0].LastModified.IsZero() {
+		t.Errorf("List returned no modification time")
+	}
+}
+
+func testStat(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/stat.tar", "hello\ngo\n")
+	put(t, s, "storagetest/stat.tar.gz", "hello")
+
+	file, err := storage.Stat(s, "storagetest/stat.tar")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+
+	if file.Path != "storagetest/stat.tar" || file.Size != 9 {
+		t.Errorf("Stat returned %s with size %d, want storagetest/stat.tar with size 9", file.Path, file.Size)
+	}
+
+	if file.LastModified.IsZero() {
+		t.Errorf("Stat returned no modification time")
+	}
+}
+
+func testStatMissing(t *testing.T, s storage.Storage) {
+	// A file sharing the prefix must not be mistaken for the missing one
+	put(t, s, "storagetest/missing.tar.gz", "hello")
+
+	if _, err := storage.Stat(s, "storagetest/missing.tar"); !storage.IsNotFound(err) {
+		t.Errorf("Stat of a missing file returned %v, want an error matching storage.IsNotFound", err)
+	}
+
+	if ok, err := storage.Exists(s, "storagetest/missing.tar"); ok || err != nil {
+		t.Errorf("Exists of a missing file returned %t, %v", ok, err)
+	}
+}
+
+func testConcurrent(t *testing.T, s storage.Storage) {
+	const workers = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			p := fmt.Sprintf("storagetest/concurrent/%d.tar", i)
+			content := strings.Repeat(p, 1000)
+
+			if err := s.Put(p, strings.NewReader(content)); err != nil {
+				errs <- err
+				return
+			}
+
+			var buf bytes.Buffer
+			if err := s.Get(p, &buf); err != nil {
+				errs <- err
+				return
+			}
+
+			if buf.String() != content {
+				errs <- fmt.Errorf("Get of %s returned different content than was put", p)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if files := list(t, s, "storagetest/concurrent/"); len(files) != workers {
+		t.Errorf("List returned %d files, want %d", len(files), workers)
+	}
+}
+
+func testConcurrentOverwrite(t *testing.T, s storage.Storage) {
+	const workers = 8
+
+	contents := make(map[string]bool)
+	for i := 0; i < workers; i++ {
+		contents[strings.Repeat(fmt.Sprint(i), 10000)] = true
+	}
+
+	var wg sync.WaitGroup
+	for content := range contents {
+		wg.Add(1)
+
+		go func(content string) {
+			defer wg.Done()
+
+			if err := s.Put("storagetest/overwrite.tar", strings.NewReader(content)); err != nil {
+				t.Errorf("Put failed: %s", err)
+			}
+		}(content)
+	}
+
+	wg.Wait()
+
+	// The last writer wins, but the content must never be interleaved
+	if got := get(t, s, "storagetest/overwrite.tar"); !contents[got] {
+		t.Errorf("Get returned content that was never put")
+	}
+}
+
+func testCreate(t *testing.T, s storage.Storage) {
+	if err := storage.Create(s, "storagetest/create.lock", strings.NewReader("first")); err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+
+	err := storage.Create(s, "storagetest/create.lock", strings.NewReader("second"))
+	if !storage.IsAlreadyExists(err) {
+		t.Errorf("Create of an existing file returned %v, want an error matching storage.IsAlreadyExists", err)
+	}
+
+	if got := get(t, s, "storagetest/create.lock"); got != "first" {
+		t.Errorf("Create replaced the existing file with %q", got)
+	}
+}
+
+func testConcurrentCreate(t *testing.T, s storage.Storage) {
+	if _, ok := s.(storage.Creator); !ok {
+		t.Skip("storage does not implement storage.Creator")
+	}
+
+	const workers = 8
+
+	var wg sync.WaitGroup
+	created := make(chan string, workers)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func(content string) {
+			defer wg.Done()
+
+			err := storage.Create(s, "storagetest/concurrent.lock", strings.NewReader(content))
+
+			switch {
+			case err == nil:
+				created <- content
+			case !storage.IsAlreadyExists(err):
+				t.Errorf("Create failed: %s", err)
+			}
+		}(fmt.Sprint(i))
+	}
+
+	wg.Wait()
+	close(created)
+
+	var winners []string
+	for content := range created {
+		winners = append(winners, content)
+	}
+
+	if len(winners) != 1 {
+		t.Fatalf("Create succeeded %d times, want once", len(winners))
+	}
+
+	if got := get(t, s, "storagetest/concurrent.lock"); got != winners[0] {
+		t.Errorf("Get returned %q, want the content of the successful Create %q", got, winners[0])
+	}
+}
+
+func testRename(t *testing.T, s storage.Storage) {
+	put(t, s, "storagetest/rename.tar.tmp", "new")
+	put(t, s, "storagetest/rename.tar", "old")
+
+	err := storage.Rename(s, "storagetest/rename.tar.tmp", "storagetest/rename.tar")
+	if err == storage.ErrNotSupported {
+		t.Skip("storage does not support renaming")
+	}
+	if err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+
+	if got := get(t, s, "storagetest/rename.tar"); got != "new" {
+		t.Errorf("Get after Rename returned %q, want %q", got, "new")
+	}
+
+	if ok, err := storage.Exists(s, "storagetest/rename.tar.tmp"); ok || err != nil {
+		t.Errorf("Rename kept the source file")
+	}
+}
+
+func testRenameMissing(t *testing.T, s storage.Storage) {
+	err := storage.Rename(s, "storagetest/missing.tar.tmp", "storagetest/missing.tar")
+	if err == storage.ErrNotSupported {
+		t.Skip("storage does not support renaming")
+	}
+
+	if !storage.IsNotFound(err) {
+		t.Errorf("Rename of a missing file returned %v, want an error matching storage.IsNotFound", err)
+	}
+}
+
+func put(t *testing.T, s storage.Storage, p, content string) {
+	t.Helper()
+
+	if err := s.Put(p, strings.NewReader(content)); err != nil {
+		t.Fatalf("Put of %s failed: %s", p, err)
+	}
+}
+
+func get(t *testing.T, s storage.Storage, p string) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := s.Get(p, &buf); err != nil {
+		t.Fatalf("Get of %s failed: %s", p, err)
+	}
+
+	return buf.String()
+}
+
+func list(t *testing.T, s storage.Storage, p string) []storage.FileEntry {
+	t.Helper()
+
+	files, err := s.List(p)
+	if err != nil {
+		t.Fatalf("List of %s failed: %s", p, err)
+	}
+
+	return files
+}
+
+func paths(files []storage.FileEntry) []string {
+	var p []string
+	for _, file := range files {
+		p = append(p, file.Path)
+	}
+
+	sort.Strings(p)
+	return p
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("storagetest: source failed")
+}
@@ -0,0 +1,413 @@
+package tiered
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drone/drone-cache-lib/logger"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/internal/stream"
+)
+
+// Options contains configuration for the tiered storage.
+type Options struct {
+	// MaxAge is how long a file in the local tier is served without going
+	// to the remote tier. It defaults to one hour.
+	MaxAge time.Duration
+
+	// Validate compares the local file with the remote one before serving
+	// it and fetches the remote file again when it is newer.
+	Validate bool
+
+	// WriteBack makes Put return once the local tier has the file and
+	// upload it to the remote tier in the background. Close waits for
+	// pending uploads.
+	WriteBack bool
+
+	// MaxSize bounds the total size of the local tier in bytes. The least
+	// recently used files are evicted when it is exceeded. Zero means no
+	// bound.
+	MaxSize int64
+
+	// Logger receives log messages. Nothing is logged by default.
+	Logger logger.Logger
+}
+
+type tieredStorage struct {
+	local  storage.Storage
+	remote storage.Storage
+	opts   Options
+	now    func() time.Time
+
+	mu      sync.Mutex
+	used    map[string]time.Time
+	pending map[string]int
+	idle    *sync.Cond
+
+	wg   sync.WaitGroup
+	errs []error
+}
+
+// New creates an implementation of Storage that serves files from the fast
+// local tier when possible and from the remote tier otherwise. Files read
+// from the remote tier are copied to the local tier while they stream.
+//
+// The returned storage implements io.Closer. Close waits for write-back
+// uploads and returns the first one that failed.
+func New(local, remote storage.Storage, opts *Options) (storage.Storage, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	o.Logger = logger.OrDiscard(o.Logger)
+
+	if o.MaxAge <= 0 {
+		o.MaxAge = time.Hour
+	}
+
+	s := &tieredStorage{
+		local:   local,
+		remote:  remote,
+		opts:    o,
+		now:     time.Now,
+		used:    make(map[string]time.Time),
+		pending: make(map[string]int),
+	}
+	s.idle = sync.NewCond(&s.mu)
+
+	return s, nil
+}
+
+func (s *tieredStorage) Get(p string, dst io.Writer) error {
+	if s.fresh(p) {
+		w := &stream.CountWriter{W: dst}
+		err := s.local.Get(p, w)
+
+		// Fall back to the remote tier if the file was evicted meanwhile
+		if err == nil || w.N > 0 || !storage.IsNotFound(err) {
+			return err
+		}
+	}
+
+	s.opts.Logger.Debugf("Fetching %s from the remote tier", p)
+
+	// Populate the local tier while streaming to dst
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		err := s.local.Put(p, reader)
+		reader.CloseWithError(err)
+		done <- err
+	}()
+
+	err := s.remote.Get(p, io.MultiWriter(dst, &stream.DropWriter{W: writer}))
+	writer.CloseWithError(err)
+
+	if lerr := <-done; err == nil && lerr != nil {
+		s.opts.Logger.Warnf("Failed to populate local tier with %s: %s", p, lerr)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.touch(p)
+	s.evict()
+
+	return nil
+}
+
+func (s *tieredStorage) Put(p string, src io.Reader) error {
+	if s.opts.WriteBack {
+		return s.putWriteBack(p, src)
+	}
+
+	// Write to both tiers while reading src once
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+
+	go func() {
+		err := s.local.Put(p, reader)
+		reader.CloseWithError(err)
+		done <- err
+	}()
+
+	err := s.remote.Put(p, io.TeeReader(src, &stream.DropWriter{W: writer}))
+	writer.CloseWithError(err)
+
+	if lerr := <-done; err == nil && lerr != nil {
+		// The remote tier has the file, so only the local copy is lost
+		s.opts.Logger.Warnf("Failed to write %s to local tier: %s", p, lerr)
+		s.local.Delete(p)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.touch(p)
+	s.evict()
+
+	return nil
+}
+
+func (s *tieredStorage) putWriteBack(p string, src io.Reader) error {
+	if err := s.local.Put(p, src); err != nil {
+		return err
+	}
+
+	s.touch(p)
+
+	s.mu.Lock()
+	s.pending[p]++
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+
+	go func() {
+		defer s.wg.Done()
+
+		err := s.upload(p)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if s.pending[p]--; s.pending[p] == 0 {
+			delete(s.pending, p)
+			s.idle.Broadcast()
+		}
+
+		if err != nil {
+			s.opts.Logger.Warnf("Failed to write %s back to remote tier: %s", p, err)
+			s.errs = append(s.errs, err)
+		}
+	}()
+
+	s.evict()
+
+	return nil
+}
+
+// upload copies the local file to the remote tier.
+func (s *tieredStorage) upload(p string) error {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(s.local.Get(p, writer))
+	}()
+
+	err := s.remote.Put(p, reader)
+	reader.CloseWithError(err)
+
+	return err
+}
+
+func (s *tieredStorage) List(p string) ([]storage.FileEntry, error) {
+	files, err := s.remote.List(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.opts.WriteBack {
+		return files, nil
+	}
+
+	// Include files that are not written back yet
+	seen := make(map[string]bool)
+	for _, file := range files {
+		seen[file.Path] = true
+	}
+
+	local, err := s.local.List(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range local {
+		if !seen[file.Path] {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+func (s *tieredStorage) Stat(p string) (storage.FileEntry, error) {
+	if s.fresh(p) {
+		file, err := storage.Stat(s.local, p)
+		if err == nil {
+			return file, nil
+		}
+	}
+
+	return storage.Stat(s.remote, p)
+}
+
+// Rename renames the file in the remote tier and drops the local copies,
+// after the file was written back.
+func (s *tieredStorage) Rename(src, dst string) error {
+	s.wait(src)
+
+	if err := storage.Rename(s.remote, src, dst); err != nil {
+		return err
+	}
+
+	for _, p := range []string{src, dst} {
+		s.wait(p)
+
+		if err := s.local.Delete(p); err != nil {
+			s.opts.Logger.Warnf("Failed to delete %s from local tier: %s", p, err)
+		}
+
+		s.mu.Lock()
+		delete(s.used, p)
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (s *tieredStorage) Delete(p string) error {
+	// A pending upload would write the file back after it was deleted
+	s.wait(p)
+
+	if err := s.local.Delete(p); err != nil {
+		s.opts.Logger.Warnf("Failed to delete %s from local tier: %s", p, err)
+	}
+
+	s.mu.Lock()
+	delete(s.used, p)
+	s.mu.Unlock()
+
+	return s.remote.Delete(p)
+}
+
+// Unwrap returns the remote tier.
+func (s *tieredStorage) Unwrap() storage.Storage {
+	return s.remote
+}
+
+// Close waits for pending write-back uploads.
+func (s *tieredStorage) Close() error {
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.errs) > 0 {
+		return s.errs[0]
+	}
+
+	return nil
+}
+
+// wait waits until the file has no pending write-back uploads.
+func (s *tieredStorage) wait(p string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.pending[p] > 0 {
+		s.idle.Wait()
+	}
+}
+
+// fresh reports whether the local tier has a copy of the file that can be
+// served.
+func (s *tieredStorage) fresh(p string) bool {
+	file, err := storage.Stat(s.local, p)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	pending := s.pending[p] > 0
+	s.mu.Unlock()
+
+	// Files that are not written back yet are the newest version
+	if pending {
+		return true
+	}
+
+	if s.opts.MaxAge > 0 && s.now().Sub(file.LastModified) > s.opts.MaxAge {
+		return false
+	}
+
+	if s.opts.Validate {
+		remote, err := storage.Stat(s.remote, p)
+		if err != nil || remote.LastModified.After(file.LastModified) {
+			return false
+		}
+	}
+
+	s.touch(p)
+
+	return true
+}
+
+// touch records the use of a local file for eviction.
+func (s *tieredStorage) touch(p string) {
+	s.mu.Lock()
+	s.used[p] = s.now()
+	s.mu.Unlock()
+}
+
+// evict removes the least recently used files from the local tier until it
+// fits into MaxSize.
+func (s *tieredStorage) evict() {
+	if s.opts.MaxSize <= 0 {
+		return
+	}
+
+	files, err := s.local.List("")
+	if err != nil {
+		s.opts.Logger.Warnf("Failed to list local tier: %s", err)
+		return
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+
+	if total <= s.opts.MaxSize {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range files {
+		if t, ok := s.used[files[i].Path]; ok {
+			files[i].LastAccessed = t
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].LastUsed().Before(files[j].LastUsed())
+	})
+
+	for _, file := range files {
+		if total <= s.opts.MaxSize {
+			break
+		}
+
+		// Keep files that still have to be written back
+		if s.pending[file.Path] > 0 {
+			continue
+		}
+
+		s.opts.Logger.Debugf("Evicting %s from local tier", file.Path)
+
+		if err := s.local.Delete(file.Path); err != nil {
+			s.opts.Logger.Warnf("Failed to evict %s from local tier: %s", file.Path, err)
+			continue
+		}
+
+		delete(s.used, file.Path)
+		total -= file.Size
+	}
+}
@@ -0,0 +1,175 @@
+package tiered
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/drone/drone-cache-lib/storage/memory"
+	"github.com/drone/drone-cache-lib/storage/storagetest"
+	"github.com/franela/goblin"
+)
+
+func TestTieredStorage(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("tiered package", func() {
+		var (
+			local, remote storage.Storage
+			remoteGets    int
+		)
+
+		g.BeforeEach(func() {
+			remoteGets = 0
+			local, _ = memory.New(nil)
+			remote, _ = memory.New(&memory.Options{Fail: func(op, p string) error {
+				if op == "get" {
+					remoteGets++
+				}
+				return nil
+			}})
+		})
+
+		g.Describe("Get", func() {
+			g.It("Should populate the local tier from the remote tier", func() {
+				remote.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				s, _ := New(local, remote, nil)
+
+				g.Assert(get(s, "archive.tar")).Equal("hello\ngo\n")
+				g.Assert(get(local, "archive.tar")).Equal("hello\ngo\n")
+
+				g.Assert(get(s, "archive.tar")).Equal("hello\ngo\n")
+				g.Assert(remoteGets).Equal(1)
+			})
+
+			g.It("Should fetch stale files again", func() {
+				remote.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				s, _ := New(local, remote, &Options{MaxAge: time.Hour})
+				ts := s.(*tieredStorage)
+
+				get(s, "archive.tar")
+				ts.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+				get(s, "archive.tar")
+
+				g.Assert(remoteGets).Equal(2)
+			})
+
+			g.It("Should fetch files again after an hour by default", func() {
+				remote.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				s, _ := New(local, remote, nil)
+				ts := s.(*tieredStorage)
+
+				get(s, "archive.tar")
+				ts.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+				get(s, "archive.tar")
+
+				g.Assert(remoteGets).Equal(2)
+			})
+
+			g.It("Should not populate the local tier on failure", func() {
+				s, _ := New(local, remote, nil)
+
+				var buf bytes.Buffer
+				err := s.Get("missing.tar", &buf)
+				g.Assert(storage.IsNotFound(err)).IsTrue("failed to return not found")
+
+				ok, _ := storage.Exists(local, "missing.tar")
+				g.Assert(ok).IsFalse("populated local tier with missing file")
+			})
+		})
+
+		g.Describe("Put", func() {
+			g.It("Should write through to both tiers", func() {
+				s, _ := New(local, remote, nil)
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(get(local, "archive.tar")).Equal("hello\ngo\n")
+				g.Assert(get(remote, "archive.tar")).Equal("hello\ngo\n")
+			})
+
+			g.It("Should write back to the remote tier", func() {
+				s, _ := New(local, remote, &Options{WriteBack: true})
+
+				err := s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				g.Assert(err == nil).IsTrue("failed to put")
+				g.Assert(s.(io.Closer).Close() == nil).IsTrue("failed to write back")
+				g.Assert(get(remote, "archive.tar")).Equal("hello\ngo\n")
+			})
+		})
+
+		g.Describe("Delete", func() {
+			g.It("Should wait for the file to be written back", func() {
+				release := make(chan struct{})
+				remote, _ := memory.New(&memory.Options{Fail: func(op, p string) error {
+					if op == "put" {
+						<-release
+					}
+					return nil
+				}})
+				s, _ := New(local, remote, &Options{WriteBack: true})
+
+				s.Put("archive.tar", strings.NewReader("hello\ngo\n"))
+				time.AfterFunc(10*time.Millisecond, func() { close(release) })
+
+				g.Assert(s.Delete("archive.tar") == nil).IsTrue("failed to delete")
+				g.Assert(s.(io.Closer).Close() == nil).IsTrue("failed to write back")
+
+				ok, _ := storage.Exists(remote, "archive.tar")
+				g.Assert(ok).IsFalse("wrote back deleted file")
+			})
+		})
+
+		g.Describe("Eviction", func() {
+			g.It("Should evict the least recently used files", func() {
+				s, _ := New(local, remote, &Options{MaxSize: 10})
+				ts := s.(*tieredStorage)
+
+				now := time.Now()
+				ts.now = func() time.Time { return now }
+
+				s.Put("a.tar", strings.NewReader("aaaa"))
+				now = now.Add(time.Minute)
+				s.Put("b.tar", strings.NewReader("bbbb"))
+				now = now.Add(time.Minute)
+				get(s, "a.tar")
+				now = now.Add(time.Minute)
+				s.Put("c.tar", strings.NewReader("cccc"))
+
+				files, _ := local.List("")
+				g.Assert(len(files)).Equal(2)
+				g.Assert(files[0].Path).Equal("a.tar")
+				g.Assert(files[1].Path).Equal("c.tar")
+			})
+		})
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		local, _ := memory.New(nil)
+		remote, _ := memory.New(nil)
+
+		s, _ := New(local, remote, nil)
+		return s
+	})
+}
+
+func TestConformanceWriteBack(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		local, _ := memory.New(nil)
+		remote, _ := memory.New(nil)
+
+		s, _ := New(local, remote, &Options{WriteBack: true})
+		return s
+	})
+}
+
+func get(s storage.Storage, p string) string {
+	var buf bytes.Buffer
+	s.Get(p, &buf)
+	return buf.String()
+}
@@ -0,0 +1,10 @@
+package storage
+
+// Wrapper is implemented by storages that forward every operation to another
+// storage, adding behaviour like retries or metrics on the way. Capabilities
+// of the wrapped storage that the wrapper doesn't forward are found through
+// it.
+type Wrapper interface {
+	// Unwrap returns the wrapped storage.
+	Unwrap() Storage
+}